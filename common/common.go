@@ -1,10 +1,13 @@
 package common
 
 import (
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"time"
 )
 
 //---------------------------------------------------------------------------
@@ -56,17 +59,119 @@ func PosixFileName(input string) string {
 }
 
 //
-// Creates a file containing the bytes given
+// Writes a file without ever leaving it half written.
+// The bytes go to a temporary file which is synced and renamed over the file.
+//
+func WriteFileAtomic(blob []byte, location string) error {
+	tmp_location := location + ".tmp"
+	file_p, err := os.OpenFile(tmp_location, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file_p.Write(blob)
+	if err == nil {
+		err = file_p.Sync()
+	}
+	if close_err := file_p.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(tmp_location, location)
+	}
+	if err != nil {
+		os.Remove(tmp_location)
+		return err
+	}
+	return SyncDir(filepath.Dir(location))
+}
+
+//
+// Keeps the current version of a file as a ".bak" next to it,
+// linking it where possible so the file is never missing
+//
+func KeepPrevious(location string) error {
+	if _, err := os.Stat(location); os.IsNotExist(err) {
+		return nil
+	}
+	bak_location := location + ".bak"
+	tmp_bak_location := bak_location + ".tmp"
+	os.Remove(tmp_bak_location)
+	if os.Link(location, tmp_bak_location) != nil {
+		blob, err := ioutil.ReadFile(location)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(tmp_bak_location, blob, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp_bak_location, bak_location)
+}
+
+//
+// Syncs a directory so renames in it survive a crash
+//
+func SyncDir(dir string) error {
+	dir_p, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dir_p.Close()
+	// not every system can sync a directory
+	dir_p.Sync()
+	return nil
+}
+
+//
+// Creates or replaces a file containing the bytes given.
+// The file is locked, its previous version kept as a ".bak"
+// and the new version written atomically.
 //
 func SaveBlob(blob []byte, location string) {
+	lock, err := LockFile(location)
+	CheckErr(err)
+	defer lock.Unlock()
+
+	err = KeepPrevious(location)
+	CheckErr(err)
+	err = WriteFileAtomic(blob, location)
+	CheckErr(err)
+}
+
+//
+// Gets a timestamped location next to a file for a backup of it
+//
+func BackupLocation(location string) string {
+	return location + "." + time.Now().Format("20060102T150405") + ".bak"
+}
+
+//
+// Copies a file to a backup location
+//
+func CopyToBackup(location string, backup_location string) {
 	var err error
-	var file_p *os.File
-	file_p, err = os.Create(location)
+	var blob []byte
+	var info os.FileInfo
+
+	info, err = os.Stat(location)
 	CheckErr(err)
-	_, err = file_p.Write(blob)
+	blob, err = ioutil.ReadFile(location)
 	CheckErr(err)
-	err = file_p.Close()
+
+	err = ioutil.WriteFile(backup_location, blob, info.Mode())
 	CheckErr(err)
+	log.Printf("Backed up '%s' to '%s'.\n", location, backup_location)
+}
+
+//
+// Copies a file to a timestamped backup next to it
+// and returns the location of the backup
+//
+func BackupFile(location string) string {
+	backup_location := BackupLocation(location)
+	CopyToBackup(location, backup_location)
+	return backup_location
 }
 
 //
@@ -0,0 +1,448 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Directory in the media root where journals are kept
+//
+const JOURNAL_DIR = "journal"
+
+//
+// How long finished and undone journals are kept for undoing,
+// they are removed when a new journal is made
+//
+const JOURNAL_MAX_AGE = 90 * 24 * time.Hour
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// A record of an ingestion's plan and how far through it has got.
+// It is saved after every action so an ingestion which dies
+// can be resumed, and so it can be undone.
+// Input is where the files came from when that isn't the item itself.
+//
+type Journal struct {
+	Location string          `json:"-"`
+	Command  string          `json:"command"`
+	Item     string          `json:"item"`
+	Input    string          `json:"input,omitempty"`
+	Started  time.Time       `json:"started"`
+	Finished bool            `json:"finished"`
+	Undone   bool            `json:"undone,omitempty"`
+	Actions  []PlannedAction `json:"actions"`
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Makes and saves a journal for a plan
+//
+func NewJournal(
+	media_root string,
+	command string,
+	item string,
+	input string,
+	plan *Plan,
+) *Journal {
+	started := time.Now()
+	journal_dir := path.Join(media_root, JOURNAL_DIR)
+	CheckDir(journal_dir)
+	PruneJournals(media_root)
+	journal := &Journal{
+		Location: path.Join(
+			journal_dir,
+			started.Format("20060102T150405.000000000")+"__"+command+".json",
+		),
+		Command: command,
+		Item:    item,
+		Input:   input,
+		Started: started,
+		Actions: plan.Actions,
+	}
+	journal.Save()
+	return journal
+}
+
+//
+// Reads a journal
+//
+func ReadJournal(location string) (*Journal, error) {
+	var journal Journal
+
+	blob, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(blob, &journal)
+	if err != nil {
+		return nil, err
+	}
+	journal.Location = location
+	return &journal, nil
+}
+
+//
+// Finds every journal in a media root, oldest first.
+// Journals which can't be read are skipped.
+//
+func FindJournals(media_root string) []*Journal {
+	var journals []*Journal
+
+	journal_dir := path.Join(media_root, JOURNAL_DIR)
+	dir_files, err := ioutil.ReadDir(journal_dir)
+	if os.IsNotExist(err) {
+		return journals
+	}
+	CheckErr(err)
+
+	sort.Slice(dir_files, func(i, j int) bool {
+		return dir_files[i].Name() < dir_files[j].Name()
+	})
+	for _, dir_file := range dir_files {
+		if filepath.Ext(dir_file.Name()) != ".json" {
+			continue
+		}
+		location := path.Join(journal_dir, dir_file.Name())
+		journal, err := ReadJournal(location)
+		if err != nil {
+			log.Printf("Skipping '%s', it can't be read: %v\n", location, err)
+			continue
+		}
+		journals = append(journals, journal)
+	}
+	return journals
+}
+
+//
+// Removes finished and undone journals older than JOURNAL_MAX_AGE
+//
+func PruneJournals(media_root string) {
+	for _, journal := range FindJournals(media_root) {
+		if (journal.Finished || journal.Undone) &&
+			time.Since(journal.Started) > JOURNAL_MAX_AGE {
+			log.Printf("Removing '%s', it's too old to undo.\n", journal.Location)
+			err := os.Remove(journal.Location)
+			CheckErr(err)
+		}
+	}
+}
+
+//
+// Finds a journal of an ingestion which didn't finish
+//
+func FindUnfinishedJournal(
+	media_root string,
+	command string,
+	item string,
+) (
+	*Journal,
+	bool,
+) {
+	for _, journal := range FindJournals(media_root) {
+		if journal.Command == command && journal.Item == item &&
+			!journal.Finished && !journal.Undone {
+			return journal, true
+		}
+	}
+	return nil, false
+}
+
+//
+// Saves a journal
+//
+func (journal *Journal) Save() {
+	blob, err := json.MarshalIndent(journal, "", INDENT)
+	CheckErr(err)
+	err = WriteFileAtomic(blob, journal.Location)
+	CheckErr(err)
+}
+
+//
+// Carries out an action.
+// Actions which were done before the journal was saved are noticed and skipped.
+//
+func DoAction(
+	action PlannedAction,
+	download func(picture string, location string) error,
+) error {
+	switch action.Action {
+	case PLAN_MKDIR:
+		return os.MkdirAll(action.Destination, 0755)
+
+	case PLAN_RMDIR:
+		err := os.Remove(action.Destination)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Leaving '%s': %v\n", action.Destination, err)
+		}
+
+	case PLAN_MOVE:
+		_, source_err := os.Stat(action.Source)
+		_, destination_err := os.Stat(action.Destination)
+		if os.IsNotExist(source_err) && destination_err == nil {
+			log.Printf("'%s' has already been moved.\n", action.Source)
+			return nil
+		}
+		err := MoveFile(action.Source, action.Destination)
+		if err == nil {
+			log.Printf("Moved '%s' to '%s'.\n", action.Source, action.Destination)
+		}
+		return err
+
+	case PLAN_COPY, PLAN_HARDLINK, PLAN_SYMLINK, PLAN_REFLINK:
+		if _, err := os.Lstat(action.Destination); err == nil {
+			log.Printf("'%s' has already been placed.\n", action.Destination)
+			return nil
+		}
+		err := PlaceFile(action.Source, action.Destination, action.Action)
+		if err == nil {
+			log.Printf(
+				"Placed '%s' at '%s' (%s).\n",
+				action.Source,
+				action.Destination,
+				action.Action,
+			)
+		}
+		return err
+
+	case PLAN_WRITE, PLAN_UPDATE:
+		// a resumed journal may find the file changed by another ingestion,
+		// so the change is made to the file as it is now
+		lock, err := LockFile(action.Destination)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		blob, changed, err := MergeFile(action.Destination, action.Previous, action.Contents)
+		if err != nil {
+			return err
+		}
+		if changed {
+			log.Printf("'%s' has changed since, keeping those changes.\n", action.Destination)
+		}
+		log.Printf("Saving '%s'.\n", action.Destination)
+		SaveBlob(blob, action.Destination)
+
+	case PLAN_BACKUP:
+		if _, err := os.Stat(action.Destination); err == nil {
+			return nil
+		}
+		CopyToBackup(action.Source, action.Destination)
+
+	case PLAN_DOWNLOAD:
+		if _, err := os.Stat(action.Destination); err == nil {
+			return nil
+		}
+		err := download(action.Source, action.Destination)
+		if err != nil {
+			log.Printf(
+				"Couldn't download '%s', 'librarian repair' will remove it: %v\n",
+				action.Destination,
+				err,
+			)
+		}
+
+	default:
+		return fmt.Errorf("unknown action '%s'", action.Action)
+	}
+	return nil
+}
+
+//
+// Carries out the actions of a journal which haven't been done
+//
+func (journal *Journal) Run(
+	download func(picture string, location string) error,
+) error {
+	for idx := range journal.Actions {
+		if journal.Actions[idx].Done {
+			continue
+		}
+		err := DoAction(journal.Actions[idx], download)
+		if err != nil {
+			return err
+		}
+		journal.Actions[idx].Done = true
+		journal.Save()
+	}
+	journal.Finished = true
+	journal.Save()
+	return nil
+}
+
+//
+// Reverses an action.
+// Info files changed since are only given back what this action changed,
+// unless forced, when they are restored or removed anyway.
+//
+func UndoAction(action PlannedAction, force bool) error {
+	switch action.Action {
+	case PLAN_MKDIR:
+		err := os.Remove(action.Destination)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Leaving '%s': %v\n", action.Destination, err)
+		}
+
+	case PLAN_RMDIR:
+		return os.MkdirAll(action.Destination, 0755)
+
+	case PLAN_MOVE:
+		_, source_err := os.Stat(action.Source)
+		_, destination_err := os.Stat(action.Destination)
+		if os.IsNotExist(destination_err) && source_err == nil {
+			return nil
+		}
+		CheckDir(filepath.Dir(action.Source))
+		err := MoveFile(action.Destination, action.Source)
+		if err == nil {
+			log.Printf("Moved '%s' back to '%s'.\n", action.Destination, action.Source)
+		}
+		return err
+
+	case PLAN_UPDATE:
+		lock, err := LockFile(action.Destination)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		blob, changed, err := MergeFile(action.Destination, action.Contents, action.Previous)
+		if err != nil {
+			if !force {
+				return err
+			}
+			log.Printf("%v, restoring it anyway.\n", err)
+			blob = action.Previous
+		} else if changed {
+			log.Printf(
+				"'%s' has changed since, only undoing this ingestion's changes.\n",
+				action.Destination,
+			)
+		}
+		log.Printf("Restoring '%s'.\n", action.Destination)
+		SaveBlob(blob, action.Destination)
+
+	case PLAN_WRITE:
+		lock, err := LockFile(action.Destination)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		current, err := ioutil.ReadFile(action.Destination)
+		if err == nil && !bytes.Equal(current, action.Contents) && !force {
+			return ChangedSinceError(action.Destination)
+		}
+		err = os.Remove(action.Destination)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Printf("Removed '%s'.\n", action.Destination)
+
+	case PLAN_BACKUP, PLAN_DOWNLOAD,
+		PLAN_COPY, PLAN_HARDLINK, PLAN_SYMLINK, PLAN_REFLINK:
+		err := os.Remove(action.Destination)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Printf("Removed '%s'.\n", action.Destination)
+
+	default:
+		return fmt.Errorf("unknown action '%s'", action.Action)
+	}
+	return nil
+}
+
+//
+// Makes the error for a file made by an ingestion
+// which a later one has changed
+//
+func ChangedSinceError(location string) error {
+	return fmt.Errorf(
+		"'%s' has changed since it was made, undo the ingestions after this one first"+
+			" or force it",
+		location,
+	)
+}
+
+//
+// Checks a journal's info files can be undone
+// without losing what has been changed in them since,
+// working through its writes and updates as undoing them would
+//
+func (journal *Journal) CheckUndo() error {
+	contents := make(map[string][]byte)
+	for idx := len(journal.Actions) - 1; idx >= 0; idx-- {
+		action := journal.Actions[idx]
+		if !action.Done || (action.Action != PLAN_WRITE && action.Action != PLAN_UPDATE) {
+			continue
+		}
+		current, known := contents[action.Destination]
+		if !known {
+			blob, err := ioutil.ReadFile(action.Destination)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			current = blob
+		}
+
+		if action.Action == PLAN_WRITE {
+			if current != nil && !bytes.Equal(current, action.Contents) {
+				return ChangedSinceError(action.Destination)
+			}
+			contents[action.Destination] = nil
+			continue
+		}
+		if current == nil {
+			contents[action.Destination] = action.Previous
+			continue
+		}
+		merged, err := MergeBlob(current, action.Contents, action.Previous)
+		if err != nil {
+			return fmt.Errorf("'%s' has changed and can't be merged: %v", action.Destination, err)
+		}
+		contents[action.Destination] = merged
+	}
+	return nil
+}
+
+//
+// Reverses the actions of a journal which were done, last first.
+// Nothing is undone if an info file has changed since in a way
+// which can't be undone, unless forced.
+//
+func (journal *Journal) Undo(force bool) error {
+	if !force {
+		err := journal.CheckUndo()
+		if err != nil {
+			return err
+		}
+	}
+	for idx := len(journal.Actions) - 1; idx >= 0; idx-- {
+		if !journal.Actions[idx].Done {
+			continue
+		}
+		err := UndoAction(journal.Actions[idx], force)
+		if err != nil {
+			return err
+		}
+		journal.Actions[idx].Done = false
+		journal.Save()
+	}
+	journal.Undone = true
+	journal.Save()
+	return nil
+}
@@ -0,0 +1,251 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// the info files of the ingestion the journal tests plan
+//
+const (
+	JOURNAL_TEST_COMMAND    = "test"
+	JOURNAL_TEST_COLLECTION = `{"name":"Dune","films":[]}`
+	JOURNAL_TEST_UPDATED    = `{"name":"Dune","films":[{"id":"Dune_1"}]}`
+	JOURNAL_TEST_FILM       = `{"id":"Dune_1","title":"Dune"}`
+)
+
+//
+// how far through an ingestion got before it died,
+// how many actions were done and how many of those the journal says were
+//
+var RESUME_CASES = []struct {
+	name   string
+	done   int
+	marked int
+}{
+	{"nothing done", 0, 0},
+	{"the directory made", 1, 1},
+	{"the film moved but not marked", 2, 1},
+	{"the film moved", 2, 2},
+	{"the info file written but not marked", 3, 2},
+	{"the collection updated but not marked", 4, 3},
+	{"everything done but not finished", 4, 4},
+}
+
+//---------------------------------------------------------------------------
+// Helper Functions
+//---------------------------------------------------------------------------
+//
+// The files of an ingestion of a film into a collection
+//
+type TestIngestion struct {
+	root       string
+	film       string
+	film_dir   string
+	placed     string
+	info       string
+	collection string
+}
+
+//
+// Makes a media root with a collection and a film to ingest into it
+//
+func NewTestIngestion(t *testing.T) TestIngestion {
+	root := t.TempDir()
+	ingestion := TestIngestion{
+		root:       root,
+		film:       filepath.Join(root, "inbox", "Dune.mkv"),
+		film_dir:   filepath.Join(root, "films", "Dune"),
+		placed:     filepath.Join(root, "films", "Dune", "Dune.mkv"),
+		info:       filepath.Join(root, "films", "Dune", "Dune.json"),
+		collection: filepath.Join(root, "collections", "Dune", "Dune.json"),
+	}
+	WriteTestFile(t, ingestion.film, "film")
+	WriteTestFile(t, ingestion.collection, JOURNAL_TEST_COLLECTION)
+	err := os.Mkdir(filepath.Dir(ingestion.film_dir), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ingestion
+}
+
+//
+// Plans the ingestion and journals it
+//
+func (ingestion TestIngestion) Journal() *Journal {
+	plan := NewPlan()
+	plan.CheckDir(ingestion.film_dir)
+	plan.MoveFile(ingestion.film, ingestion.placed)
+	plan.SaveBlob([]byte(JOURNAL_TEST_FILM), ingestion.info)
+	plan.SaveBlob([]byte(JOURNAL_TEST_UPDATED), ingestion.collection)
+	return NewJournal(ingestion.root, JOURNAL_TEST_COMMAND, ingestion.film, "", plan)
+}
+
+//
+// Writes a file, making its directory
+//
+func WriteTestFile(t *testing.T, location string, contents string) {
+	err := os.MkdirAll(filepath.Dir(location), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(location, []byte(contents), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//
+// Checks a file has the contents given, or doesn't exist if they are empty
+//
+func CheckTestFile(t *testing.T, name string, location string, contents string) {
+	blob, err := ioutil.ReadFile(location)
+	switch {
+	case contents == "" && !os.IsNotExist(err):
+		t.Errorf("%s: '%s' is still there", name, location)
+	case contents == "":
+	case err != nil:
+		t.Errorf("%s: %v", name, err)
+	case string(blob) != contents:
+		t.Errorf("%s: '%s' is %q, want %q", name, location, blob, contents)
+	}
+}
+
+//---------------------------------------------------------------------------
+// Tests
+//---------------------------------------------------------------------------
+//
+func TestJournalResume(t *testing.T) {
+	for _, resume_case := range RESUME_CASES {
+		ingestion := NewTestIngestion(t)
+		journal := ingestion.Journal()
+		if len(journal.Actions) != 4 {
+			t.Fatalf("the ingestion has %d actions, want 4", len(journal.Actions))
+		}
+		for idx := 0; idx < resume_case.done; idx++ {
+			err := DoAction(journal.Actions[idx], nil)
+			if err != nil {
+				t.Fatalf("%s: %v", resume_case.name, err)
+			}
+			if idx < resume_case.marked {
+				journal.Actions[idx].Done = true
+				journal.Save()
+			}
+		}
+
+		resumed, found := FindUnfinishedJournal(ingestion.root, JOURNAL_TEST_COMMAND, ingestion.film)
+		if !found {
+			t.Errorf("%s: the unfinished journal wasn't found", resume_case.name)
+			continue
+		}
+		err := resumed.Run(nil)
+		if err != nil {
+			t.Errorf("%s: %v", resume_case.name, err)
+			continue
+		}
+		CheckTestFile(t, resume_case.name, ingestion.film, "")
+		CheckTestFile(t, resume_case.name, ingestion.placed, "film")
+		CheckTestFile(t, resume_case.name, ingestion.info, JOURNAL_TEST_FILM)
+		CheckTestFile(t, resume_case.name, ingestion.collection, JOURNAL_TEST_UPDATED)
+		if _, found := FindUnfinishedJournal(ingestion.root, JOURNAL_TEST_COMMAND, ingestion.film); found {
+			t.Errorf("%s: the journal is still unfinished", resume_case.name)
+		}
+
+		err = resumed.Undo(false)
+		if err != nil {
+			t.Errorf("%s: %v", resume_case.name, err)
+			continue
+		}
+		CheckTestFile(t, resume_case.name, ingestion.film, "film")
+		CheckTestFile(t, resume_case.name, ingestion.placed, "")
+		CheckTestFile(t, resume_case.name, ingestion.info, "")
+		CheckTestFile(t, resume_case.name, ingestion.collection, JOURNAL_TEST_COLLECTION)
+	}
+}
+
+func TestJournalUndoKeepsLaterChanges(t *testing.T) {
+	ingestion := NewTestIngestion(t)
+	journal := ingestion.Journal()
+	err := journal.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a later ingestion adds another film to the collection
+	WriteTestFile(
+		t,
+		ingestion.collection,
+		`{"name":"Dune","films":[{"id":"Dune_1"},{"id":"Dune_2"}]}`,
+	)
+	err = journal.Undo(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	CheckTestFile(t, "undone", ingestion.collection, `{
+	"name": "Dune",
+	"films": [
+		{
+			"id": "Dune_2"
+		}
+	]
+}`)
+	CheckTestFile(t, "undone", ingestion.film, "film")
+}
+
+func TestJournalUndoRefusesChangedFiles(t *testing.T) {
+	ingestion := NewTestIngestion(t)
+	journal := ingestion.Journal()
+	err := journal.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the info file the ingestion made is changed since
+	WriteTestFile(t, ingestion.info, `{"id":"Dune_1","title":"Dune: Part One"}`)
+	err = journal.Undo(false)
+	if err == nil {
+		t.Fatal("undoing over a changed info file didn't fail")
+	}
+	CheckTestFile(t, "refused", ingestion.placed, "film")
+	CheckTestFile(t, "refused", ingestion.collection, JOURNAL_TEST_UPDATED)
+
+	err = journal.Undo(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	CheckTestFile(t, "forced", ingestion.film, "film")
+	CheckTestFile(t, "forced", ingestion.info, "")
+	CheckTestFile(t, "forced", ingestion.collection, JOURNAL_TEST_COLLECTION)
+}
+
+func TestFindJournalsSkipsUnreadable(t *testing.T) {
+	ingestion := NewTestIngestion(t)
+	journal := ingestion.Journal()
+	WriteTestFile(t, filepath.Join(ingestion.root, JOURNAL_DIR, "0__broken.json"), `{"command":`)
+
+	journals := FindJournals(ingestion.root)
+	if len(journals) != 1 || journals[0].Location != journal.Location {
+		t.Errorf("found %d journals, want only '%s'", len(journals), journal.Location)
+	}
+}
+
+func TestNewJournalPrunesOldJournals(t *testing.T) {
+	ingestion := NewTestIngestion(t)
+	started := time.Now().Add(-JOURNAL_MAX_AGE - time.Hour).Format(time.RFC3339)
+	finished := filepath.Join(ingestion.root, JOURNAL_DIR, "0__finished.json")
+	unfinished := filepath.Join(ingestion.root, JOURNAL_DIR, "0__unfinished.json")
+	WriteTestFile(t, finished, `{"command":"test","started":"`+started+`","finished":true}`)
+	WriteTestFile(t, unfinished, `{"command":"test","started":"`+started+`"}`)
+
+	ingestion.Journal()
+	CheckTestFile(t, "finished", finished, "")
+	if _, err := os.Stat(unfinished); err != nil {
+		t.Errorf("an old unfinished journal was removed: %v", err)
+	}
+}
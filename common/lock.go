@@ -0,0 +1,115 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// A lock on a file, shared by everything in this process which locks it.
+// The lock is taken on a file in the temporary directory named after
+// the file's location, as info files are replaced rather than written in place
+// and may be locked before their directory is made.
+//
+type FileLock struct {
+	Location string
+	file     *os.File
+	count    int
+}
+
+//---------------------------------------------------------------------------
+// Variables
+//---------------------------------------------------------------------------
+//
+// Locks held by this process, keyed by the location of the locked file
+//
+var held_locks = make(map[string]*FileLock)
+var held_locks_mutex sync.Mutex
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Gets the location of a file's lock file
+//
+func LockLocation(location string) string {
+	sum := sha256.Sum256([]byte(Absolute(location)))
+	return filepath.Join(
+		os.TempDir(),
+		"serviam-locks",
+		hex.EncodeToString(sum[:16])+".lock",
+	)
+}
+
+//
+// Locks a file, waiting for any other process which has it locked.
+// Locking a file this process already holds just counts it,
+// so the lock keeps other processes out but not other goroutines:
+// goroutines sharing a file have to take turns with it themselves.
+//
+func LockFile(location string) (*FileLock, error) {
+	location = Absolute(location)
+
+	held_locks_mutex.Lock()
+	if lock, ok := held_locks[location]; ok {
+		lock.count++
+		held_locks_mutex.Unlock()
+		return lock, nil
+	}
+	held_locks_mutex.Unlock()
+
+	// waiting is done without the mutex, so other locks aren't held up
+	lock_location := LockLocation(location)
+	err := os.MkdirAll(filepath.Dir(lock_location), 0777)
+	if err != nil {
+		return nil, err
+	}
+	file_p, err := os.OpenFile(lock_location, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := TryLock(file_p)
+	if err == nil && !locked {
+		log.Printf("Waiting for another command to finish with '%s'.\n", location)
+		err = WaitLock(file_p)
+	}
+	if err != nil {
+		file_p.Close()
+		return nil, err
+	}
+
+	held_locks_mutex.Lock()
+	defer held_locks_mutex.Unlock()
+
+	// where files can't be locked another goroutine may have got here first
+	if lock, ok := held_locks[location]; ok {
+		file_p.Close()
+		lock.count++
+		return lock, nil
+	}
+	lock := &FileLock{Location: location, file: file_p, count: 1}
+	held_locks[location] = lock
+	return lock, nil
+}
+
+//
+// Unlocks a file once everything which locked it has unlocked it
+//
+func (lock *FileLock) Unlock() error {
+	held_locks_mutex.Lock()
+	defer held_locks_mutex.Unlock()
+
+	lock.count--
+	if lock.count > 0 {
+		return nil
+	}
+	delete(held_locks, lock.Location)
+	return lock.file.Close()
+}
@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package common
+
+import (
+	"os"
+)
+
+//
+// File locking isn't supported here, so locks are only shared in process
+//
+func TryLock(file_p *os.File) (bool, error) {
+	return true, nil
+}
+
+//
+// File locking isn't supported here, so locks are only shared in process
+//
+func WaitLock(file_p *os.File) error {
+	return nil
+}
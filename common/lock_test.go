@@ -0,0 +1,75 @@
+package common
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// locks and unlocks of one file, by the name it is locked by,
+// and whether the file should be locked after each
+//
+var LOCK_STEPS = []struct {
+	name   string
+	lock   bool
+	locked bool
+}{
+	{"Dune.json", true, true},
+	{"Dune.json", true, true},
+	{"../collections/Dune.json", true, true},
+	{"Dune.json", false, true},
+	{"Dune.json", false, true},
+	{"Dune.json", false, false},
+	{"Dune.json", true, true},
+	{"Dune.json", false, false},
+}
+
+//---------------------------------------------------------------------------
+// Helper Functions
+//---------------------------------------------------------------------------
+//
+// Locks and unlocks a file as LOCK_STEPS says,
+// checking after each step whether it is locked
+//
+func StepLocks(t *testing.T, is_locked func(location string) bool) {
+	dir := filepath.Join(t.TempDir(), "collections")
+	location := filepath.Join(dir, "Dune.json")
+	var locks []*FileLock
+	for idx, step := range LOCK_STEPS {
+		if step.lock {
+			lock, err := LockFile(filepath.Join(dir, step.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(locks) > 0 && lock != locks[0] {
+				t.Errorf("step %d: locking '%s' again gave another lock", idx, step.name)
+			}
+			locks = append(locks, lock)
+		} else {
+			err := locks[len(locks)-1].Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			locks = locks[:len(locks)-1]
+		}
+		if locked := is_locked(location); locked != step.locked {
+			t.Errorf("step %d: locked is %v, want %v", idx, locked, step.locked)
+		}
+	}
+}
+
+//---------------------------------------------------------------------------
+// Tests
+//---------------------------------------------------------------------------
+//
+func TestLockFileCounts(t *testing.T) {
+	StepLocks(t, func(location string) bool {
+		held_locks_mutex.Lock()
+		defer held_locks_mutex.Unlock()
+		_, held := held_locks[location]
+		return held
+	})
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package common
+
+import (
+	"os"
+	"syscall"
+)
+
+//
+// Takes an exclusive lock on an open file if no one else has it
+//
+func TryLock(file_p *os.File) (bool, error) {
+	err := syscall.Flock(int(file_p.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//
+// Waits for an exclusive lock on an open file
+//
+func WaitLock(file_p *os.File) error {
+	for {
+		err := syscall.Flock(int(file_p.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
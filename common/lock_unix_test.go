@@ -0,0 +1,39 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package common
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+//
+// Checks whether another process would find the file locked,
+// by trying to lock its lock file through another open file
+//
+func LockedElsewhere(t *testing.T, location string) bool {
+	file_p, err := os.OpenFile(LockLocation(location), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file_p.Close()
+	locked, err := TryLock(file_p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		err = syscall.Flock(int(file_p.Fd()), syscall.LOCK_UN)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return !locked
+}
+
+func TestLockFileHoldsFlock(t *testing.T) {
+	StepLocks(t, func(location string) bool {
+		return LockedElsewhere(t, location)
+	})
+}
@@ -0,0 +1,353 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// A json object which keeps the order of its keys,
+// so merged info files are written the way they were read
+//
+type JSONObject struct {
+	Keys   []string
+	Values map[string]interface{}
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Writes the object's keys in order
+//
+func (object *JSONObject) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	for idx, key := range object.Keys {
+		if idx > 0 {
+			buffer.WriteString(",")
+		}
+		key_blob, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value_blob, err := json.Marshal(object.Values[key])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(key_blob)
+		buffer.WriteString(":")
+		buffer.Write(value_blob)
+	}
+	buffer.WriteString("}")
+	return buffer.Bytes(), nil
+}
+
+//
+// Makes a copy of an object, sharing its values
+//
+func (object *JSONObject) Copy() *JSONObject {
+	copied := &JSONObject{
+		Keys:   append([]string(nil), object.Keys...),
+		Values: make(map[string]interface{}),
+	}
+	for key, value := range object.Values {
+		copied.Values[key] = value
+	}
+	return copied
+}
+
+//
+// Sets a key, adding it to the end if it is new
+//
+func (object *JSONObject) Set(key string, value interface{}) {
+	if _, ok := object.Values[key]; !ok {
+		object.Keys = append(object.Keys, key)
+	}
+	object.Values[key] = value
+}
+
+//
+// Removes a key
+//
+func (object *JSONObject) Delete(key string) {
+	if _, ok := object.Values[key]; !ok {
+		return
+	}
+	delete(object.Values, key)
+	for idx, object_key := range object.Keys {
+		if object_key == key {
+			object.Keys = append(object.Keys[:idx], object.Keys[idx+1:]...)
+			break
+		}
+	}
+}
+
+//
+// Reads a json value, keeping the order of object keys
+//
+func DecodeJSONValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		object := &JSONObject{Values: make(map[string]interface{})}
+		for decoder.More() {
+			key_token, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := key_token.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a key, got %v", key_token)
+			}
+			value, err := DecodeJSONValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			object.Set(key, value)
+		}
+		_, err = decoder.Token()
+		return object, err
+	case json.Delim('['):
+		list := []interface{}{}
+		for decoder.More() {
+			value, err := DecodeJSONValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err = decoder.Token()
+		return list, err
+	}
+	return token, nil
+}
+
+//
+// Reads a json document, keeping the order of object keys
+//
+func DecodeJSON(blob []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(blob))
+	decoder.UseNumber()
+	value, err := DecodeJSONValue(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the json")
+	}
+	return value, nil
+}
+
+//
+// Gets what identifies an item in a list,
+// the id of films, seasons and episodes or the path of files
+//
+func ItemKey(item interface{}) (string, bool) {
+	object, ok := item.(*JSONObject)
+	if !ok {
+		return "", false
+	}
+	for _, field := range []string{"id", "path"} {
+		if key, ok := object.Values[field].(string); ok && key != "" {
+			return field + ":" + key, true
+		}
+	}
+	return "", false
+}
+
+//
+// Indexes a list by its items' keys,
+// failing if any item has no key or shares one
+//
+func KeyItems(list []interface{}) (map[string]interface{}, bool) {
+	items := make(map[string]interface{})
+	for _, item := range list {
+		key, ok := ItemKey(item)
+		if !ok {
+			return nil, false
+		}
+		if _, taken := items[key]; taken {
+			return nil, false
+		}
+		items[key] = item
+	}
+	return items, true
+}
+
+//
+// Applies the change from base to target to the items of current,
+// matching items by their keys.
+// Items only in target are put after the item before them in target.
+//
+func MergeLists(base []interface{}, target []interface{}, current []interface{}) interface{} {
+	base_items, base_ok := KeyItems(base)
+	target_items, target_ok := KeyItems(target)
+	current_items, current_ok := KeyItems(current)
+	if !base_ok || !target_ok || !current_ok {
+		return target
+	}
+
+	var merged []interface{}
+	var merged_keys []string
+	for _, item := range current {
+		key, _ := ItemKey(item)
+		base_item, in_base := base_items[key]
+		target_item, in_target := target_items[key]
+		switch {
+		case in_target:
+			merged = append(merged, MergeJSON(base_item, target_item, item))
+		case in_base:
+			// removed by the change
+			continue
+		default:
+			merged = append(merged, item)
+		}
+		merged_keys = append(merged_keys, key)
+	}
+
+	insert_at := 0
+	for _, item := range target {
+		key, _ := ItemKey(item)
+		_, in_base := base_items[key]
+		_, in_current := current_items[key]
+		if in_current {
+			for idx, merged_key := range merged_keys {
+				if merged_key == key {
+					insert_at = idx + 1
+				}
+			}
+			continue
+		}
+		if in_base {
+			// removed since
+			continue
+		}
+		merged = append(merged[:insert_at], append([]interface{}{item}, merged[insert_at:]...)...)
+		merged_keys = append(
+			merged_keys[:insert_at],
+			append([]string{key}, merged_keys[insert_at:]...)...,
+		)
+		insert_at++
+	}
+	if merged == nil {
+		merged = []interface{}{}
+	}
+	return merged
+}
+
+//
+// Applies the change from base to target to the keys of current
+//
+func MergeObjects(base *JSONObject, target *JSONObject, current *JSONObject) interface{} {
+	merged := current.Copy()
+	for _, key := range base.Keys {
+		if _, ok := target.Values[key]; !ok {
+			merged.Delete(key)
+		}
+	}
+	for _, key := range target.Keys {
+		base_value, in_base := base.Values[key]
+		target_value := target.Values[key]
+		if current_value, ok := current.Values[key]; ok {
+			merged.Set(key, MergeJSON(base_value, target_value, current_value))
+		} else if !in_base || !reflect.DeepEqual(base_value, target_value) {
+			merged.Set(key, target_value)
+		}
+	}
+	return merged
+}
+
+//
+// Applies the change from base to target to current,
+// keeping changes made to current since base.
+// Objects are merged key by key and lists of films, seasons, episodes
+// and files item by item, anything else which changed is replaced by target.
+//
+func MergeJSON(base interface{}, target interface{}, current interface{}) interface{} {
+	if reflect.DeepEqual(base, target) {
+		return current
+	}
+	if reflect.DeepEqual(base, current) {
+		return target
+	}
+	switch target_value := target.(type) {
+	case *JSONObject:
+		current_value, ok := current.(*JSONObject)
+		if !ok {
+			return target
+		}
+		base_value, ok := base.(*JSONObject)
+		if !ok {
+			base_value = &JSONObject{Values: make(map[string]interface{})}
+		}
+		return MergeObjects(base_value, target_value, current_value)
+	case []interface{}:
+		current_value, ok := current.([]interface{})
+		if !ok {
+			return target
+		}
+		base_value, _ := base.([]interface{})
+		return MergeLists(base_value, target_value, current_value)
+	}
+	return target
+}
+
+//
+// Applies the change from base to target to the json in current.
+// Base may be empty, for a file made by the change.
+//
+func MergeBlob(current []byte, base []byte, target []byte) ([]byte, error) {
+	if bytes.Equal(current, base) || bytes.Equal(current, target) {
+		return target, nil
+	}
+	var base_value interface{}
+	var err error
+	if len(base) > 0 {
+		base_value, err = DecodeJSON(base)
+		if err != nil {
+			return nil, err
+		}
+	}
+	target_value, err := DecodeJSON(target)
+	if err != nil {
+		return nil, err
+	}
+	current_value, err := DecodeJSON(current)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(MergeJSON(base_value, target_value, current_value), "", INDENT)
+}
+
+//
+// Works out what a file should be changed to, from base to target,
+// keeping what has changed in it since base,
+// and whether anything has.
+// A missing file is given target.
+//
+func MergeFile(location string, base []byte, target []byte) ([]byte, bool, error) {
+	current, err := ioutil.ReadFile(location)
+	if os.IsNotExist(err) {
+		return target, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	merged, err := MergeBlob(current, base, target)
+	if err != nil {
+		return nil, false, fmt.Errorf("'%s' has changed and can't be merged: %v", location, err)
+	}
+	return merged, !bytes.Equal(current, base) && !bytes.Equal(current, target), nil
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// info files as they are now, before and after a change,
+// and what applying the change to them now should give
+//
+var MERGE_CASES = []struct {
+	name    string
+	current string
+	base    string
+	target  string
+	merged  string
+}{
+	{
+		"unchanged since",
+		`{"name":"Dune","films":[]}`,
+		`{"name":"Dune","films":[]}`,
+		`{"name":"Dune","films":[{"id":"Dune_1"}]}`,
+		`{"name":"Dune","films":[{"id":"Dune_1"}]}`,
+	},
+	{
+		"keys kept in their order",
+		`{"z":1,"name":"Dune","a":2,"overview":"old"}`,
+		`{"name":"Dune","overview":"old"}`,
+		`{"name":"Dune","overview":"new"}`,
+		`{"z":1,"name":"Dune","a":2,"overview":"new"}`,
+	},
+	{
+		"unknown keys kept in the items of lists",
+		`{"films":[{"id":"a","note":"mine","title":"A"}]}`,
+		`{"films":[{"id":"a","title":"A"}]}`,
+		`{"films":[{"id":"a","title":"B"}]}`,
+		`{"films":[{"id":"a","note":"mine","title":"B"}]}`,
+	},
+	{
+		"new keys go at the end",
+		`{"name":"Dune","extra":true}`,
+		`{"name":"Dune"}`,
+		`{"name":"Dune","poster":"p.jpg"}`,
+		`{"name":"Dune","extra":true,"poster":"p.jpg"}`,
+	},
+	{
+		"keys removed by the change",
+		`{"name":"Dune","poster":"p.jpg","extra":true}`,
+		`{"name":"Dune","poster":"p.jpg"}`,
+		`{"name":"Dune"}`,
+		`{"name":"Dune","extra":true}`,
+	},
+	{
+		"items added since are kept",
+		`{"films":[{"id":"a"},{"id":"c"}]}`,
+		`{"films":[{"id":"a"}]}`,
+		`{"films":[{"id":"a"},{"id":"b"}]}`,
+		`{"films":[{"id":"a"},{"id":"b"},{"id":"c"}]}`,
+	},
+	{
+		"items removed by the change",
+		`{"films":[{"id":"a"},{"id":"b"},{"id":"c"}]}`,
+		`{"films":[{"id":"a"},{"id":"b"}]}`,
+		`{"films":[{"id":"a"}]}`,
+		`{"films":[{"id":"a"},{"id":"c"}]}`,
+	},
+	{
+		"items removed since stay removed",
+		`{"films":[{"id":"b"}]}`,
+		`{"films":[{"id":"a"},{"id":"b"}]}`,
+		`{"films":[{"id":"a"},{"id":"b"},{"id":"c"}]}`,
+		`{"films":[{"id":"b"},{"id":"c"}]}`,
+	},
+	{
+		"lists without keys are replaced",
+		`{"genres":["Drama","War"]}`,
+		`{"genres":["Drama"]}`,
+		`{"genres":["Science Fiction"]}`,
+		`{"genres":["Science Fiction"]}`,
+	},
+	{
+		"a file made by the change",
+		`{"name":"Dune","extra":true}`,
+		``,
+		`{"name":"Dune","poster":"p.jpg"}`,
+		`{"name":"Dune","extra":true,"poster":"p.jpg"}`,
+	},
+}
+
+//---------------------------------------------------------------------------
+// Tests
+//---------------------------------------------------------------------------
+//
+func TestMergeBlob(t *testing.T) {
+	for _, merge_case := range MERGE_CASES {
+		merged, err := MergeBlob(
+			[]byte(merge_case.current),
+			[]byte(merge_case.base),
+			[]byte(merge_case.target),
+		)
+		if err != nil {
+			t.Errorf("%s: %v", merge_case.name, err)
+			continue
+		}
+		var compact bytes.Buffer
+		err = json.Compact(&compact, merged)
+		if err != nil {
+			t.Errorf("%s: merged to bad json %q: %v", merge_case.name, merged, err)
+			continue
+		}
+		if compact.String() != merge_case.merged {
+			t.Errorf("%s: merged to %s, want %s", merge_case.name, compact.String(), merge_case.merged)
+		}
+	}
+}
+
+func TestMergeBlobBadJSON(t *testing.T) {
+	_, err := MergeBlob([]byte(`{"name":`), []byte(`{}`), []byte(`{"name":"Dune"}`))
+	if err == nil {
+		t.Errorf("merging into broken json didn't fail")
+	}
+	_, err = MergeBlob([]byte(`{} {}`), []byte(`{}`), []byte(`{"name":"Dune"}`))
+	if err == nil {
+		t.Errorf("merging into json followed by more didn't fail")
+	}
+}
@@ -0,0 +1,222 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Set to "1" to compare checksums after copying across filesystems
+//
+const MOVE_CHECKSUM_ENV = "SERVIAM_MOVE_CHECKSUM"
+
+//
+// Copy settings
+//
+const COPY_BUFFER_SIZE = 4 * 1024 * 1024
+const PROGRESS_INTERVAL = 2 * time.Second
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// Writer which logs how much of a copy has been done every so often
+//
+type ProgressWriter struct {
+	Name    string
+	Total   int64
+	Written int64
+	Logged  time.Time
+}
+
+//
+// Counts bytes written and logs progress
+//
+func (progress *ProgressWriter) Write(blob []byte) (int, error) {
+	progress.Written += int64(len(blob))
+	if time.Since(progress.Logged) >= PROGRESS_INTERVAL {
+		progress.Logged = time.Now()
+		percent := 100.0
+		if progress.Total > 0 {
+			percent = 100 * float64(progress.Written) / float64(progress.Total)
+		}
+		log.Printf(
+			"Copying '%s': %d of %d MiB (%.0f%%).\n",
+			progress.Name,
+			progress.Written>>20,
+			progress.Total>>20,
+			percent,
+		)
+	}
+	return len(blob), nil
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Checks whether checksums should be compared after copying
+//
+func ChecksumMoves() bool {
+	switch strings.ToLower(os.Getenv(MOVE_CHECKSUM_ENV)) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+//
+// Gets the sha256 sum of a file
+//
+func FileChecksum(location string) ([]byte, error) {
+	file_p, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer file_p.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file_p)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+//
+// Copies a file to a temporary file next to the destination,
+// syncs it, checks its size (and checksum if asked),
+// copies the mode and times and then renames it into place.
+//
+func CopyFile(source string, destination string, checksum bool) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	source_p, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer source_p.Close()
+
+	tmp_destination := destination + ".part"
+	destination_p, err := os.OpenFile(
+		tmp_destination,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		info.Mode().Perm(),
+	)
+	if err != nil {
+		return err
+	}
+
+	progress := &ProgressWriter{
+		Name:   source,
+		Total:  info.Size(),
+		Logged: time.Now(),
+	}
+	hash := sha256.New()
+	writers := []io.Writer{destination_p, progress}
+	if checksum {
+		writers = append(writers, hash)
+	}
+	_, err = io.CopyBuffer(
+		io.MultiWriter(writers...),
+		source_p,
+		make([]byte, COPY_BUFFER_SIZE),
+	)
+	if err == nil {
+		err = destination_p.Sync()
+	}
+	if close_err := destination_p.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = VerifyCopy(tmp_destination, info.Size(), hash.Sum(nil), checksum)
+	}
+	if err == nil {
+		err = os.Chtimes(tmp_destination, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp_destination, destination)
+	}
+	if err != nil {
+		os.Remove(tmp_destination)
+	}
+	return err
+}
+
+//
+// Checks a copy has the size, and if asked the checksum, of its source
+//
+func VerifyCopy(
+	location string,
+	size int64,
+	source_sum []byte,
+	checksum bool,
+) error {
+	info, err := os.Stat(location)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return fmt.Errorf(
+			"copy '%s' is %d bytes but should be %d",
+			location,
+			info.Size(),
+			size,
+		)
+	}
+	if !checksum {
+		return nil
+	}
+	copy_sum, err := FileChecksum(location)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(copy_sum, source_sum) {
+		return fmt.Errorf("copy '%s' has a different checksum", location)
+	}
+	return nil
+}
+
+//
+// Moves a file. If it is on another filesystem it is copied,
+// verified and then the original is removed.
+// Symlinks are moved as links, not copied as the file they point at.
+//
+func MoveFile(source string, destination string) error {
+	err := os.Rename(source, destination)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	if info, err := os.Lstat(source); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		err = os.Symlink(target, destination)
+		if err != nil {
+			return err
+		}
+		return os.Remove(source)
+	}
+
+	log.Printf("'%s' is on another filesystem, copying it.\n", source)
+	err = CopyFile(source, destination, ChecksumMoves())
+	if err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Ways a film or episode file can be put in the media directory.
+// They are recorded in the file's FileData.
+//
+const (
+	PLACE_MOVE     = "move"
+	PLACE_COPY     = "copy"
+	PLACE_HARDLINK = "hardlink"
+	PLACE_SYMLINK  = "symlink"
+	PLACE_REFLINK  = "reflink"
+)
+
+var PLACEMENTS = []string{
+	PLACE_MOVE,
+	PLACE_COPY,
+	PLACE_HARDLINK,
+	PLACE_SYMLINK,
+	PLACE_REFLINK,
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Checks a placement is one serviam knows
+//
+func CheckPlacement(placement string) error {
+	for _, known := range PLACEMENTS {
+		if placement == known {
+			return nil
+		}
+	}
+	return fmt.Errorf(
+		"unknown placement '%s', use one of %s",
+		placement,
+		strings.Join(PLACEMENTS, ", "),
+	)
+}
+
+//
+// Puts a file at destination the way given.
+// Symlinks point at the source's absolute path.
+// Reflinks fall back to copying where the filesystem can't share blocks.
+//
+func PlaceFile(source string, destination string, placement string) error {
+	switch placement {
+	case PLACE_MOVE, "":
+		return MoveFile(source, destination)
+
+	case PLACE_COPY:
+		return CopyFile(source, destination, ChecksumMoves())
+
+	case PLACE_HARDLINK:
+		return os.Link(source, destination)
+
+	case PLACE_SYMLINK:
+		return os.Symlink(Absolute(source), destination)
+
+	case PLACE_REFLINK:
+		err := Reflink(source, destination)
+		if err != nil {
+			log.Printf("Can't reflink '%s', copying it: %v\n", source, err)
+			return CopyFile(source, destination, ChecksumMoves())
+		}
+		return nil
+	}
+	return CheckPlacement(placement)
+}
+
+//
+// Works out how a file in the media directory was placed,
+// as far as can be told from the file itself.
+// Symlinks and files with other hardlinks are found,
+// anything else is an ordinary file and gives "".
+//
+func DetectPlacement(location string) (string, error) {
+	info, err := os.Lstat(location)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return PLACE_SYMLINK, nil
+	}
+	if LinkCount(info) > 1 {
+		return PLACE_HARDLINK, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package common
+
+import (
+	"os"
+)
+
+//
+// Hardlinks can't be counted here, so every file counts as having one
+//
+func LinkCount(info os.FileInfo) uint64 {
+	return 1
+}
@@ -0,0 +1,296 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Kinds of planned action
+//
+const (
+	PLAN_MKDIR    = "mkdir"
+	PLAN_RMDIR    = "rmdir"
+	PLAN_MOVE     = "move"
+	PLAN_WRITE    = "write"
+	PLAN_UPDATE   = "update"
+	PLAN_BACKUP   = "backup"
+	PLAN_DOWNLOAD = "download"
+	PLAN_COPY     = PLACE_COPY
+	PLAN_HARDLINK = PLACE_HARDLINK
+	PLAN_SYMLINK  = PLACE_SYMLINK
+	PLAN_REFLINK  = PLACE_REFLINK
+)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// A change to the filesystem.
+// Writes and updates keep the new contents, updates keep the old contents
+// so they can be undone.
+//
+type PlannedAction struct {
+	Action      string `json:"action"`
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination"`
+	Contents    []byte `json:"contents,omitempty"`
+	Previous    []byte `json:"previous,omitempty"`
+	Done        bool   `json:"done,omitempty"`
+}
+
+//
+// Works out the changes a command will make to the filesystem
+// without making them.
+// The plan remembers the directories and files it will have made,
+// where files it moves will be and what it will have moved or removed,
+// so later steps see them.
+// It is carried out by a journal.
+// Files the plan reads and then updates are locked until it is unlocked.
+// Film and episode files are placed the way Placement says.
+//
+type Plan struct {
+	Actions   []PlannedAction
+	Placement string
+	dirs      map[string]bool
+	blobs     map[string][]byte
+	sources   map[string]string
+	moved     map[string]bool
+	locks     []*FileLock
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Makes an empty plan
+//
+func NewPlan() *Plan {
+	return &Plan{
+		Placement: PLACE_MOVE,
+		dirs:      make(map[string]bool),
+		blobs:     make(map[string][]byte),
+		sources:   make(map[string]string),
+		moved:     make(map[string]bool),
+	}
+}
+
+//
+// Makes a location absolute so the plan can be carried out from anywhere
+//
+func Absolute(location string) string {
+	if location == "" {
+		return location
+	}
+	absolute, err := filepath.Abs(location)
+	CheckErr(err)
+	return absolute
+}
+
+//
+// Locks a file the plan is about to read and update
+//
+func (plan *Plan) Lock(location string) {
+	lock, err := LockFile(location)
+	CheckErr(err)
+	plan.locks = append(plan.locks, lock)
+}
+
+//
+// Unlocks the files the plan locked, once it has been carried out
+//
+func (plan *Plan) Unlock() {
+	for _, lock := range plan.locks {
+		err := lock.Unlock()
+		CheckErr(err)
+	}
+	plan.locks = nil
+}
+
+//
+// Adds an action to the plan
+//
+func (plan *Plan) Record(action string, source string, destination string) {
+	plan.Actions = append(plan.Actions, PlannedAction{
+		Action:      action,
+		Source:      Absolute(source),
+		Destination: Absolute(destination),
+	})
+}
+
+//
+// Checks whether a file or directory exists, or will once the plan is done
+//
+func (plan *Plan) Exists(location string) bool {
+	location = Absolute(location)
+	if plan.dirs[location] || plan.blobs[location] != nil ||
+		plan.sources[location] != "" {
+		return true
+	}
+	if plan.moved[location] {
+		return false
+	}
+	_, err := os.Stat(location)
+	return err == nil
+}
+
+//
+// Plans to make a directory, and any parents, if it doesn't exist
+//
+func (plan *Plan) CheckDir(dir string) {
+	if plan.Exists(dir) {
+		CheckDir(dir)
+		return
+	}
+	var missing []string
+	for parent := Absolute(dir); !plan.Exists(parent); parent = filepath.Dir(parent) {
+		missing = append(missing, parent)
+	}
+	for idx := len(missing) - 1; idx >= 0; idx-- {
+		plan.Record(PLAN_MKDIR, "", missing[idx])
+		plan.dirs[missing[idx]] = true
+	}
+}
+
+//
+// Plans to move a file
+//
+func (plan *Plan) MoveFile(source string, destination string) {
+	plan.Record(PLAN_MOVE, source, destination)
+	source = Absolute(source)
+	destination = Absolute(destination)
+	if blob, ok := plan.blobs[source]; ok {
+		plan.blobs[destination] = blob
+	} else if original, ok := plan.sources[source]; ok {
+		plan.sources[destination] = original
+	} else {
+		plan.sources[destination] = source
+	}
+	plan.moved[source] = true
+	delete(plan.moved, destination)
+	delete(plan.blobs, source)
+	delete(plan.sources, source)
+}
+
+//
+// Plans to remove a directory once it is empty
+//
+func (plan *Plan) RemoveDir(dir string) {
+	plan.Record(PLAN_RMDIR, "", dir)
+	plan.moved[Absolute(dir)] = true
+	delete(plan.dirs, Absolute(dir))
+}
+
+//
+// Plans to put a film or episode file in the media directory
+// the way the plan's Placement says
+//
+func (plan *Plan) PlaceFile(source string, destination string) {
+	if plan.Placement == PLACE_MOVE || plan.Placement == "" {
+		plan.MoveFile(source, destination)
+		return
+	}
+	plan.Record(plan.Placement, source, destination)
+}
+
+//
+// Gets the contents the plan will have written to a file
+//
+func (plan *Plan) Planned(location string) ([]byte, bool) {
+	blob, ok := plan.blobs[Absolute(location)]
+	return blob, ok
+}
+
+//
+// Gets the contents a file will have once the plan is done
+//
+func (plan *Plan) ReadFile(location string) ([]byte, error) {
+	if blob, ok := plan.Planned(location); ok {
+		return blob, nil
+	}
+	if source, ok := plan.sources[Absolute(location)]; ok {
+		return ioutil.ReadFile(source)
+	}
+	return ioutil.ReadFile(location)
+}
+
+//
+// Plans to create or replace a file containing the bytes given
+//
+func (plan *Plan) SaveBlob(blob []byte, location string) {
+	action := PlannedAction{
+		Action:      PLAN_WRITE,
+		Destination: Absolute(location),
+		Contents:    blob,
+	}
+	if plan.Exists(location) {
+		previous, err := plan.ReadFile(location)
+		CheckErr(err)
+		action.Action = PLAN_UPDATE
+		action.Previous = previous
+	}
+	plan.Actions = append(plan.Actions, action)
+	plan.blobs[Absolute(location)] = blob
+}
+
+//
+// Plans to back up a file
+//
+func (plan *Plan) BackupFile(location string) {
+	plan.Record(PLAN_BACKUP, location, BackupLocation(location))
+}
+
+//
+// Plans to download a picture
+//
+func (plan *Plan) Download(picture string, location string) {
+	plan.Actions = append(plan.Actions, PlannedAction{
+		Action:      PLAN_DOWNLOAD,
+		Source:      picture,
+		Destination: Absolute(location),
+	})
+}
+
+//
+// Prints the plan as a table or as json
+//
+func (plan *Plan) Print(as_json bool) {
+	if as_json {
+		var actions []PlannedAction
+		for _, action := range plan.Actions {
+			actions = append(actions, PlannedAction{
+				Action:      action.Action,
+				Source:      action.Source,
+				Destination: action.Destination,
+			})
+		}
+		blob, err := json.MarshalIndent(actions, "", INDENT)
+		CheckErr(err)
+		fmt.Println(string(blob))
+		return
+	}
+	if len(plan.Actions) == 0 {
+		log.Println("Nothing to do.")
+		return
+	}
+	fmt.Printf("%-8s  %s\n", "ACTION", "SOURCE -> DESTINATION")
+	for _, action := range plan.Actions {
+		if action.Source == "" {
+			fmt.Printf("%-8s  %s\n", action.Action, action.Destination)
+		} else {
+			fmt.Printf(
+				"%-8s  %s -> %s\n",
+				action.Action,
+				action.Source,
+				action.Destination,
+			)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package common
+
+import (
+	"os"
+	"syscall"
+)
+
+//
+// ioctl which makes a file share the blocks of another (FICLONE)
+//
+const FICLONE = 0x40049409
+
+//
+// Makes destination a copy of source sharing its blocks,
+// on filesystems which support it such as btrfs and xfs
+//
+func Reflink(source string, destination string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	source_p, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer source_p.Close()
+
+	destination_p, err := os.OpenFile(
+		destination,
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		info.Mode().Perm(),
+	)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		destination_p.Fd(),
+		FICLONE,
+		source_p.Fd(),
+	)
+	if close_err := destination_p.Close(); errno == 0 && close_err != nil {
+		return close_err
+	}
+	if errno != 0 {
+		os.Remove(destination)
+		return errno
+	}
+	return os.Chtimes(destination, info.ModTime(), info.ModTime())
+}
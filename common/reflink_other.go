@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+import (
+	"errors"
+)
+
+//
+// Reflinks aren't supported here, so callers copy instead
+//
+func Reflink(source string, destination string) error {
+	return errors.New("reflinks are not supported on this system")
+}
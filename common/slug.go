@@ -0,0 +1,133 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// ASCII spellings of letters with accents and of other alphabets.
+// Other letters with accents lose them,
+// and letters which still aren't ASCII are left out of slugs.
+//
+var TRANSLITERATIONS = map[rune]string{
+	// latin
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "A", 'Å': "A", 'Ā': "A", 'Ă': "A", 'Ą': "A",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe", 'ß': "ss", 'Þ': "Th", 'þ': "th",
+	'Ç': "C", 'Ć': "C", 'Č': "C", 'ç': "c", 'ć': "c", 'č': "c",
+	'Ð': "D", 'Ď': "D", 'Đ': "D", 'ð': "d", 'ď': "d", 'đ': "d",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ē': "E", 'Ė': "E", 'Ę': "E", 'Ě': "E",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'Ğ': "G", 'ğ': "g",
+	'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I", 'Ī': "I", 'İ': "I",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'ı': "i",
+	'Ł': "L", 'Ľ': "L", 'ł': "l", 'ľ': "l",
+	'Ñ': "N", 'Ń': "N", 'Ň': "N", 'ñ': "n", 'ń': "n", 'ň': "n",
+	'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "O", 'Ø': "O", 'Ō': "O", 'Ő': "O",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o",
+	'Ř': "R", 'ř': "r",
+	'Ś': "S", 'Ş': "S", 'Š': "S", 'ś': "s", 'ş': "s", 'š': "s",
+	'Ţ': "T", 'Ť': "T", 'ţ': "t", 'ť': "t",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "U", 'Ū': "U", 'Ů': "U", 'Ű': "U",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u",
+	'Ý': "Y", 'Ÿ': "Y", 'ý': "y", 'ÿ': "y",
+	'Ź': "Z", 'Ż': "Z", 'Ž': "Z", 'ź': "z", 'ż': "z", 'ž': "z",
+
+	// greek
+	'Α': "A", 'Β': "V", 'Γ': "G", 'Δ': "D", 'Ε': "E", 'Ζ': "Z", 'Η': "I", 'Θ': "Th",
+	'Ι': "I", 'Κ': "K", 'Λ': "L", 'Μ': "M", 'Ν': "N", 'Ξ': "X", 'Ο': "O", 'Π': "P",
+	'Ρ': "R", 'Σ': "S", 'Τ': "T", 'Υ': "Y", 'Φ': "F", 'Χ': "Ch", 'Ψ': "Ps", 'Ω': "O",
+	'Ά': "A", 'Έ': "E", 'Ή': "I", 'Ί': "I", 'Ό': "O", 'Ύ': "Y", 'Ώ': "O",
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th",
+	'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p",
+	'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps",
+	'ω': "o", 'ά': "a", 'έ': "e", 'ή': "i", 'ί': "i", 'ό': "o", 'ύ': "y", 'ώ': "o",
+
+	// cyrillic
+	'А': "A", 'Б': "B", 'В': "V", 'Г': "G", 'Д': "D", 'Е': "E", 'Ё': "Yo", 'Ж': "Zh",
+	'З': "Z", 'И': "I", 'Й': "Y", 'К': "K", 'Л': "L", 'М': "M", 'Н': "N", 'О': "O",
+	'П': "P", 'Р': "R", 'С': "S", 'Т': "T", 'У': "U", 'Ф': "F", 'Х': "Kh", 'Ц': "Ts",
+	'Ч': "Ch", 'Ш': "Sh", 'Щ': "Shch", 'Ъ': "", 'Ы': "Y", 'Ь': "", 'Э': "E", 'Ю': "Yu",
+	'Я': "Ya", 'Є': "Ye", 'І': "I", 'Ї': "Yi", 'Ґ': "G",
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'є': "ye", 'і': "i", 'ї': "yi", 'ґ': "g",
+}
+
+//
+// Anything which isn't safe in a file name, between spaces
+//
+var UNSAFE_SLUG = regexp.MustCompile(`[^\w.\-]+`)
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Makes a name safe to use in file names.
+// Spaces become underscores and other letters are spelt in ASCII,
+// so plain ASCII names come out as PosixFileName always made them.
+// If nothing is left, such as for a title in Japanese,
+// the TMDB id is used instead.
+//
+func Slug(name string, tmdb_id int) string {
+	return SlugWith(name, "_", tmdb_id)
+}
+
+//
+// Spells a letter in ASCII.
+// Letters in the table are spelt as it says, such as й as y,
+// others are decomposed and lose their accents, such as ệ as e.
+//
+func Transliterate(char rune) string {
+	if spelling, ok := TRANSLITERATIONS[char]; ok {
+		return spelling
+	}
+	var spelling strings.Builder
+	for _, part := range norm.NFD.String(string(char)) {
+		switch {
+		case unicode.Is(unicode.Mn, part):
+		case part < unicode.MaxASCII:
+			spelling.WriteRune(part)
+		default:
+			spelling.WriteString(TRANSLITERATIONS[part])
+		}
+	}
+	return spelling.String()
+}
+
+//
+// Makes a name safe to use in file names like Slug,
+// with spaces becoming the string given rather than underscores
+//
+func SlugWith(name string, space string, tmdb_id int) string {
+	var slug strings.Builder
+	for _, char := range name {
+		switch {
+		case char == ' ', char > unicode.MaxASCII && unicode.IsSpace(char):
+			slug.WriteRune(' ')
+		case char < unicode.MaxASCII:
+			slug.WriteRune(char)
+		default:
+			slug.WriteString(Transliterate(char))
+		}
+	}
+	words := strings.Split(slug.String(), " ")
+	for idx, word := range words {
+		words[idx] = UNSAFE_SLUG.ReplaceAllString(word, "")
+	}
+	output := strings.Join(words, space)
+	if strings.Trim(output, "_.- ") == "" {
+		output = fmt.Sprintf("tmdb%d", tmdb_id)
+	}
+	return output
+}
@@ -0,0 +1,68 @@
+package common
+
+import (
+	"testing"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// names, what spaces become and the slugs they should give,
+// with 7 as their TMDB id
+//
+var SLUG_CASES = []struct {
+	name  string
+	space string
+	slug  string
+}{
+	// ascii
+	{"The Matrix", "_", "The_Matrix"},
+	{"Dr. Strangelove", "_", "Dr._Strangelove"},
+	{"Kill Bill: Vol. 1", "_", "Kill_Bill_Vol._1"},
+	{"AC/DC: Let There Be Rock", "_", "ACDC_Let_There_Be_Rock"},
+	{"The Matrix", " ", "The Matrix"},
+
+	// letters with accents, from the table or decomposed
+	{"Léon: The Professional", "_", "Leon_The_Professional"},
+	{"Æon Flux", "_", "AEon_Flux"},
+	{"Straße", "_", "Strasse"},
+	{"Ørkenens Sønner", "_", "Orkenens_Sonner"},
+	{"Łódź", "_", "Lodz"},
+	{"Tōkyō Monogatari", " ", "Tokyo Monogatari"},
+	{"Dziady część III", "_", "Dziady_czesc_III"},
+	{"Mùa hè chiều thẳng đứng", "_", "Mua_he_chieu_thang_dung"},
+
+	// other alphabets
+	{"Крёстный отец", "_", "Kryostnyy_otets"},
+	{"Ο Ζορμπάς", "_", "O_Zormpas"},
+	{"Ψυχή", "_", "Psychi"},
+
+	// nothing left
+	{"千と千尋の神隠し", "_", "tmdb7"},
+	{"君の名は。", " ", "tmdb7"},
+	{"/:?", "_", "tmdb7"},
+	{"", "_", "tmdb7"},
+}
+
+//---------------------------------------------------------------------------
+// Tests
+//---------------------------------------------------------------------------
+//
+func TestSlugWith(t *testing.T) {
+	for _, slug_case := range SLUG_CASES {
+		slug := SlugWith(slug_case.name, slug_case.space, 7)
+		if slug != slug_case.slug {
+			t.Errorf("SlugWith(%q, %q) = %q, want %q", slug_case.name, slug_case.space, slug, slug_case.slug)
+		}
+	}
+}
+
+func TestSlug(t *testing.T) {
+	if slug := Slug("Amélie", 194); slug != "Amelie" {
+		t.Errorf("Slug gave %q, want \"Amelie\"", slug)
+	}
+	if slug := Slug("アメリ", 194); slug != "tmdb194" {
+		t.Errorf("Slug gave %q, want \"tmdb194\"", slug)
+	}
+}
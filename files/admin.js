@@ -0,0 +1,34 @@
+
+const job = document.getElementById("job");
+const job_state = document.getElementById("job-state");
+const job_output = document.getElementById("job-output");
+
+var xhttp = new XMLHttpRequest();
+
+xhttp.onreadystatechange = function() {
+    if (this.readyState == 4 && this.status == 200) {
+        ShowProgress(this);
+    }
+};
+
+// shows the job's output so far, asking again until it has finished
+function ShowProgress (xml) {
+    const progress = xml.responseXML.getElementsByTagName("job")[0];
+    const state = progress.getAttribute("state");
+    const lines = Array.from(progress.getElementsByTagName("line")).map(
+        line => line.textContent
+    );
+    job_state.textContent = state;
+    job_state.className = "state " + state;
+    job_output.textContent = lines.join("\n");
+    if (state === "queued" || state === "running") {
+        setTimeout(AskProgress, 1000);
+    }
+}
+
+function AskProgress () {
+    xhttp.open("GET", "progress?id=" + job.dataset.id, true);
+    xhttp.send();
+}
+
+AskProgress();
@@ -5,6 +5,15 @@ const search_image = document.getElementById("search-image");
 search_input.addEventListener('keyup', InputHandler);
 search_image.addEventListener('click', ImageHandler);
 
+for (const chapter_link of document.querySelectorAll(".chapters a")) {
+    chapter_link.addEventListener('click', ChapterHandler);
+}
+
+for (const version_select of document.querySelectorAll(".versions")) {
+    ChooseVersion(version_select);
+    version_select.addEventListener('change', VersionHandler);
+}
+
 function InputHandler (key_event) {
     if (event.keyCode === 13) {
         location.replace("results?q="+search_input.value);
@@ -14,3 +23,74 @@ function InputHandler (key_event) {
 function ImageHandler () {
     location.replace("results?q="+search_input.value);
 }
+
+function ChapterHandler (click_event) {
+    click_event.preventDefault();
+    const video = this.closest("article").querySelector("video");
+    video.currentTime = parseFloat(this.dataset.start);
+    video.play();
+}
+
+// picks the version to start with: of those this browser can play,
+// the tallest no taller than the one last chosen, or than the screen,
+// or else the shortest
+function ChooseVersion (version_select) {
+    const video = version_select.closest("article").querySelector("video");
+    const playable = Array.from(version_select.options).filter(
+        option => video.canPlayType(option.dataset.type) !== ""
+    );
+    if (playable.length === 0) {
+        return;
+    }
+    const height = option => parseInt(option.dataset.height);
+    const chosen_height = localStorage.getItem("version_height");
+    const limit = chosen_height !== null ?
+        parseInt(chosen_height) : window.screen.height * window.devicePixelRatio;
+
+    const fitting = playable.filter(option => height(option) <= limit);
+    let chosen;
+    if (fitting.length > 0) {
+        chosen = fitting.reduce((best, option) => height(option) > height(best) ? option : best);
+    } else {
+        chosen = playable.reduce((best, option) => height(option) < height(best) ? option : best);
+    }
+    if (!chosen.selected) {
+        chosen.selected = true;
+        SwitchVersion(version_select);
+    }
+}
+
+function VersionHandler () {
+    localStorage.setItem("version_height", this.selectedOptions[0].dataset.height);
+    SwitchVersion(this);
+}
+
+// plays the chosen version from where the last one was,
+// with its own chapters
+function SwitchVersion (version_select) {
+    const article = version_select.closest("article");
+    const video = article.querySelector("video");
+    const source = video.querySelector("source");
+    const option = version_select.selectedOptions[0];
+    const time = video.currentTime;
+    source.src = option.value;
+    source.type = option.dataset.type;
+
+    const track = video.querySelector("track");
+    if (track !== null) {
+        track.remove();
+    }
+    if (option.dataset.chapters !== undefined) {
+        const chapters_track = document.createElement("track");
+        chapters_track.kind = "chapters";
+        chapters_track.default = true;
+        chapters_track.src = option.dataset.chapters;
+        video.appendChild(chapters_track);
+    }
+    for (const chapters of article.querySelectorAll(".chapters")) {
+        chapters.hidden = chapters.dataset.video !== option.value;
+    }
+
+    video.load();
+    video.currentTime = time;
+}
@@ -2,20 +2,20 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"log"
-	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"serviam/common"
+	"serviam/library"
 	"serviam/structs"
+	"serviam/tmdb"
 	"strconv"
 	"strings"
-	"time"
 )
 
 //---------------------------------------------------------------------------
@@ -24,16 +24,9 @@ import (
 //
 // Settings
 //
-const TIMEOUT = 30
 const DISPLAY_POSTER = true
 const SHOW_DIR = "shows"
-
-//
-// URL Prefixes
-//
-const TV_GET_URL = "https://api.themoviedb.org/3/tv/"
-const TV_SEARCH_URL = "https://api.themoviedb.org/3/search/tv"
-const IMAGE_URL = "https://image.tmdb.org/t/p/original"
+const COMMAND = "getshow"
 
 //---------------------------------------------------------------------------
 // Helper Functions
@@ -41,44 +34,17 @@ const IMAGE_URL = "https://image.tmdb.org/t/p/original"
 //
 // Downloads an image from the TMDB site.
 //
-func DownloadImage(client http.Client, tmdb_img string, location string) bool {
-	url := IMAGE_URL + tmdb_img
+func DownloadImage(client *tmdb.Client, tmdb_img string, location string) bool {
 	fmt.Printf("Downloading '%s'.\n", location)
-
-	// open file
-	file, err := os.Create(location)
-	common.CheckErr(err)
-	defer file.Close()
-	// download image
-	resp, err := client.Get(url)
-	if NotOK(resp) {
+	size, err := client.DownloadImage(context.Background(), tmdb_img, location)
+	if err != nil {
+		fmt.Printf("Couldn't download '%s': %v\n", location, err)
 		return false
 	}
-	common.CheckErr(err)
-	defer resp.Body.Close()
-	// save image
-	size, err := io.Copy(file, resp.Body)
-	common.CheckErr(err)
 	fmt.Printf("Downloaded '%s' of size %d.\n", location, size)
 	return true
 }
 
-//
-// Checks http response
-//
-func NotOK(resp *http.Response) bool {
-	if resp.StatusCode != 200 {
-		fmt.Printf("Status Code: %d\n", resp.StatusCode)
-		defer resp.Body.Close()
-		body_bytes, err := ioutil.ReadAll(resp.Body)
-		common.CheckErr(err)
-		fmt.Printf("Response Body:\n%s\n", string(body_bytes))
-		return true
-	} else {
-		return false
-	}
-}
-
 //
 // Yes or No user input
 //
@@ -135,7 +101,8 @@ func ChooseFile(dir string) string {
 }
 
 //
-// Returns all the files with a given name.
+// Returns all the files with a given name,
+// and those named after it such as versions and sidecars (name.1080p.mkv).
 //
 func FindInDir(dir, filename string) ([]string, bool) {
 	var output []string
@@ -144,13 +111,14 @@ func FindInDir(dir, filename string) ([]string, bool) {
 	var err error
 
 	dir_files, err = ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return output, false
+	}
 	common.CheckErr(err)
 
 	file_found = false
 	for _, dir_file := range dir_files {
-		ext := filepath.Ext(dir_file.Name())
-		name_no_ext := strings.TrimSuffix(dir_file.Name(), ext)
-		if name_no_ext == filename {
+		if !dir_file.IsDir() && library.BelongsToId(dir_file.Name(), filename) {
 			output = append(output, dir_file.Name())
 			file_found = true
 		}
@@ -158,6 +126,66 @@ func FindInDir(dir, filename string) ([]string, bool) {
 	return output, file_found
 }
 
+//
+// Places an input file in a season directory, named after its episode,
+// the way the plan's Placement says.
+// Videos are probed and labelled as versions of the episode,
+// named apart from the episode's other versions,
+// and sidecars are named by their language and flags.
+// A file of several episodes is placed once, with the first of them,
+// and the others share it.
+//
+func MoveEpisodeFile(
+	plan *common.Plan,
+	tomove string,
+	media_root string,
+	season_dir string,
+	episode_id string,
+	used_names map[string]bool,
+	placed_files map[string]structs.FileData,
+) structs.FileData {
+	if file_data, found := placed_files[tomove]; found {
+		return file_data
+	}
+	var file_data structs.FileData
+	tomove_ext := filepath.Ext(tomove)
+	name := episode_id + tomove_ext
+	if library.IsSidecar(tomove) {
+		// the rest of the name is the release's, not the sidecar's
+		tags := library.ParseSidecarTags(
+			strings.TrimSuffix(filepath.Base(tomove), tomove_ext),
+		)
+		tags.Others = nil
+		name = library.UniqueSidecarName(episode_id, tags, tomove_ext, used_names)
+		used_names[name] = true
+		file_data.Language = tags.Language
+		file_data.Flags = tags.Flags
+	} else {
+		file_data = library.ProbeFile(file_data, tomove)
+		file_data = library.LabelVersion(file_data, filepath.Base(tomove))
+		name = library.VersionName(
+			episode_id,
+			tomove_ext,
+			file_data.Label,
+			func(name string) bool {
+				return used_names[name] ||
+					plan.Exists(path.Join(media_root, season_dir, name))
+			},
+		)
+		used_names[name] = true
+	}
+	destination := path.Join(media_root, season_dir, name)
+	fmt.Printf("%s -> %s\n", tomove, destination)
+	plan.PlaceFile(tomove, destination)
+	placed := structs.NewFileData(name, season_dir)
+	file_data.Name = placed.Name
+	file_data.Path = placed.Path
+	file_data.Type = placed.Type
+	file_data.Placement = plan.Placement
+	placed_files[tomove] = file_data
+	return file_data
+}
+
 //---------------------------------------------------------------------------
 // Functions
 //---------------------------------------------------------------------------
@@ -165,8 +193,7 @@ func FindInDir(dir, filename string) ([]string, bool) {
 // Searches for a show in the TMDB and downloads its poster and backdrop.
 //
 func FindShow(
-	client http.Client,
-	api_key string,
+	client *tmdb.Client,
 	query string,
 	tmp_dir string,
 ) (
@@ -174,7 +201,7 @@ func FindShow(
 	bool,
 ) {
 	var stdin_reader *bufio.Reader
-	var tmdb structs.TMDBTVSearch
+	var search structs.TMDBTVSearch
 	var results []structs.TMDBTVSearchResult
 	var err error
 
@@ -195,7 +222,6 @@ func FindShow(
 			query = strings.Trim(query, "\n")
 			change_query = false
 		}
-		query = strings.Replace(query, " ", "%20", -1)
 		fmt.Printf("Current query is '%s'.\n", query)
 		if YesOrNo("Are you happy with this query? (y/n)") {
 			change_query = false
@@ -203,24 +229,13 @@ func FindShow(
 			change_query = true
 		}
 		if !change_query {
-			url := TV_SEARCH_URL + "?api_key=" + api_key + "&query=" + query
-
 			fmt.Printf("Searching the TMDB data base for '%s'.\n", query)
-			resp, err := client.Get(url)
-			common.CheckErr(err)
-			if NotOK(resp) {
-				return structs.TMDBTVSearchResult{}, false
-			}
-			defer resp.Body.Close()
-			body_bytes, err := ioutil.ReadAll(resp.Body)
-			common.CheckErr(err)
-			err = json.Unmarshal(body_bytes, &tmdb)
+			search, err = client.SearchTV(context.Background(), query, 0)
 			if err != nil {
-				fmt.Printf("Error decoding search response: %v\n", err)
-				fmt.Printf("Response Body: %s\n", string(body_bytes))
+				fmt.Printf("Error searching: %v\n", err)
 				return structs.TMDBTVSearchResult{}, false
 			}
-			results = tmdb.Results
+			results = search.Results
 			len_results = len(results)
 			fmt.Printf(
 				"There are %d results for the query '%s'.\n",
@@ -298,252 +313,418 @@ func FindShow(
 }
 
 //
-// Gets the tmdb info for a tv show, and returns it as a
+// Gets the tmdb info for a tv show, including every season's episodes
 //
 func GetShowInfo(
-	client http.Client,
-	api_key string,
+	client *tmdb.Client,
 	tmdb_id int,
 ) structs.TMDBTV {
-	var tmdb structs.TMDBTV
-	var url string
-	var resp *http.Response
-	var blob []byte
-	var err error
-
 	fmt.Println("Getting Show Data.")
-	url = TV_GET_URL + strconv.Itoa(tmdb_id) + "?api_key=" + api_key
-	resp, err = client.Get(url)
+	tmdb_show, err := client.TVWithSeasons(context.Background(), tmdb_id)
 	common.CheckErr(err)
-	if NotOK(resp) {
-		log.Fatal("Reponse not OK")
+	return tmdb_show
+}
+
+//
+// Finds the show with a TMDB id if it is already in the library,
+// locking its info file for the plan.
+//
+func FindExistingShow(
+	plan *common.Plan,
+	media_root string,
+	tmdb_id int,
+) (
+	structs.ShowData,
+	bool,
+) {
+	for _, info := range library.FindKindInfoFiles(media_root, library.SHOW_INFO) {
+		var show structs.ShowData
+		library.ReadInfoFile(info.Path, &show)
+		if show.TMDBId == tmdb_id {
+			// read it again now no one else can change it
+			plan.Lock(info.Path)
+			library.ReadInfoFile(info.Path, &show)
+			return show, true
+		}
 	}
-	defer resp.Body.Close()
-	blob, err = ioutil.ReadAll(resp.Body)
-	common.CheckErr(err)
+	return structs.ShowData{}, false
+}
 
-	err = json.Unmarshal(blob, &tmdb)
-	common.CheckErr(err)
+//
+// Finds the season matching a TMDB season by its TMDB id,
+// or by its number if it has no id. Returns -1 if there isn't one.
+//
+func MatchSeason(seasons []structs.SeasonData, tmdb_season structs.TMDBSeason) int {
+	for idx, season := range seasons {
+		if (season.TMDBId != 0 && season.TMDBId == tmdb_season.Id) ||
+			(season.TMDBId == 0 && season.SeasonNumber == tmdb_season.SeasonNumber) {
+			return idx
+		}
+	}
+	return -1
+}
 
-	for season_idx, season := range tmdb.Seasons {
-		var season_tmp structs.TMDBSeason
-		url = TV_GET_URL + strconv.Itoa(tmdb_id) +
-			"/season/" + strconv.Itoa(season.SeasonNumber) +
-			"?api_key=" + api_key
-		resp, err = client.Get(url)
-		common.CheckErr(err)
-		if NotOK(resp) {
-			log.Fatal("Reponse not OK")
+//
+// Finds the episode matching a TMDB episode by its TMDB id,
+// or by its number if it has no id. Returns -1 if there isn't one.
+//
+func MatchEpisode(
+	episodes []structs.EpisodeData,
+	tmdb_episode structs.TMDBEpisode,
+) int {
+	for idx, episode := range episodes {
+		if (episode.TMDBId != 0 && episode.TMDBId == tmdb_episode.Id) ||
+			(episode.TMDBId == 0 && episode.EpisodeNumber == tmdb_episode.EpisodeNumber) {
+			return idx
 		}
-		defer resp.Body.Close()
-		blob, err = ioutil.ReadAll(resp.Body)
-		common.CheckErr(err)
+	}
+	return -1
+}
 
-		err = json.Unmarshal(blob, &season_tmp)
-		common.CheckErr(err)
+//
+// Plans to download a picture if it isn't there already,
+// returning its file data and whether it will be downloaded.
+//
+func GetPicture(
+	plan *common.Plan,
+	tmdb_img string,
+	media_root string,
+	sub_dir string,
+	name string,
+	current structs.FileData,
+) (
+	structs.FileData,
+	bool,
+) {
+	if current.Name != "" || tmdb_img == "" {
+		return current, false
+	}
+	plan.Download(tmdb_img, path.Join(media_root, sub_dir, name))
+	return structs.NewFileData(name, sub_dir), true
+}
 
-		tmdb.Seasons[season_idx] = season_tmp
+//
+// Adds an episode which isn't in the library yet,
+// using mapped files, files already in the season directory
+// or files chosen by the user, if asking.
+// Returns false if the episode was skipped.
+//
+func AddEpisode(
+	plan *common.Plan,
+	tmdb_episode structs.TMDBEpisode,
+	episode_id string,
+	mapped_files []string,
+	media_root string,
+	season_dir string,
+	input_dir string,
+	season_input_dir *string,
+	placed_files map[string]structs.FileData,
+	ask bool,
+) (
+	structs.EpisodeData,
+	bool,
+) {
+	fmt.Printf(
+		"Episode %d (%s)\n",
+		tmdb_episode.EpisodeNumber,
+		tmdb_episode.Name,
+	)
+
+	// if files already exist for this episode
+	files_present, files_exist := FindInDir(
+		path.Join(media_root, season_dir),
+		episode_id,
+	)
+	var episode_files []structs.FileData
+	used_names := make(map[string]bool)
+	if files_exist {
+		//make info for existing files
+		for _, filename := range files_present {
+			episode_files = append(
+				episode_files,
+				library.LabelVersion(
+					library.ProbeFile(
+						structs.NewFileData(filename, season_dir),
+						path.Join(media_root, season_dir, filename),
+					),
+					"",
+				),
+			)
+		}
+	} else if len(mapped_files) > 0 {
+		// move the mapped files
+		for _, tomove := range mapped_files {
+			episode_files = append(
+				episode_files,
+				MoveEpisodeFile(
+					plan,
+					tomove,
+					media_root,
+					season_dir,
+					episode_id,
+					used_names,
+					placed_files,
+				),
+			)
+		}
+	} else if ask && YesOrNo("Do you have this episode?") {
+		if *season_input_dir == "" {
+			fmt.Println("Which folder are the season files stored?")
+			*season_input_dir = ChooseFile(input_dir)
+			common.CheckDir(*season_input_dir)
+		}
+		// move select and move the episode's files
+		files_moved := true
+		for files_moved {
+			fmt.Println("Select an episode file?")
+			tomove := ChooseFile(*season_input_dir)
+			episode_files = append(
+				episode_files,
+				MoveEpisodeFile(
+					plan,
+					tomove,
+					media_root,
+					season_dir,
+					episode_id,
+					used_names,
+					placed_files,
+				),
+			)
+			files_moved =
+				!YesOrNo("Are these all the episode files?")
+		}
+	} else {
+		return structs.EpisodeData{}, false
 	}
-	return tmdb
+
+	// download still
+	still_file, _ := GetPicture(
+		plan,
+		tmdb_episode.StillPath,
+		media_root,
+		season_dir,
+		episode_id+"__S.jpg",
+		structs.FileData{},
+	)
+	return structs.TMDBEpisodeToEpisodeData(
+		&tmdb_episode,
+		&episode_id,
+		&still_file,
+		&episode_files,
+	), true
+}
+
+//
+// Saves a show's info file
+//
+func SaveShow(plan *common.Plan, show_info string, show structs.ShowData) {
+	blob, err := json.MarshalIndent(show, "", common.INDENT)
+	common.CheckErr(err)
+	fmt.Println("Saving Show Data.")
+	plan.SaveBlob(blob, show_info)
 }
 
 //
 // Arranges files and downloads information for a show.
+// A show already in the library is updated,
+// keeping its seasons and episodes and only asking about what is missing.
+// Without asking the mapping is used as it is
+// and anything it doesn't have is skipped.
 //
 func CreateShow(
-	client http.Client,
+	plan *common.Plan,
 	tmdb_show structs.TMDBTV,
 	media_root string,
 	input_dir string,
+	ask bool,
 ) {
-	var err error
-	show_id := common.PosixFileName(
-		strings.Replace(tmdb_show.Name, " ", "_", -1),
-	) + "__" + tmdb_show.FirstAirDate
+	changed := false
+	naming := library.ReadNaming(media_root)
+	show_id := naming.ShowName(
+		tmdb_show.Name,
+		tmdb_show.FirstAirDate,
+		tmdb_show.Id,
+	)
+
+	// load the show if it is already in the library,
+	// otherwise make sure its directory isn't another show's
+	existing_show, show_exists := FindExistingShow(plan, media_root, tmdb_show.Id)
+	if show_exists {
+		show_id = existing_show.Id
+		fmt.Printf("Updating '%s'.\n", show_id)
+	} else {
+		show_id = library.UniqueId(show_id, tmdb_show.Id, func(id string) bool {
+			return plan.Exists(path.Join(media_root, SHOW_DIR, id, id+".json"))
+		})
+	}
 	show_dir := path.Join(SHOW_DIR, show_id)
-	common.CheckDir(path.Join(media_root, show_dir))
+	show_info := path.Join(media_root, show_dir, show_id+".json")
+	plan.Lock(show_info)
+	plan.CheckDir(path.Join(media_root, show_dir))
+
+	seasons_kept := make([]bool, len(existing_show.Seasons))
+
+	// propose a mapping of the input files to the missing episodes
+	mapping := ScanEpisodeFiles(input_dir)
+	mapping.Restrict(tmdb_show, existing_show)
+	use_mapping := false
+	placed_files := make(map[string]structs.FileData)
+	if len(mapping.Files) > 0 {
+		mapping.Print(tmdb_show)
+		use_mapping = !ask || YesOrNo("Is this mapping correct? (y/n)")
+	}
 
 	// for the seasons in the show
 	var seasons []structs.SeasonData
 	for _, tmdb_season := range tmdb_show.Seasons {
+		var existing_season structs.SeasonData
+		season_idx := MatchSeason(existing_show.Seasons, tmdb_season)
+		season_exists := season_idx >= 0
+		if season_exists {
+			existing_season = existing_show.Seasons[season_idx]
+			seasons_kept[season_idx] = true
+		}
+
 		fmt.Printf(
 			"Season %d (%s)\n",
 			tmdb_season.SeasonNumber,
 			tmdb_season.Name,
 		)
-		if YesOrNo("Do you have this season?") {
-			season_id := fmt.Sprintf(
-				"%02d__%s__%s",
-				tmdb_season.SeasonNumber,
-				common.PosixFileName(
-					strings.Replace(tmdb_season.Name, " ", "_", -1),
-				),
-				tmdb_season.AirDate,
-			)
-			season_dir := path.Join(show_dir, season_id)
-			common.CheckDir(path.Join(media_root, season_dir))
-
-			// add episodes
-			fmt.Println("Which folder are the season files stored?")
-			season_input_dir := ChooseFile(input_dir)
-			common.CheckDir(season_input_dir)
+		have_season := season_exists ||
+			use_mapping && mapping.HasSeason(tmdb_season.SeasonNumber)
+		if !have_season && (!ask || !YesOrNo("Do you have this season?")) {
+			continue
+		}
 
-			var episodes []structs.EpisodeData
-			for _, tmdb_episode := range tmdb_season.Episodes {
-				fmt.Printf(
-					"Episode %d (%s)\n",
-					tmdb_episode.EpisodeNumber,
-					tmdb_episode.Name,
-				)
-				episode_id := fmt.Sprintf(
-					"%02d__%s__%s",
+		season_fields := library.EpisodeFields{
+			Show:         tmdb_show.Name,
+			ShowTMDBId:   tmdb_show.Id,
+			Season:       tmdb_season.SeasonNumber,
+			SeasonName:   tmdb_season.Name,
+			SeasonDate:   tmdb_season.AirDate,
+			SeasonTMDBId: tmdb_season.Id,
+		}
+		season_id, _ := naming.EpisodeNames(season_fields)
+		if season_exists {
+			season_id = existing_season.Id
+		}
+		season_dir := path.Join(show_dir, season_id)
+		plan.CheckDir(path.Join(media_root, season_dir))
+
+		episodes_kept := make([]bool, len(existing_season.Episodes))
+
+		// add episodes
+		season_input_dir := ""
+		var episodes []structs.EpisodeData
+		for _, tmdb_episode := range tmdb_season.Episodes {
+			episode_idx := MatchEpisode(existing_season.Episodes, tmdb_episode)
+			if episode_idx >= 0 {
+				episodes = append(episodes, existing_season.Episodes[episode_idx])
+				episodes_kept[episode_idx] = true
+				continue
+			}
+			var mapped_files []string
+			if use_mapping {
+				mapped_files = mapping.Files[EpisodeKey{
+					tmdb_season.SeasonNumber,
 					tmdb_episode.EpisodeNumber,
-					common.PosixFileName(
-						strings.Replace(tmdb_episode.Name, " ", "_", -1),
-					),
-					tmdb_episode.AirDate,
-				)
-
-				// if files already exist for this episode
-				files_present, files_exist := FindInDir(
-					path.Join(media_root, season_dir),
-					episode_id,
-				)
-				var episode_files []structs.FileData
-				skipping_episode := false
-				if files_exist {
-					//make info for existing files
-					for _, filename := range files_present {
-						ext := filepath.Ext(filename)
-						episode_files = append(
-							episode_files,
-							structs.FileData{
-								filename,
-								path.Join(
-									season_dir,
-									filename,
-								),
-								ext[1:],
-							},
-						)
-					}
-				} else if YesOrNo("Do you have this episode?") {
-					// move select and move the episode's files
-					files_moved := true
-					for files_moved {
-						fmt.Println("Select an episode file?")
-						tomove := ChooseFile(season_input_dir)
-						tomove_ext := filepath.Ext(tomove)
-						destination := path.Join(
-							media_root,
-							season_dir,
-							episode_id+tomove_ext,
-						)
-						fmt.Printf("%s -> %s\n", tomove, destination)
-						err = os.Rename(tomove, destination)
-						common.CheckErr(err)
-						episode_files = append(
-							episode_files,
-							structs.FileData{
-								episode_id + tomove_ext,
-								path.Join(
-									season_dir,
-									episode_id+tomove_ext,
-								),
-								tomove_ext[1:],
-							},
-						)
-						files_moved =
-							!YesOrNo("Are these all the episode files?")
-					}
-				} else {
-					skipping_episode = true
-				}
-				if !skipping_episode {
-					// download still
-					still_name := episode_id + "__S.jpg"
-					var still_file structs.FileData
-					if tmdb_episode.StillPath != "" {
-						if DownloadImage(
-							client,
-							tmdb_episode.StillPath,
-							path.Join(media_root, season_dir, still_name),
-						) {
-							still_file = structs.FileData{
-								still_name,
-								path.Join(season_dir, still_name),
-								"jpg",
-							}
-						}
-					}
-					// add episode info to season info
-					episode := structs.TMDBEpisodeToEpisodeData(
-						&tmdb_episode,
-						&episode_id,
-						&still_file,
-						&episode_files,
-					)
-					episodes = append(episodes, episode)
-				}
+				}]
 			}
-			// download poster
-			season_poster_name := season_id + "__P.jpg"
-			var season_poster_file structs.FileData
-			if tmdb_season.PosterPath != "" {
-				if DownloadImage(
-					client,
-					tmdb_season.PosterPath,
-					path.Join(media_root, season_dir, season_poster_name),
-				) {
-					season_poster_file = structs.FileData{
-						season_poster_name,
-						path.Join(season_dir, season_poster_name),
-						"jpg",
-					}
-				}
-				// add season info to show info
-				seasons = append(seasons, structs.TMDBSeasonToSeasonData(
-					&tmdb_season,
-					&season_id,
-					&season_poster_file,
-					&episodes,
-				))
+			episode_fields := season_fields
+			episode_fields.Episode = tmdb_episode.EpisodeNumber
+			episode_fields.Name = tmdb_episode.Name
+			episode_fields.Date = tmdb_episode.AirDate
+			episode_fields.TMDBId = tmdb_episode.Id
+			_, episode_id := naming.EpisodeNames(episode_fields)
+			episode, added := AddEpisode(
+				plan,
+				tmdb_episode,
+				episode_id,
+				mapped_files,
+				media_root,
+				season_dir,
+				input_dir,
+				&season_input_dir,
+				placed_files,
+				ask,
+			)
+			if added {
+				episodes = append(episodes, episode)
+				changed = true
 			}
 		}
-	}
-	// download poster
-	show_poster_name := show_id + "__P.jpg"
-	var show_poster_file structs.FileData
-	if tmdb_show.PosterPath != "" {
-		if DownloadImage(
-			client,
-			tmdb_show.PosterPath,
-			path.Join(media_root, show_dir, show_poster_name),
-		) {
-			show_poster_file = structs.FileData{
-				show_poster_name,
-				path.Join(show_dir, show_poster_name),
-				"jpg",
+		// keep episodes which are no longer listed
+		for idx, episode := range existing_season.Episodes {
+			if !episodes_kept[idx] {
+				episodes = append(episodes, episode)
 			}
 		}
+
+		// download poster
+		poster_file, downloaded := GetPicture(
+			plan,
+			tmdb_season.PosterPath,
+			media_root,
+			season_dir,
+			season_id+"__P.jpg",
+			existing_season.PosterFile,
+		)
+		changed = changed || downloaded
+
+		// add season info to show info
+		if season_exists {
+			existing_season.PosterFile = poster_file
+			existing_season.Episodes = episodes
+			seasons = append(seasons, existing_season)
+		} else {
+			seasons = append(seasons, structs.TMDBSeasonToSeasonData(
+				&tmdb_season,
+				&season_id,
+				&poster_file,
+				&episodes,
+			))
+			changed = true
+		}
 	}
-	// download backdrop
-	show_backdrop_name := show_id + "__B.jpg"
-	var show_backdrop_file structs.FileData
-	if tmdb_show.BackdropPath != "" {
-		if DownloadImage(
-			client,
-			tmdb_show.BackdropPath,
-			path.Join(media_root, show_dir, show_backdrop_name),
-		) {
-			show_backdrop_file = structs.FileData{
-				show_backdrop_name,
-				path.Join(show_dir, show_backdrop_name),
-				"jpg",
-			}
+	// keep seasons which are no longer listed
+	for idx, season := range existing_show.Seasons {
+		if !seasons_kept[idx] {
+			seasons = append(seasons, season)
 		}
 	}
+
+	// download poster and backdrop
+	show_poster_file, poster_downloaded := GetPicture(
+		plan,
+		tmdb_show.PosterPath,
+		media_root,
+		show_dir,
+		show_id+"__P.jpg",
+		existing_show.PosterFile,
+	)
+	show_backdrop_file, backdrop_downloaded := GetPicture(
+		plan,
+		tmdb_show.BackdropPath,
+		media_root,
+		show_dir,
+		show_id+"__B.jpg",
+		existing_show.BackdropFile,
+	)
+	changed = changed || poster_downloaded || backdrop_downloaded
+
 	// save show info file
+	if show_exists {
+		if !changed {
+			fmt.Println("Nothing new to add.")
+			return
+		}
+		existing_show.PosterFile = show_poster_file
+		existing_show.BackdropFile = show_backdrop_file
+		existing_show.Seasons = seasons
+		plan.BackupFile(show_info)
+		SaveShow(plan, show_info, existing_show)
+		return
+	}
 	show := structs.TMDBTVToShowData(
 		&tmdb_show,
 		&show_id,
@@ -551,14 +732,7 @@ func CreateShow(
 		&show_backdrop_file,
 		&seasons,
 	)
-	blob, err := json.MarshalIndent(show, "", common.INDENT)
-	common.CheckErr(err)
-	fmt.Println("Saving Show Data.")
-	common.SaveBlob(blob, path.Join(
-		media_root,
-		show_dir,
-		show_id+".json",
-	))
+	SaveShow(plan, show_info, show)
 }
 
 //---------------------------------------------------------------------------
@@ -566,7 +740,19 @@ func CreateShow(
 //---------------------------------------------------------------------------
 //
 func main() {
-	if len(os.Args) < 4 {
+	dry_run := flag.Bool("dry-run", false, "print what would be done without doing it")
+	as_json := flag.Bool("json", false, "print the dry run plan as json")
+	placement := flag.String(
+		"placement",
+		common.PLACE_MOVE,
+		"how episode files are put in the media directory: "+
+			strings.Join(common.PLACEMENTS, ", "),
+	)
+	tmdb_id := flag.Int("id", 0, "TMDB id of the show, used without searching")
+	yes := flag.Bool("yes", false, "use the proposed mapping without asking")
+	flag.Parse()
+
+	if flag.NArg() < 3 {
 		println(
 			"Please provide an API key,",
 			"an input directory",
@@ -578,28 +764,76 @@ func main() {
 	var query string
 	var stdin_reader *bufio.Reader
 
-	api_key := os.Args[1]
-	media_root := os.Args[2]
-	input_dir := os.Args[3]
-
-	common.CheckDir(input_dir)
-	common.CheckDir(media_root)
+	api_key := flag.Arg(0)
+	media_root := flag.Arg(1)
+	input_dir := flag.Arg(2)
+	err = common.CheckPlacement(*placement)
+	common.CheckErr(err)
 
-	timeout := time.Duration(TIMEOUT * time.Second)
-	client := http.Client{
-		Timeout: timeout,
+	plan := common.NewPlan()
+	plan.Placement = *placement
+	// a single episode file can be given in place of a directory
+	input_info, err := os.Stat(input_dir)
+	input_is_file := err == nil && !input_info.IsDir()
+	if !input_is_file {
+		common.CheckDir(input_dir)
+	}
+	if *dry_run {
+		plan.CheckDir(media_root)
+	} else {
+		common.CheckDir(media_root)
 	}
-	stdin_reader = bufio.NewReader(os.Stdin)
 
-	println("What's the show's name?")
-	query, err = stdin_reader.ReadString('\n')
-	common.CheckErr(err)
-	query = strings.Trim(query, "\n")
+	client := tmdb.NewClient(api_key)
 
-	search_result, found_show := FindShow(client, api_key, query, input_dir)
+	search_result := structs.TMDBTVSearchResult{Id: *tmdb_id}
+	if *tmdb_id == 0 {
+		stdin_reader = bufio.NewReader(os.Stdin)
+		println("What's the show's name?")
+		query, err = stdin_reader.ReadString('\n')
+		common.CheckErr(err)
+		query = strings.Trim(query, "\n")
 
-	if found_show {
-		tmdb_show := GetShowInfo(client, api_key, search_result.Id)
-		CreateShow(client, tmdb_show, media_root, input_dir)
+		// keep the poster preview out of the input directory in a dry run
+		preview_dir := input_dir
+		if *dry_run || input_is_file {
+			preview_dir = os.TempDir()
+		}
+		var found_show bool
+		search_result, found_show = FindShow(client, query, preview_dir)
+		if !found_show {
+			return
+		}
+	}
+
+	// finish an earlier attempt which didn't, if it was from the same input,
+	// as it would place that input's files rather than these
+	item := strconv.Itoa(search_result.Id)
+	defer plan.Unlock()
+	input := common.Absolute(input_dir)
+	journal, unfinished := common.FindUnfinishedJournal(media_root, COMMAND, item)
+	if unfinished && journal.Input != input && !*dry_run {
+		from := "another input"
+		if journal.Input != "" {
+			from = "'" + journal.Input + "'"
+		}
+		fmt.Printf("'%s' didn't finish adding this show from %s.\n", journal.Location, from)
+		unfinished = !*yes && YesOrNo("Finish that rather than adding this input? (y/n)")
 	}
+	if unfinished && !*dry_run {
+		fmt.Printf("Resuming from '%s'.\n", journal.Location)
+	} else {
+		tmdb_show := GetShowInfo(client, search_result.Id)
+		CreateShow(plan, tmdb_show, media_root, input_dir, !*yes)
+		if *dry_run {
+			plan.Print(*as_json)
+			return
+		}
+		journal = common.NewJournal(media_root, COMMAND, item, input, plan)
+	}
+	err = journal.Run(func(picture string, location string) error {
+		_, err := client.DownloadImage(context.Background(), picture, location)
+		return err
+	})
+	common.CheckErr(err)
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"serviam/releasename"
+	"serviam/structs"
+	"sort"
+	"strings"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// extensions of files which belong to an episode
+//
+var EPISODE_EXTENSIONS = []string{
+	".mp4",
+	".mkv",
+	".avi",
+	".m4v",
+	".srt",
+	".sub",
+	".vtt",
+	".ass",
+}
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// Identifies an episode by its season and episode numbers
+//
+type EpisodeKey struct {
+	Season  int
+	Episode int
+}
+
+//
+// Input files matched to the episodes of a show,
+// the files which couldn't be matched
+// and those of episodes already in the library
+//
+type EpisodeMapping struct {
+	Files     map[EpisodeKey][]string
+	Unmatched []string
+	Known     []string
+	InLibrary map[EpisodeKey]bool
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Checks whether a file could belong to an episode from its extension
+//
+func IsEpisodeFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, episode_ext := range EPISODE_EXTENSIONS {
+		if ext == episode_ext {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Finds the episode files in a directory and its subdirectories.
+// Files are matched to every episode they contain,
+// several files of an episode being its versions and sidecars,
+// and those without an SxxEyy or 1x02 marker are unmatched.
+//
+func ScanEpisodeFiles(input_dir string) EpisodeMapping {
+	mapping := EpisodeMapping{
+		Files:     make(map[EpisodeKey][]string),
+		InLibrary: make(map[EpisodeKey]bool),
+	}
+
+	err := filepath.Walk(input_dir, func(
+		location string,
+		file_info os.FileInfo,
+		err error,
+	) error {
+		if err != nil {
+			return err
+		}
+		if file_info.IsDir() || !IsEpisodeFile(location) {
+			return nil
+		}
+		release := releasename.Parse(file_info.Name())
+		if !release.IsEpisode() {
+			mapping.Unmatched = append(mapping.Unmatched, location)
+			return nil
+		}
+		for _, episode := range release.Episodes {
+			key := EpisodeKey{release.Season, episode}
+			mapping.Files[key] = append(mapping.Files[key], location)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Couldn't search '%s': %v\n", input_dir, err)
+	}
+	return mapping
+}
+
+//
+// Moves the files which don't match an episode of the show to the unmatched
+// and drops those of episodes already in the library.
+// Files of several episodes are only dropped
+// if none of their episodes are left.
+//
+func (mapping *EpisodeMapping) Restrict(
+	tmdb_show structs.TMDBTV,
+	existing_show structs.ShowData,
+) {
+	episodes := make(map[EpisodeKey]bool)
+	for _, tmdb_season := range tmdb_show.Seasons {
+		var existing_episodes []structs.EpisodeData
+		if season_idx := MatchSeason(existing_show.Seasons, tmdb_season); season_idx >= 0 {
+			existing_episodes = existing_show.Seasons[season_idx].Episodes
+		}
+		for _, tmdb_episode := range tmdb_season.Episodes {
+			key := EpisodeKey{
+				tmdb_season.SeasonNumber,
+				tmdb_episode.EpisodeNumber,
+			}
+			if MatchEpisode(existing_episodes, tmdb_episode) >= 0 {
+				mapping.InLibrary[key] = true
+				mapping.Known = append(mapping.Known, mapping.Files[key]...)
+				delete(mapping.Files, key)
+			} else {
+				episodes[key] = true
+			}
+		}
+	}
+	var unmatched []string
+	for key, files := range mapping.Files {
+		if !episodes[key] {
+			unmatched = append(unmatched, files...)
+			delete(mapping.Files, key)
+		}
+	}
+	mapped := make(map[string]bool)
+	for _, files := range mapping.Files {
+		for _, file := range files {
+			mapped[file] = true
+		}
+	}
+	for _, file := range unmatched {
+		if !mapped[file] {
+			mapping.Unmatched = append(mapping.Unmatched, file)
+		}
+	}
+	var known []string
+	for _, file := range mapping.Known {
+		if !mapped[file] {
+			known = append(known, file)
+		}
+	}
+	mapping.Unmatched = UniqueSorted(mapping.Unmatched)
+	mapping.Known = UniqueSorted(known)
+}
+
+//
+// Sorts a list of files, dropping those listed twice
+//
+func UniqueSorted(files []string) []string {
+	var unique []string
+	sort.Strings(files)
+	for idx, file := range files {
+		if idx == 0 || file != files[idx-1] {
+			unique = append(unique, file)
+		}
+	}
+	return unique
+}
+
+//
+// Checks whether any files are mapped to a season
+//
+func (mapping *EpisodeMapping) HasSeason(season_number int) bool {
+	for key := range mapping.Files {
+		if key.Season == season_number {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Prints the mapping as a table, one row per file,
+// for every season with files
+//
+func (mapping *EpisodeMapping) Print(tmdb_show structs.TMDBTV) {
+	fmt.Printf("%6s %7s  %-30s  %s\n", "Season", "Episode", "Name", "File")
+	for _, tmdb_season := range tmdb_show.Seasons {
+		if !mapping.HasSeason(tmdb_season.SeasonNumber) {
+			continue
+		}
+		for _, tmdb_episode := range tmdb_season.Episodes {
+			key := EpisodeKey{
+				tmdb_season.SeasonNumber,
+				tmdb_episode.EpisodeNumber,
+			}
+			files := mapping.Files[key]
+			if mapping.InLibrary[key] {
+				files = []string{"(in the library)"}
+			} else if len(files) == 0 {
+				files = []string{"-"}
+			}
+			for _, file := range files {
+				fmt.Printf(
+					"%6d %7d  %-30.30s  %s\n",
+					tmdb_season.SeasonNumber,
+					tmdb_episode.EpisodeNumber,
+					tmdb_episode.Name,
+					file,
+				)
+			}
+		}
+	}
+	if len(mapping.Known) > 0 {
+		fmt.Println("Files of episodes already in the library:")
+		for _, file := range mapping.Known {
+			fmt.Printf("    %s\n", file)
+		}
+	}
+	if len(mapping.Unmatched) > 0 {
+		fmt.Println("Unmatched files:")
+		for _, file := range mapping.Unmatched {
+			fmt.Printf("    %s\n", file)
+		}
+	}
+}
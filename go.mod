@@ -1,3 +1,5 @@
 module serviam
 
 go 1.13
+
+require golang.org/x/text v0.13.0
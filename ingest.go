@@ -0,0 +1,683 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"serviam/common"
+	"serviam/library"
+	"serviam/match"
+	"serviam/releasename"
+	"serviam/tmdb"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// inbox settings
+//
+const (
+	INBOX_DIR           = "inbox"
+	POSTER_CACHE_DIR    = "serviam-posters"
+	ADMIN_HTML_TEMPLATE = "internal/admin.html"
+	MATCH_HTML_TEMPLATE = "internal/match.html"
+	JOB_HTML_TEMPLATE   = "internal/job.html"
+	MAX_CANDIDATES      = 10
+)
+
+//
+// environment variables, the TMDB API key for searching and placing,
+// the directory of the scripts if they aren't on the PATH
+// and the admin password, without which the admin section
+// is only served to this machine
+//
+const (
+	API_KEY_ENV        = "TMDB_API_KEY"
+	BIN_DIR_ENV        = "SERVIAM_BIN_DIR"
+	ADMIN_PASSWORD_ENV = "SERVIAM_ADMIN_PASSWORD"
+)
+
+//
+// admin login settings
+//
+const (
+	ADMIN_USER       = "admin"
+	ADMIN_REALM      = "serviam admin"
+	CSRF_TOKEN_BYTES = 32
+)
+
+//
+// directories the scripts make in the inbox, which aren't listed
+//
+var INBOX_SCRIPT_DIRS = map[string]bool{
+	"pictures":    true,
+	"collections": true,
+	"moved":       true,
+}
+
+//
+// job states
+//
+const (
+	JOB_QUEUED  = "queued"
+	JOB_RUNNING = "running"
+	JOB_DONE    = "done"
+	JOB_FAILED  = "failed"
+)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// An entry of the inbox, a video or a directory of episodes.
+// Directories and videos named like episodes are matched as shows.
+//
+type InboxEntry struct {
+	Name  string
+	Dir   bool
+	Show  bool
+	Query string
+	Year  int
+	Job   *IngestJob
+}
+
+//
+// Admin page structure
+//
+type AdminPage struct {
+	Inbox   string
+	Entries []InboxEntry
+	Jobs    []*IngestJob
+	Error   string
+}
+
+//
+// Match page structure
+//
+type MatchPage struct {
+	Entry      InboxEntry
+	Candidates []match.Candidate
+	CSRFToken  string
+	Error      string
+}
+
+//
+// Job progress structure
+//
+type JobProgress struct {
+	XMLName xml.Name `xml:"job"`
+	State   string   `xml:"state,attr"`
+	Lines   []string `xml:"line"`
+}
+
+//
+// Placing an inbox entry as a TMDB film or show,
+// with the output of the scripts doing it
+//
+type IngestJob struct {
+	Id     int
+	Name   string
+	Show   bool
+	TMDBId int
+	Title  string
+	lock   sync.Mutex
+	state  string
+	output strings.Builder
+}
+
+//
+// Holds the inbox and the queue of jobs placing its entries.
+// Jobs run one at a time in the order they were confirmed.
+// Confirming a match needs the CSRF token given with the match page,
+// so other sites can't confirm one through the browser.
+//
+type Ingester struct {
+	site_server *SiteServer
+	client      *tmdb.Client
+	api_key     string
+	bin_dir     string
+	password    string
+	csrf_token  string
+	media_root  string
+	inbox       string
+	lock        sync.Mutex
+	jobs        []*IngestJob
+	queue       chan *IngestJob
+}
+
+//---------------------------------------------------------------------------
+// Job Functions
+//---------------------------------------------------------------------------
+//
+// Collects the output of the job's scripts
+//
+func (job *IngestJob) Write(blob []byte) (int, error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.output.Write(blob)
+}
+
+//
+// Adds a line to the job's output
+//
+func (job *IngestJob) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(job, format, args...)
+}
+
+//
+// Gets the job's state
+//
+func (job *IngestJob) State() string {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.state
+}
+
+//
+// Sets the job's state
+//
+func (job *IngestJob) SetState(state string) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.state = state
+}
+
+//
+// Checks whether the job is still to finish
+//
+func (job *IngestJob) Active() bool {
+	state := job.State()
+	return state == JOB_QUEUED || state == JOB_RUNNING
+}
+
+//
+// Gets the lines the job's scripts have output so far
+//
+func (job *IngestJob) Lines() []string {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	output := strings.TrimSuffix(job.output.String(), "\n")
+	if output == "" {
+		return nil
+	}
+	return strings.Split(output, "\n")
+}
+
+//
+// Gets what kind of item the job places
+//
+func (job *IngestJob) Kind() string {
+	if job.Show {
+		return "show"
+	}
+	return "film"
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Sets up the inbox next to the media directory.
+// Without a TMDB API key the inbox is listed but nothing can be matched.
+//
+func NewIngester(site_server *SiteServer) *Ingester {
+	media_root, err := filepath.Abs(MEDIA_ROOT)
+	common.CheckErr(err)
+	inbox, err := filepath.Abs(INBOX_DIR)
+	common.CheckErr(err)
+
+	csrf_token := make([]byte, CSRF_TOKEN_BYTES)
+	_, err = rand.Read(csrf_token)
+	common.CheckErr(err)
+
+	ingester := &Ingester{
+		site_server: site_server,
+		api_key:     os.Getenv(API_KEY_ENV),
+		bin_dir:     os.Getenv(BIN_DIR_ENV),
+		password:    os.Getenv(ADMIN_PASSWORD_ENV),
+		csrf_token:  hex.EncodeToString(csrf_token),
+		media_root:  media_root,
+		inbox:       inbox,
+		queue:       make(chan *IngestJob, 100),
+	}
+	if ingester.api_key != "" {
+		ingester.client = tmdb.NewClient(ingester.api_key)
+	}
+	if ingester.password == "" {
+		log.Printf(
+			"The admin section is only served to this machine,"+
+				" set %s to log in to it from elsewhere.\n",
+			ADMIN_PASSWORD_ENV,
+		)
+	}
+	go ingester.Run()
+	return ingester
+}
+
+//
+// Checks whether a request may use the admin section,
+// logged in with the admin password if there is one
+// or otherwise coming from this machine
+//
+func (ingester *Ingester) Authorised(r *http.Request) bool {
+	if ingester.password != "" {
+		user, password, ok := r.BasicAuth()
+		return ok &&
+			subtle.ConstantTimeCompare([]byte(user), []byte(ADMIN_USER)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(ingester.password)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+//
+// Checks a form was sent from one of the admin section's pages
+//
+func (ingester *Ingester) CheckCSRFToken(r *http.Request) bool {
+	token := r.PostFormValue("csrf")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(ingester.csrf_token)) == 1
+}
+
+//
+// Lists the entries of an inbox directory
+//
+func ListInbox(inbox string) ([]InboxEntry, error) {
+	var entries []InboxEntry
+	dir_files, err := ioutil.ReadDir(inbox)
+	if err != nil {
+		return entries, err
+	}
+	for _, dir_file := range dir_files {
+		name := dir_file.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		entry := InboxEntry{Name: name, Dir: dir_file.IsDir()}
+		if entry.Dir {
+			if INBOX_SCRIPT_DIRS[name] || library.IsSidecarDir(name) {
+				continue
+			}
+			entry.Show = true
+		} else if library.IsVideoName(name) {
+			entry.Show = releasename.Parse(name).IsEpisode()
+		} else {
+			continue
+		}
+		entry.Query, entry.Year = releasename.Query(name)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+//
+// Finds the last job of an inbox entry, nil if there isn't one.
+// The ingester must be locked.
+//
+func (ingester *Ingester) LastJob(name string) *IngestJob {
+	for idx := len(ingester.jobs) - 1; idx >= 0; idx-- {
+		if ingester.jobs[idx].Name == name {
+			return ingester.jobs[idx]
+		}
+	}
+	return nil
+}
+
+//
+// Finds the last job of an inbox entry, nil if there isn't one
+//
+func (ingester *Ingester) FindJob(name string) *IngestJob {
+	ingester.lock.Lock()
+	defer ingester.lock.Unlock()
+	return ingester.LastJob(name)
+}
+
+//
+// Finds an entry of the inbox by its name,
+// so only what is in the inbox can be placed
+//
+func (ingester *Ingester) FindEntry(name string) (InboxEntry, bool) {
+	entries, _ := ListInbox(ingester.inbox)
+	for _, entry := range entries {
+		if entry.Name == name {
+			entry.Job = ingester.FindJob(name)
+			return entry, true
+		}
+	}
+	return InboxEntry{}, false
+}
+
+//
+// Places a job's entry the way posterplucker and posterplacer do for films
+// and getshow does for shows, then reloads the library
+//
+func (ingester *Ingester) RunJob(job *IngestJob) {
+	job.SetState(JOB_RUNNING)
+	log.Printf("Placing '%s' as %s %d.\n", job.Name, job.Kind(), job.TMDBId)
+
+	run_script := func(name string, args ...string) error {
+		job.Printf("Running %s.\n", name)
+		return match.RunScript(ingester.bin_dir, ingester.inbox, job, name, args...)
+	}
+
+	var err error
+	tmdb_id := strconv.Itoa(job.TMDBId)
+	if job.Show {
+		err = run_script(
+			"getshow",
+			"-id", tmdb_id,
+			"-yes",
+			ingester.api_key,
+			ingester.media_root,
+			path.Join(ingester.inbox, job.Name),
+		)
+	} else {
+		err = run_script("posterplucker", "-id", tmdb_id, ingester.api_key, job.Name)
+		if err == nil {
+			info_file := strings.TrimSuffix(job.Name, filepath.Ext(job.Name)) + ".json"
+			err = run_script("posterplacer", ingester.media_root, info_file)
+		}
+	}
+	if err != nil {
+		job.Printf("Failed: %v\n", err)
+		log.Printf("Couldn't place '%s': %v\n", job.Name, err)
+		job.SetState(JOB_FAILED)
+		return
+	}
+
+	job.Printf("Reloading the library.\n")
+	if err := ingester.site_server.Reload(); err != nil {
+		// placed all the same, so a later rescan will show it
+		job.Printf("Couldn't reload the library: %v\n", err)
+		log.Printf("Couldn't reload the library: %v\n", err)
+	}
+	job.Printf("Done.\n")
+	job.SetState(JOB_DONE)
+}
+
+//
+// Runs the queued jobs
+//
+func (ingester *Ingester) Run() {
+	for job := range ingester.queue {
+		ingester.RunJob(job)
+	}
+}
+
+//
+// Queues a job placing an inbox entry,
+// unless one already is, returning the entry's job
+//
+func (ingester *Ingester) Queue(
+	entry InboxEntry,
+	show bool,
+	tmdb_id int,
+	title string,
+) *IngestJob {
+	ingester.lock.Lock()
+	if last_job := ingester.LastJob(entry.Name); last_job != nil && last_job.Active() {
+		ingester.lock.Unlock()
+		return last_job
+	}
+	job := &IngestJob{
+		Id:     len(ingester.jobs),
+		Name:   entry.Name,
+		Show:   show,
+		TMDBId: tmdb_id,
+		Title:  title,
+		state:  JOB_QUEUED,
+	}
+	ingester.jobs = append(ingester.jobs, job)
+	ingester.lock.Unlock()
+
+	job.Printf("Queued '%s' as the %s '%s'.\n", entry.Name, job.Kind(), title)
+	ingester.queue <- job
+	return job
+}
+
+//
+// Finds a job by the id in a request
+//
+func (ingester *Ingester) RequestedJob(r *http.Request) (*IngestJob, bool) {
+	job_id, err := strconv.Atoi(r.FormValue("id"))
+	ingester.lock.Lock()
+	defer ingester.lock.Unlock()
+	if err != nil || job_id < 0 || job_id >= len(ingester.jobs) {
+		return nil, false
+	}
+	return ingester.jobs[job_id], true
+}
+
+//---------------------------------------------------------------------------
+// Handlers
+//---------------------------------------------------------------------------
+//
+// Handles /admin requests, listing the inbox and the jobs
+//
+func (ingester *Ingester) HandleAdmin(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Serving admin site.\n")
+
+	page := AdminPage{Inbox: ingester.inbox}
+	entries, err := ListInbox(ingester.inbox)
+	if err != nil {
+		page.Error = fmt.Sprintf("Couldn't list the inbox: %v", err)
+	} else if ingester.client == nil {
+		page.Error = "Set " + API_KEY_ENV + " to match and place what is in the inbox."
+	}
+	for _, entry := range entries {
+		entry.Job = ingester.FindJob(entry.Name)
+		page.Entries = append(page.Entries, entry)
+	}
+	ingester.lock.Lock()
+	for idx := len(ingester.jobs) - 1; idx >= 0; idx-- {
+		page.Jobs = append(page.Jobs, ingester.jobs[idx])
+	}
+	ingester.lock.Unlock()
+
+	t, err := template.ParseFiles(ADMIN_HTML_TEMPLATE)
+	common.CheckErr(err)
+	err = t.Execute(w, page)
+	common.CheckErr(err)
+}
+
+//
+// Handles /match requests, giving the TMDB candidates for an inbox entry.
+// The query and whether it is a show can be changed.
+//
+func (ingester *Ingester) HandleMatch(w http.ResponseWriter, r *http.Request) {
+	entry, found := ingester.FindEntry(r.FormValue("name"))
+	if !found || ingester.client == nil {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("Serving match site for '%s'.\n", entry.Name)
+
+	if query := r.FormValue("q"); query != "" && query != entry.Query {
+		entry.Query = query
+		entry.Year = 0
+	}
+	if kind := r.FormValue("kind"); kind != "" && !entry.Dir {
+		entry.Show = kind == "show"
+	}
+	page := MatchPage{Entry: entry, CSRFToken: ingester.csrf_token}
+	candidates, err := match.Search(ingester.client, entry.Show, entry.Query, entry.Year)
+	if err != nil {
+		page.Error = fmt.Sprintf("Couldn't search TMDB: %v", err)
+	}
+	if len(candidates) > MAX_CANDIDATES {
+		candidates = candidates[:MAX_CANDIDATES]
+	}
+	page.Candidates = candidates
+
+	t, err := template.ParseFiles(MATCH_HTML_TEMPLATE)
+	common.CheckErr(err)
+	err = t.Execute(w, page)
+	common.CheckErr(err)
+}
+
+//
+// Handles /ingest requests, queueing a confirmed match
+//
+func (ingester *Ingester) HandleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Matches are confirmed with POST.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ingester.CheckCSRFToken(r) {
+		log.Printf("Refused a match without the CSRF token from %s.\n", r.RemoteAddr)
+		http.Error(w, "Matches are confirmed from the match page.", http.StatusForbidden)
+		return
+	}
+	entry, found := ingester.FindEntry(r.FormValue("name"))
+	tmdb_id, err := strconv.Atoi(r.FormValue("id"))
+	if !found || err != nil || ingester.client == nil {
+		http.NotFound(w, r)
+		return
+	}
+	show := entry.Dir || r.FormValue("kind") == "show"
+	job := ingester.Queue(entry, show, tmdb_id, r.FormValue("title"))
+	http.Redirect(w, r, "job?id="+strconv.Itoa(job.Id), http.StatusSeeOther)
+}
+
+//
+// Handles /job requests, showing a job's progress
+//
+func (ingester *Ingester) HandleJob(w http.ResponseWriter, r *http.Request) {
+	job, found := ingester.RequestedJob(r)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("Serving job site for '%s'.\n", job.Name)
+
+	t, err := template.ParseFiles(JOB_HTML_TEMPLATE)
+	common.CheckErr(err)
+	err = t.Execute(w, job)
+	common.CheckErr(err)
+}
+
+//
+// Handles /progress requests, giving a job's state and output as xml
+//
+func (ingester *Ingester) HandleProgress(w http.ResponseWriter, r *http.Request) {
+	job, found := ingester.RequestedJob(r)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	progress := JobProgress{State: job.State(), Lines: job.Lines()}
+
+	w.Header().Add("Content-Type", "application/xml; charset=utf-8")
+	blob, err := xml.Marshal(progress)
+	common.CheckErr(err)
+	_, err = w.Write(blob)
+	common.CheckErr(err)
+}
+
+//
+// Handles /poster requests, giving a candidate's poster from TMDB
+//
+func (ingester *Ingester) HandlePoster(w http.ResponseWriter, r *http.Request) {
+	tmdb_img := r.FormValue("path")
+	name := path.Base(tmdb_img)
+	if ingester.client == nil || tmdb_img != "/"+name || name == ".." {
+		http.NotFound(w, r)
+		return
+	}
+	cache_dir := path.Join(os.TempDir(), POSTER_CACHE_DIR)
+	location := path.Join(cache_dir, name)
+	if _, err := os.Stat(location); os.IsNotExist(err) {
+		common.CheckErr(os.MkdirAll(cache_dir, 0755))
+		_, err = ingester.client.DownloadImage(context.Background(), tmdb_img, location)
+		if err != nil {
+			log.Printf("Couldn't download '%s': %v\n", tmdb_img, err)
+			http.NotFound(w, r)
+			return
+		}
+	}
+	http.ServeFile(w, r, location)
+}
+
+//
+// Handles /rescan requests, reloading the library
+// once something else, such as watchfolder, has placed things in it.
+// A GET gives the CSRF token to post with,
+// which other sites can't read through the browser.
+//
+func (ingester *Ingester) HandleRescan(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(ingester.csrf_token))
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Rescans are asked for with POST.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ingester.CheckCSRFToken(r) {
+		log.Printf("Refused a rescan without the CSRF token from %s.\n", r.RemoteAddr)
+		http.Error(w, "Rescans need the token from GET /rescan.", http.StatusForbidden)
+		return
+	}
+	log.Printf("Rescanning the library.\n")
+	if err := ingester.site_server.Reload(); err != nil {
+		log.Printf("Couldn't rescan the library: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// Handles admin requests, once they are authorised
+//
+func (ingester *Ingester) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !ingester.Authorised(r) {
+		if ingester.password != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+ADMIN_REALM+`"`)
+			http.Error(w, "Log in to use the admin section.", http.StatusUnauthorized)
+		} else {
+			log.Printf("Refused an admin request from %s.\n", r.RemoteAddr)
+			http.Error(
+				w,
+				"The admin section is only served to the machine serviam runs on.",
+				http.StatusForbidden,
+			)
+		}
+		return
+	}
+	switch path := r.URL.Path; path {
+	case "/admin":
+		ingester.HandleAdmin(w, r)
+	case "/match":
+		ingester.HandleMatch(w, r)
+	case "/ingest":
+		ingester.HandleIngest(w, r)
+	case "/job":
+		ingester.HandleJob(w, r)
+	case "/progress":
+		ingester.HandleProgress(w, r)
+	case "/poster":
+		ingester.HandlePoster(w, r)
+	case "/rescan":
+		ingester.HandleRescan(w, r)
+	}
+}
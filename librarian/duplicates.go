@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"serviam/library"
+	"serviam/structs"
+	"sort"
+)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// A film or show in the library with its videos.
+// Films in collections are named by their collection and id.
+//
+type LibraryItem struct {
+	Kind   int
+	Name   string
+	TMDBId int
+	Videos []structs.FileData
+}
+
+//
+// Works out which duplicates could be removed,
+// counting each file's space once however many groups it is in
+//
+type DuplicateReport struct {
+	media_root  string
+	stats       map[string]os.FileInfo
+	reclaimable map[string]int64
+	num_groups  int
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Lists the films, including those in collections, and shows of a media root
+//
+func ListItems(media_root string) []LibraryItem {
+	var items []LibraryItem
+	add_film := func(name string, film structs.FilmData) {
+		var videos []structs.FileData
+		for _, file := range film.FilmFiles {
+			if library.IsVideo(file) {
+				videos = append(videos, file)
+			}
+		}
+		items = append(items, LibraryItem{library.FILM_INFO, name, film.TMDBId, videos})
+	}
+
+	for _, info := range library.FindInfoFiles(media_root) {
+		switch info.Kind {
+		case library.FILM_INFO:
+			var film structs.FilmData
+			library.ReadInfoFile(info.Path, &film)
+			add_film(info.SubDir, film)
+		case library.COLLECTION_INFO:
+			var collection structs.CollectionData
+			library.ReadInfoFile(info.Path, &collection)
+			for _, film := range collection.Films {
+				add_film(path.Join(info.SubDir, film.Id), film)
+			}
+		case library.SHOW_INFO:
+			var show structs.ShowData
+			library.ReadInfoFile(info.Path, &show)
+			item := LibraryItem{Kind: library.SHOW_INFO, Name: info.SubDir, TMDBId: show.TMDBId}
+			for _, season := range show.Seasons {
+				for _, episode := range season.Episodes {
+					for _, file := range episode.Files {
+						if library.IsVideo(file) {
+							item.Videos = append(item.Videos, file)
+						}
+					}
+				}
+			}
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+//
+// Formats a number of bytes for reading
+//
+func FormatSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(size)/(1<<20))
+	}
+	return fmt.Sprintf("%d B", size)
+}
+
+//
+// Looks up a video on disk, nil if it is missing
+//
+func (report *DuplicateReport) Stat(file structs.FileData) os.FileInfo {
+	if stat, ok := report.stats[file.Path]; ok {
+		return stat
+	}
+	stat, err := os.Stat(path.Join(report.media_root, file.Path))
+	if err != nil {
+		stat = nil
+	}
+	report.stats[file.Path] = stat
+	return stat
+}
+
+//
+// Gets the size of the videos given on disk
+//
+func (report *DuplicateReport) Size(files []structs.FileData) int64 {
+	size := int64(0)
+	for _, file := range files {
+		if stat := report.Stat(file); stat != nil {
+			size += stat.Size()
+		}
+	}
+	return size
+}
+
+//
+// Marks a video as one which could be removed, keeping the kept ones.
+// Videos which are links to a kept one take no space of their own.
+// Returns the space it takes.
+//
+func (report *DuplicateReport) Reclaim(file structs.FileData, kept []structs.FileData) int64 {
+	stat := report.Stat(file)
+	if stat == nil {
+		return 0
+	}
+	for _, kept_file := range kept {
+		if kept_stat := report.Stat(kept_file); kept_stat != nil && os.SameFile(stat, kept_stat) {
+			return 0
+		}
+	}
+	report.reclaimable[file.Path] = stat.Size()
+	return stat.Size()
+}
+
+//
+// Reports films, or shows, with the same TMDB id.
+// The one with the most video is kept and the videos of the rest could go.
+//
+func (report *DuplicateReport) SameTMDBId(items []LibraryItem) {
+	groups := make(map[[2]int][]LibraryItem)
+	var keys [][2]int
+	for _, item := range items {
+		if item.TMDBId == 0 {
+			continue
+		}
+		key := [2]int{item.Kind, item.TMDBId}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], item)
+	}
+
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+		report.num_groups++
+		kept := 0
+		for idx, item := range group {
+			if report.Size(item.Videos) > report.Size(group[kept].Videos) {
+				kept = idx
+			}
+		}
+		kind := "film"
+		if key[0] == library.SHOW_INFO {
+			kind = "show"
+		}
+		log.Printf("Same %s, TMDB id %d:\n", kind, key[1])
+
+		reclaimable := int64(0)
+		for idx, item := range group {
+			note := ""
+			if idx == kept {
+				note = ", kept"
+			} else {
+				for _, file := range item.Videos {
+					reclaimable += report.Reclaim(file, group[kept].Videos)
+				}
+			}
+			log.Printf(
+				"  %s, %d videos, %s%s\n",
+				item.Name,
+				len(item.Videos),
+				FormatSize(report.Size(item.Videos)),
+				note,
+			)
+		}
+		log.Printf("  %s could be reclaimed.\n", FormatSize(reclaimable))
+	}
+}
+
+//
+// Reports videos with the same size and hash, wherever they are.
+// A video already reported as one which could go isn't kept
+// if another copy can be.
+//
+func (report *DuplicateReport) SameHash(items []LibraryItem) {
+	groups := make(map[string][]structs.FileData)
+	var keys []string
+	seen := make(map[string]bool)
+	for _, item := range items {
+		for _, file := range item.Videos {
+			if file.Hash == "" || seen[file.Path] {
+				continue
+			}
+			seen[file.Path] = true
+			key := fmt.Sprintf("%d:%s", file.Size, file.Hash)
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], file)
+		}
+	}
+
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+		report.num_groups++
+		kept := 0
+		for idx, file := range group {
+			if _, ok := report.reclaimable[file.Path]; !ok {
+				kept = idx
+				break
+			}
+		}
+		log.Printf("Same video, %s:\n", FormatSize(group[0].Size))
+
+		reclaimable := int64(0)
+		for idx, file := range group {
+			note := ""
+			if idx == kept {
+				note = ", kept"
+			} else if _, ok := report.reclaimable[file.Path]; !ok {
+				size := report.Reclaim(file, group[kept:kept+1])
+				reclaimable += size
+				if size == 0 {
+					note = ", linked"
+				}
+			}
+			log.Printf("  %s%s\n", file.Path, note)
+		}
+		log.Printf("  %s could be reclaimed.\n", FormatSize(reclaimable))
+	}
+}
+
+//
+// Reports films and shows which are in a media root more than once,
+// by TMDB id or by having the same videos, and the space they take.
+// Nothing is removed.
+//
+func ReportDuplicates(media_root string) {
+	report := &DuplicateReport{
+		media_root:  media_root,
+		stats:       make(map[string]os.FileInfo),
+		reclaimable: make(map[string]int64),
+	}
+	items := ListItems(media_root)
+	report.SameTMDBId(items)
+	report.SameHash(items)
+
+	total := int64(0)
+	var paths []string
+	for file_path, size := range report.reclaimable {
+		total += size
+		paths = append(paths, file_path)
+	}
+	sort.Strings(paths)
+	for _, file_path := range paths {
+		log.Printf("Could remove '%s'.\n", file_path)
+	}
+	log.Printf(
+		"Found %d groups of duplicates, %s could be reclaimed.\n",
+		report.num_groups,
+		FormatSize(total),
+	)
+}
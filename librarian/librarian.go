@@ -0,0 +1,545 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"serviam/common"
+	"serviam/library"
+	"serviam/structs"
+	"serviam/tmdb"
+	"strings"
+)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// Keeps track of a directory's files and which of them are referenced
+//
+type DirFiles struct {
+	sub_dir string
+	names   []string
+	claimed map[string]bool
+}
+
+//
+// Lists a directory's files, ready for claiming
+//
+func NewDirFiles(media_root string, sub_dir string) *DirFiles {
+	return &DirFiles{
+		sub_dir: sub_dir,
+		names:   library.ListFiles(path.Join(media_root, sub_dir)),
+		claimed: make(map[string]bool),
+	}
+}
+
+//
+// Marks the files referenced by the FileData given as claimed
+//
+func (dir_files *DirFiles) Claim(files ...structs.FileData) {
+	for _, file := range files {
+		if path.Dir(file.Path) == dir_files.sub_dir {
+			dir_files.claimed[file.Name] = true
+		}
+	}
+}
+
+//
+// Returns the files in the directory which no item references
+//
+func (dir_files *DirFiles) Unclaimed() []string {
+	var output []string
+	for _, name := range dir_files.names {
+		ext := filepath.Ext(name)
+		if ext == ".json" || ext == ".bak" || dir_files.claimed[name] {
+			continue
+		}
+		output = append(output, path.Join(dir_files.sub_dir, name))
+	}
+	return output
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Repairs a picture reference, looking for picture_id when it is missing
+//
+func RepairPicture(
+	media_root string,
+	dir_files *DirFiles,
+	picture structs.FileData,
+	picture_id string,
+	notes *[]string,
+) structs.FileData {
+	if picture.Path != "" && library.FileExists(media_root, picture) {
+		dir_files.Claim(picture)
+		return picture
+	}
+	found, found_ok := library.FindPicture(
+		dir_files.names,
+		dir_files.sub_dir,
+		picture_id,
+	)
+	if picture.Path != "" {
+		*notes = append(*notes, "missing '"+picture.Path+"'")
+	}
+	if found_ok {
+		*notes = append(*notes, "attaching '"+found.Path+"'")
+		dir_files.Claim(found)
+		return found
+	}
+	if picture.Path != "" {
+		*notes = append(*notes, "dropping '"+picture.Path+"'")
+	}
+	return structs.FileData{}
+}
+
+//
+// Checks a file's recorded placement matches the file,
+// correcting it if the file is, or has stopped being, a link
+//
+func RepairPlacement(
+	media_root string,
+	file structs.FileData,
+	notes *[]string,
+) structs.FileData {
+	detected, err := common.DetectPlacement(path.Join(media_root, file.Path))
+	if err != nil {
+		return file
+	}
+	switch {
+	case detected == file.Placement:
+	case detected != "":
+		*notes = append(*notes, "'"+file.Path+"' is a "+detected)
+		file.Placement = detected
+	case file.Placement == common.PLACE_SYMLINK ||
+		file.Placement == common.PLACE_HARDLINK:
+		*notes = append(*notes, "'"+file.Path+"' is no longer a "+file.Placement)
+		file.Placement = detected
+	}
+	return file
+}
+
+//
+// Repairs a list of files of the item with the given id.
+// References to missing files are dropped
+// and files named after the id which are not referenced are attached.
+// Symlinks to missing files are reported but kept,
+// as what they point at may only be unmounted.
+//
+func RepairFiles(
+	media_root string,
+	dir_files *DirFiles,
+	files []structs.FileData,
+	id string,
+	notes *[]string,
+) []structs.FileData {
+	var output []structs.FileData
+	referenced := make(map[string]bool)
+
+	for _, file := range files {
+		location := path.Join(media_root, file.Path)
+		if library.FileExists(media_root, file) {
+			referenced[file.Path] = true
+			output = append(output, RepairPlacement(media_root, file, notes))
+		} else if target, err := os.Readlink(location); err == nil {
+			log.Printf("'%s' links to missing '%s'.\n", file.Path, target)
+			referenced[file.Path] = true
+			output = append(output, file)
+		} else {
+			*notes = append(*notes, "dropping missing '"+file.Path+"'")
+		}
+	}
+	found := library.FilesForId(dir_files.names, dir_files.sub_dir, id)
+	for _, file := range found {
+		if !referenced[file.Path] {
+			*notes = append(*notes, "attaching '"+file.Path+"'")
+			file.Placement, _ = common.DetectPlacement(
+				path.Join(media_root, file.Path),
+			)
+			file = library.ProbeFile(file, path.Join(media_root, file.Path))
+			if library.IsVideo(file) {
+				file = library.LabelVersion(file, "")
+			}
+			output = append(output, file)
+		}
+	}
+	dir_files.Claim(output...)
+	return output
+}
+
+//
+// Repairs the file references of a film
+//
+func RepairFilm(
+	media_root string,
+	dir_files *DirFiles,
+	film structs.FilmData,
+	notes *[]string,
+) structs.FilmData {
+	film.PosterFile = RepairPicture(
+		media_root,
+		dir_files,
+		film.PosterFile,
+		film.Id+library.POSTER_SUFFIX,
+		notes,
+	)
+	film.BackdropFile = RepairPicture(
+		media_root,
+		dir_files,
+		film.BackdropFile,
+		film.Id+library.BACKDROP_SUFFIX,
+		notes,
+	)
+	film.FilmFiles = RepairFiles(
+		media_root,
+		dir_files,
+		film.FilmFiles,
+		film.Id,
+		notes,
+	)
+	return film
+}
+
+//
+// Repairs the file references of a collection and its films
+//
+func RepairCollection(
+	media_root string,
+	dir_files *DirFiles,
+	info library.InfoFile,
+	collection structs.CollectionData,
+	notes *[]string,
+) structs.CollectionData {
+	collection.PosterFile = RepairPicture(
+		media_root,
+		dir_files,
+		collection.PosterFile,
+		info.Id+library.POSTER_SUFFIX,
+		notes,
+	)
+	collection.BackdropFile = RepairPicture(
+		media_root,
+		dir_files,
+		collection.BackdropFile,
+		info.Id+library.BACKDROP_SUFFIX,
+		notes,
+	)
+	films := make([]structs.FilmData, len(collection.Films))
+	for idx, film := range collection.Films {
+		films[idx] = RepairFilm(media_root, dir_files, film, notes)
+	}
+	collection.Films = films
+	return collection
+}
+
+//
+// Repairs the file references of a show, its seasons and its episodes
+//
+func RepairShow(
+	media_root string,
+	dir_files *DirFiles,
+	show structs.ShowData,
+	notes *[]string,
+	unclaimed *[]string,
+) structs.ShowData {
+	show.PosterFile = RepairPicture(
+		media_root,
+		dir_files,
+		show.PosterFile,
+		show.Id+library.POSTER_SUFFIX,
+		notes,
+	)
+	show.BackdropFile = RepairPicture(
+		media_root,
+		dir_files,
+		show.BackdropFile,
+		show.Id+library.BACKDROP_SUFFIX,
+		notes,
+	)
+	seasons := make([]structs.SeasonData, len(show.Seasons))
+	for season_idx, season := range show.Seasons {
+		season_files := NewDirFiles(
+			media_root,
+			path.Join(dir_files.sub_dir, season.Id),
+		)
+		season.PosterFile = RepairPicture(
+			media_root,
+			season_files,
+			season.PosterFile,
+			season.Id+library.POSTER_SUFFIX,
+			notes,
+		)
+		episodes := make([]structs.EpisodeData, len(season.Episodes))
+		for episode_idx, episode := range season.Episodes {
+			episode.StillFile = RepairPicture(
+				media_root,
+				season_files,
+				episode.StillFile,
+				episode.Id+library.STILL_SUFFIX,
+				notes,
+			)
+			episode.Files = RepairFiles(
+				media_root,
+				season_files,
+				episode.Files,
+				episode.Id,
+				notes,
+			)
+			episodes[episode_idx] = episode
+		}
+		season.Episodes = episodes
+		seasons[season_idx] = season
+		*unclaimed = append(*unclaimed, season_files.Unclaimed()...)
+	}
+	show.Seasons = seasons
+	return show
+}
+
+//
+// Checks, and if asked repairs, the items of an info file
+//
+func ProcessInfoFile(
+	media_root string,
+	info library.InfoFile,
+	repair bool,
+) int {
+	var notes []string
+	var unclaimed []string
+	var repaired interface{}
+
+	// locked so an ingestion can't change it between reading and rewriting it
+	lock, err := common.LockFile(info.Path)
+	common.CheckErr(err)
+	defer lock.Unlock()
+
+	dir_files := NewDirFiles(media_root, info.SubDir)
+
+	switch info.Kind {
+	case library.FILM_INFO:
+		var film structs.FilmData
+		library.ReadInfoFile(info.Path, &film)
+		repaired = RepairFilm(media_root, dir_files, film, &notes)
+	case library.COLLECTION_INFO:
+		var collection structs.CollectionData
+		library.ReadInfoFile(info.Path, &collection)
+		repaired = RepairCollection(
+			media_root,
+			dir_files,
+			info,
+			collection,
+			&notes,
+		)
+	case library.SHOW_INFO:
+		var show structs.ShowData
+		library.ReadInfoFile(info.Path, &show)
+		repaired = RepairShow(media_root, dir_files, show, &notes, &unclaimed)
+	}
+	unclaimed = append(dir_files.Unclaimed(), unclaimed...)
+
+	for _, note := range notes {
+		log.Printf("%s: %s.\n", info.SubDir, note)
+	}
+	for _, name := range unclaimed {
+		log.Printf("%s: '%s' is not referenced by any item.\n", info.SubDir, name)
+	}
+
+	if repair && len(notes) > 0 {
+		common.BackupFile(info.Path)
+		log.Printf("Rewriting '%s'.\n", info.Path)
+		library.WriteInfoFile(info.Path, repaired)
+	}
+	return len(notes)
+}
+
+//
+// Checks, and if asked repairs, every info file in a media root
+//
+func CheckLibrary(media_root string, repair bool) {
+	num_problems := 0
+	for _, info := range library.FindInfoFiles(media_root) {
+		num_problems += ProcessInfoFile(media_root, info, repair)
+	}
+	if repair {
+		log.Printf("Repaired %d problems.\n", num_problems)
+	} else {
+		log.Printf(
+			"Found %d problems. Run '%s repair %s' to fix them.\n",
+			num_problems,
+			os.Args[0],
+			media_root,
+		)
+		DedupeLibrary(media_root, false)
+	}
+}
+
+//
+// Merges films which appear in a collection more than once.
+// Only reports them unless fixing.
+//
+func DedupeLibrary(media_root string, fix bool) {
+	num_duplicates := 0
+	for _, info := range library.FindKindInfoFiles(media_root, library.COLLECTION_INFO) {
+		var collection structs.CollectionData
+
+		lock, err := common.LockFile(info.Path)
+		common.CheckErr(err)
+		library.ReadInfoFile(info.Path, &collection)
+		films, duplicates := library.DedupeFilms(collection.Films)
+		if duplicates > 0 {
+			log.Printf(
+				"%s: %d films listed more than once.\n",
+				info.SubDir,
+				duplicates,
+			)
+			num_duplicates += duplicates
+			if fix {
+				collection.Films = films
+				common.BackupFile(info.Path)
+				log.Printf("Rewriting '%s'.\n", info.Path)
+				library.WriteInfoFile(info.Path, collection)
+			}
+		}
+		err = lock.Unlock()
+		common.CheckErr(err)
+	}
+	if fix {
+		log.Printf("Merged %d duplicate films.\n", num_duplicates)
+	} else if num_duplicates > 0 {
+		log.Printf(
+			"Found %d duplicate films. Run '%s dedupe %s' to merge them.\n",
+			num_duplicates,
+			os.Args[0],
+			media_root,
+		)
+	}
+}
+
+//
+// Upgrades an info file to the current schema version,
+// returning whether it needed it
+//
+func MigrateInfoFile(info library.InfoFile) bool {
+	lock, err := common.LockFile(info.Path)
+	common.CheckErr(err)
+	defer lock.Unlock()
+
+	blob, err := ioutil.ReadFile(info.Path)
+	common.CheckErr(err)
+	version, err := library.SchemaVersion(blob)
+	if err != nil {
+		log.Fatalf("Couldn't read '%s': %v.", info.Path, err)
+	}
+	if version >= structs.SCHEMA_VERSION {
+		return false
+	}
+	for _, migration := range library.MIGRATIONS[version:] {
+		log.Printf(
+			"%s: %d -> %d, %s.\n",
+			info.SubDir,
+			migration.From,
+			migration.From+1,
+			migration.Description,
+		)
+	}
+
+	// through the raw json, so keys this librarian doesn't know are kept
+	migrated, _, err := library.MigrateBlob(blob)
+	if err != nil {
+		log.Fatalf("Couldn't upgrade '%s': %v.", info.Path, err)
+	}
+	common.BackupFile(info.Path)
+	common.SaveBlob(migrated, info.Path)
+	return true
+}
+
+//
+// Upgrades every info file in a media root to the current schema version
+//
+func MigrateLibrary(media_root string) {
+	num_migrated := 0
+	for _, info := range library.FindInfoFiles(media_root) {
+		if MigrateInfoFile(info) {
+			num_migrated++
+		}
+	}
+	log.Printf(
+		"Upgraded %d info files to schema version %d.\n",
+		num_migrated,
+		structs.SCHEMA_VERSION,
+	)
+}
+
+//
+// Refreshes the metadata of every info file in a media root
+//
+func RefreshLibrary(args []string) {
+	flags := flag.NewFlagSet("refresh", flag.ExitOnError)
+	api_url := flags.String("api-url", "", "TMDB API base URL")
+	image_url := flags.String("image-url", "", "TMDB image base URL")
+	images := flags.Bool("images", false, "download the pictures again")
+	yes := flags.Bool("yes", false, "save changes without asking")
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		println("Please provide the media root and an API key.")
+		return
+	}
+	media_root := flags.Arg(0)
+
+	client := tmdb.NewClient(flags.Arg(1))
+	if *api_url != "" {
+		client.APIURL = strings.TrimSuffix(*api_url, "/")
+	}
+	if *image_url != "" {
+		client.ImageURL = strings.TrimSuffix(*image_url, "/")
+	}
+	refresher := NewRefresher(client, media_root, *images, *yes)
+	for _, info := range library.FindInfoFiles(media_root) {
+		refresher.RefreshInfoFile(info)
+	}
+}
+
+//---------------------------------------------------------------------------
+// Main
+//---------------------------------------------------------------------------
+//
+func main() {
+	if len(os.Args) < 3 {
+		println(
+			"Please provide a command",
+			"(check, repair, dedupe, duplicates, migrate, probe, refresh, relayout or undo)",
+			"and its arguments.",
+		)
+		return
+	}
+	command := os.Args[1]
+
+	switch command {
+	case "check":
+		CheckLibrary(os.Args[2], false)
+	case "repair":
+		CheckLibrary(os.Args[2], true)
+	case "dedupe":
+		DedupeLibrary(os.Args[2], true)
+	case "duplicates":
+		ReportDuplicates(os.Args[2])
+	case "migrate":
+		MigrateLibrary(os.Args[2])
+	case "probe":
+		ProbeLibrary(os.Args[2:])
+	case "refresh":
+		RefreshLibrary(os.Args[2:])
+	case "relayout":
+		RelayoutLibrary(os.Args[2:])
+	case "undo":
+		UndoIngestions(os.Args[2:])
+	default:
+		log.Fatalf("Unknown command '%s'.", command)
+	}
+}
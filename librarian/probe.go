@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"path"
+	"serviam/common"
+	"serviam/library"
+	"serviam/probe"
+	"serviam/structs"
+)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// Settings of a probe run
+//
+type Prober struct {
+	media_root string
+	all        bool
+	num_probed int
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Checks whether a file has been hashed, probed and labelled already,
+// or needs none of it, being a picture or sidecar
+//
+func IsProbed(file structs.FileData) bool {
+	if !library.IsVideo(file) {
+		return true
+	}
+	if file.Hash == "" {
+		return false
+	}
+	return !probe.CanProbe(file.Name) || file.Media != nil && file.Label != ""
+}
+
+//
+// Probes and hashes the videos of a list of files which haven't been
+// yet, or all of them if asked, labelling them with the resolution found
+//
+func (prober *Prober) ProbeFiles(files []structs.FileData) []structs.FileData {
+	probed := make([]structs.FileData, len(files))
+	for idx, file := range files {
+		probed[idx] = file
+		if IsProbed(file) && !prober.all {
+			continue
+		}
+		probed[idx] = library.ProbeFile(file, path.Join(prober.media_root, file.Path))
+		if library.IsVideo(probed[idx]) {
+			probed[idx] = library.LabelVersion(probed[idx], "")
+		}
+		if probed[idx].Media != nil || probed[idx].Hash != file.Hash {
+			prober.num_probed++
+		}
+	}
+	return probed
+}
+
+//
+// Probes the videos of a film
+//
+func (prober *Prober) ProbeFilm(film structs.FilmData) structs.FilmData {
+	film.FilmFiles = prober.ProbeFiles(film.FilmFiles)
+	return film
+}
+
+//
+// Probes the videos of the items of an info file,
+// saving it if anything probing found has changed
+//
+func (prober *Prober) ProbeInfoFile(info library.InfoFile) {
+	var old interface{}
+	var probed interface{}
+
+	lock, err := common.LockFile(info.Path)
+	common.CheckErr(err)
+	defer lock.Unlock()
+
+	num_probed := prober.num_probed
+	switch info.Kind {
+	case library.FILM_INFO:
+		var film structs.FilmData
+		library.ReadInfoFile(info.Path, &film)
+		old = film
+		probed = prober.ProbeFilm(film)
+	case library.COLLECTION_INFO:
+		var collection structs.CollectionData
+		library.ReadInfoFile(info.Path, &collection)
+		old = collection
+		films := make([]structs.FilmData, len(collection.Films))
+		for idx, film := range collection.Films {
+			films[idx] = prober.ProbeFilm(film)
+		}
+		collection.Films = films
+		probed = collection
+	case library.SHOW_INFO:
+		var show structs.ShowData
+		library.ReadInfoFile(info.Path, &show)
+		old = show
+		seasons := make([]structs.SeasonData, len(show.Seasons))
+		for season_idx, season := range show.Seasons {
+			episodes := make([]structs.EpisodeData, len(season.Episodes))
+			for episode_idx, episode := range season.Episodes {
+				episode.Files = prober.ProbeFiles(episode.Files)
+				episodes[episode_idx] = episode
+			}
+			season.Episodes = episodes
+			seasons[season_idx] = season
+		}
+		show.Seasons = seasons
+		probed = show
+	}
+	if prober.num_probed == num_probed {
+		return
+	}
+	log.Printf("%s: probed %d videos.\n", info.SubDir, prober.num_probed-num_probed)
+	if len(Diff(old, probed)) == 0 {
+		return
+	}
+	common.BackupFile(info.Path)
+	log.Printf("Rewriting '%s'.\n", info.Path)
+	library.WriteInfoFile(info.Path, probed)
+}
+
+//
+// Probes the videos of every info file in a media root
+// which haven't been probed yet, recording what is in them
+//
+func ProbeLibrary(args []string) {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	all := flags.Bool("all", false, "probe videos which have been probed before again")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		println("Please provide the media root.")
+		return
+	}
+	prober := &Prober{media_root: flags.Arg(0), all: *all}
+	for _, info := range library.FindInfoFiles(prober.media_root) {
+		prober.ProbeInfoFile(info)
+	}
+	log.Printf("Probed %d videos.\n", prober.num_probed)
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"serviam/common"
+	"serviam/library"
+	"serviam/structs"
+	"serviam/tmdb"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Added to a picture's location for the download which will replace it
+//
+const REFRESH_SUFFIX = ".refresh"
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// Settings of a refresh run
+//
+type Refresher struct {
+	client     *tmdb.Client
+	media_root string
+	images     bool
+	yes        bool
+	pictures   []RefreshedPicture
+}
+
+//
+// A picture downloaded beside the one it will replace,
+// which is only put in its place once the refresh is saved
+//
+type RefreshedPicture struct {
+	Path     string
+	Location string
+	Download string
+}
+
+//---------------------------------------------------------------------------
+// Helper Functions
+//---------------------------------------------------------------------------
+//
+// Yes or No user input
+//
+func YesOrNo(question string) bool {
+	var y_or_n string
+	var err error
+	var stdin_reader *bufio.Reader
+
+	stdin_reader = bufio.NewReader(os.Stdin)
+	fmt.Println(question)
+	for {
+		y_or_n, err = stdin_reader.ReadString('\n')
+		common.CheckErr(err)
+		y_or_n = strings.Trim(y_or_n, "\n")
+		switch y_or_n {
+		case "n":
+			return false
+		case "y":
+			return true
+		default:
+			fmt.Println("Please enter 'y' or 'n'.")
+		}
+	}
+}
+
+//
+// Checks whether a field, named by its json key, is in a locked list
+//
+func IsLocked(locked []string, field string) bool {
+	for _, locked_field := range locked {
+		if locked_field == field {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Copies the locked fields of old into fresh.
+// Both must be pointers to the same type of structure
+// and fields are named by their json keys.
+//
+func RestoreLocked(fresh interface{}, old interface{}, locked []string) {
+	fresh_value := reflect.ValueOf(fresh).Elem()
+	old_value := reflect.ValueOf(old).Elem()
+	fields := fresh_value.Type()
+
+	for idx := 0; idx < fields.NumField(); idx++ {
+		key := strings.Split(fields.Field(idx).Tag.Get("json"), ",")[0]
+		if IsLocked(locked, key) {
+			fresh_value.Field(idx).Set(old_value.Field(idx))
+		}
+	}
+}
+
+//
+// Appends a line for every difference between two decoded json values
+//
+func DiffValues(prefix string, old interface{}, fresh interface{}, diff *[]string) {
+	old_map, old_is_map := old.(map[string]interface{})
+	fresh_map, fresh_is_map := fresh.(map[string]interface{})
+	old_list, old_is_list := old.([]interface{})
+	fresh_list, fresh_is_list := fresh.([]interface{})
+
+	if old_is_map && fresh_is_map {
+		var keys []string
+		for key := range old_map {
+			keys = append(keys, key)
+		}
+		for key := range fresh_map {
+			if _, ok := old_map[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			DiffValues(
+				strings.TrimPrefix(prefix+"."+key, "."),
+				old_map[key],
+				fresh_map[key],
+				diff,
+			)
+		}
+	} else if old_is_list && fresh_is_list && len(old_list) == len(fresh_list) {
+		for idx := range old_list {
+			DiffValues(
+				prefix+"["+strconv.Itoa(idx)+"]",
+				old_list[idx],
+				fresh_list[idx],
+				diff,
+			)
+		}
+	} else if !reflect.DeepEqual(old, fresh) {
+		old_blob, _ := json.Marshal(old)
+		fresh_blob, _ := json.Marshal(fresh)
+		*diff = append(
+			*diff,
+			fmt.Sprintf("%s: %s -> %s", prefix, old_blob, fresh_blob),
+		)
+	}
+}
+
+//
+// Lists the differences between two structures
+//
+func Diff(old interface{}, fresh interface{}) []string {
+	var diff []string
+	var old_value, fresh_value interface{}
+
+	blob, err := json.Marshal(old)
+	common.CheckErr(err)
+	common.CheckErr(json.Unmarshal(blob, &old_value))
+	blob, err = json.Marshal(fresh)
+	common.CheckErr(err)
+	common.CheckErr(json.Unmarshal(blob, &fresh_value))
+
+	DiffValues("", old_value, fresh_value, &diff)
+	return diff
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Downloads a picture to replace an existing one, keeping its path.
+// If there isn't one yet, a picture named picture_id is made in sub_dir.
+// The download is kept beside it until the refresh is saved or dropped.
+//
+func (refresher *Refresher) RefreshPicture(
+	picture structs.FileData,
+	tmdb_img string,
+	sub_dir string,
+	picture_id string,
+) structs.FileData {
+	if !refresher.images || tmdb_img == "" {
+		return picture
+	}
+	if picture.Path == "" {
+		picture = structs.NewFileData(picture_id+filepath.Ext(tmdb_img), sub_dir)
+	}
+	location := path.Join(refresher.media_root, picture.Path)
+	download := location + REFRESH_SUFFIX
+	size, err := refresher.client.DownloadImage(
+		context.Background(),
+		tmdb_img,
+		download,
+	)
+	if err != nil {
+		log.Printf("Couldn't refresh '%s': %v\n", picture.Path, err)
+		return picture
+	}
+	log.Printf("Downloaded '%s' of size %d.\n", download, size)
+
+	// an unchanged picture doesn't need replacing
+	old_blob, old_err := ioutil.ReadFile(location)
+	new_blob, new_err := ioutil.ReadFile(download)
+	if old_err == nil && new_err == nil && bytes.Equal(old_blob, new_blob) {
+		os.Remove(download)
+		return picture
+	}
+	refresher.pictures = append(refresher.pictures, RefreshedPicture{
+		Path:     picture.Path,
+		Location: location,
+		Download: download,
+	})
+	return picture
+}
+
+//
+// Puts the downloaded pictures in place of the ones they replace
+//
+func (refresher *Refresher) PlacePictures() {
+	for _, picture := range refresher.pictures {
+		log.Printf("Replacing '%s'.\n", picture.Location)
+		err := os.Rename(picture.Download, picture.Location)
+		if err != nil {
+			log.Printf("Couldn't replace '%s': %v\n", picture.Location, err)
+			os.Remove(picture.Download)
+		}
+	}
+	refresher.pictures = nil
+}
+
+//
+// Removes the downloaded pictures, keeping the ones they would have replaced
+//
+func (refresher *Refresher) DropPictures() {
+	for _, picture := range refresher.pictures {
+		os.Remove(picture.Download)
+	}
+	refresher.pictures = nil
+}
+
+//
+// Refreshes a film's metadata
+//
+func (refresher *Refresher) RefreshFilm(
+	film structs.FilmData,
+	sub_dir string,
+) (
+	structs.FilmData,
+	error,
+) {
+	if film.TMDBId == 0 {
+		return film, nil
+	}
+	tmdb_movie, err := refresher.client.Movie(context.Background(), film.TMDBId)
+	if err != nil {
+		return film, err
+	}
+
+	poster_file := film.PosterFile
+	backdrop_file := film.BackdropFile
+	if !IsLocked(film.Locked, "poster_file") {
+		poster_file = refresher.RefreshPicture(
+			poster_file,
+			tmdb_movie.PosterPath,
+			sub_dir,
+			film.Id+library.POSTER_SUFFIX,
+		)
+	}
+	if !IsLocked(film.Locked, "backdrop_file") {
+		backdrop_file = refresher.RefreshPicture(
+			backdrop_file,
+			tmdb_movie.BackdropPath,
+			sub_dir,
+			film.Id+library.BACKDROP_SUFFIX,
+		)
+	}
+	fresh := structs.TMDBMovieToFilmData(
+		&tmdb_movie,
+		&film.Id,
+		&poster_file,
+		&backdrop_file,
+		&film.FilmFiles,
+	)
+	fresh.Locked = film.Locked
+	RestoreLocked(&fresh, &film, film.Locked)
+	return fresh, nil
+}
+
+//
+// Refreshes a collection's metadata and that of its films
+//
+func (refresher *Refresher) RefreshCollection(
+	collection structs.CollectionData,
+	sub_dir string,
+	collection_id string,
+) (
+	structs.CollectionData,
+	error,
+) {
+	films := make([]structs.FilmData, len(collection.Films))
+	for idx, film := range collection.Films {
+		fresh_film, err := refresher.RefreshFilm(film, sub_dir)
+		if err != nil {
+			return collection, err
+		}
+		films[idx] = fresh_film
+	}
+
+	if collection.TMDBId == 0 {
+		collection.Films = films
+		return collection, nil
+	}
+	tmdb_collection, err := refresher.client.Collection(
+		context.Background(),
+		collection.TMDBId,
+	)
+	if err != nil {
+		return collection, err
+	}
+
+	poster_file := collection.PosterFile
+	backdrop_file := collection.BackdropFile
+	if !IsLocked(collection.Locked, "poster_file") {
+		poster_file = refresher.RefreshPicture(
+			poster_file,
+			tmdb_collection.PosterPath,
+			sub_dir,
+			collection_id+library.POSTER_SUFFIX,
+		)
+	}
+	if !IsLocked(collection.Locked, "backdrop_file") {
+		backdrop_file = refresher.RefreshPicture(
+			backdrop_file,
+			tmdb_collection.BackdropPath,
+			sub_dir,
+			collection_id+library.BACKDROP_SUFFIX,
+		)
+	}
+	fresh := structs.TMDBCollectionToCollectionData(
+		&tmdb_collection,
+		&poster_file,
+		&backdrop_file,
+		&films,
+	)
+	fresh.Locked = collection.Locked
+	RestoreLocked(&fresh, &collection, collection.Locked)
+	return fresh, nil
+}
+
+//
+// Refreshes a season's metadata and that of its episodes.
+// Only the episodes already in the season are refreshed.
+//
+func (refresher *Refresher) RefreshSeason(
+	season structs.SeasonData,
+	show_tmdb_id int,
+	sub_dir string,
+) (
+	structs.SeasonData,
+	error,
+) {
+	tmdb_season, err := refresher.client.Season(
+		context.Background(),
+		show_tmdb_id,
+		season.SeasonNumber,
+	)
+	if err != nil {
+		return season, err
+	}
+	season_dir := path.Join(sub_dir, season.Id)
+
+	episodes := make([]structs.EpisodeData, len(season.Episodes))
+	for idx, episode := range season.Episodes {
+		episodes[idx] = episode
+		for _, tmdb_episode := range tmdb_season.Episodes {
+			if (episode.TMDBId != 0 && tmdb_episode.Id == episode.TMDBId) ||
+				(episode.TMDBId == 0 &&
+					tmdb_episode.EpisodeNumber == episode.EpisodeNumber) {
+				still_file := episode.StillFile
+				if !IsLocked(episode.Locked, "still_file") {
+					still_file = refresher.RefreshPicture(
+						still_file,
+						tmdb_episode.StillPath,
+						season_dir,
+						episode.Id+library.STILL_SUFFIX,
+					)
+				}
+				fresh_episode := structs.TMDBEpisodeToEpisodeData(
+					&tmdb_episode,
+					&episode.Id,
+					&still_file,
+					&episode.Files,
+				)
+				fresh_episode.Locked = episode.Locked
+				RestoreLocked(&fresh_episode, &episode, episode.Locked)
+				episodes[idx] = fresh_episode
+				break
+			}
+		}
+	}
+
+	poster_file := season.PosterFile
+	if !IsLocked(season.Locked, "poster_file") {
+		poster_file = refresher.RefreshPicture(
+			poster_file,
+			tmdb_season.PosterPath,
+			season_dir,
+			season.Id+library.POSTER_SUFFIX,
+		)
+	}
+	fresh := structs.TMDBSeasonToSeasonData(
+		&tmdb_season,
+		&season.Id,
+		&poster_file,
+		&episodes,
+	)
+	fresh.Locked = season.Locked
+	RestoreLocked(&fresh, &season, season.Locked)
+	return fresh, nil
+}
+
+//
+// Refreshes a show's metadata and that of its seasons.
+// Only the seasons already in the show are refreshed.
+//
+func (refresher *Refresher) RefreshShow(
+	show structs.ShowData,
+	sub_dir string,
+) (
+	structs.ShowData,
+	error,
+) {
+	if show.TMDBId == 0 {
+		return show, nil
+	}
+	tmdb_show, err := refresher.client.TV(context.Background(), show.TMDBId)
+	if err != nil {
+		return show, err
+	}
+
+	seasons := make([]structs.SeasonData, len(show.Seasons))
+	for idx, season := range show.Seasons {
+		fresh_season, err := refresher.RefreshSeason(season, show.TMDBId, sub_dir)
+		if err != nil {
+			return show, err
+		}
+		seasons[idx] = fresh_season
+	}
+
+	poster_file := show.PosterFile
+	backdrop_file := show.BackdropFile
+	if !IsLocked(show.Locked, "poster_file") {
+		poster_file = refresher.RefreshPicture(
+			poster_file,
+			tmdb_show.PosterPath,
+			sub_dir,
+			show.Id+library.POSTER_SUFFIX,
+		)
+	}
+	if !IsLocked(show.Locked, "backdrop_file") {
+		backdrop_file = refresher.RefreshPicture(
+			backdrop_file,
+			tmdb_show.BackdropPath,
+			sub_dir,
+			show.Id+library.BACKDROP_SUFFIX,
+		)
+	}
+	fresh := structs.TMDBTVToShowData(
+		&tmdb_show,
+		&show.Id,
+		&poster_file,
+		&backdrop_file,
+		&seasons,
+	)
+	fresh.Locked = show.Locked
+	RestoreLocked(&fresh, &show, show.Locked)
+	return fresh, nil
+}
+
+//
+// Refreshes the items of an info file, showing what changed
+//
+func (refresher *Refresher) RefreshInfoFile(info library.InfoFile) {
+	var old interface{}
+	var fresh interface{}
+	var err error
+
+	// held while asking too, so an ingestion waits rather than being lost
+	lock, err := common.LockFile(info.Path)
+	common.CheckErr(err)
+	defer lock.Unlock()
+
+	log.Printf("Refreshing '%s'.\n", info.SubDir)
+	switch info.Kind {
+	case library.FILM_INFO:
+		var film structs.FilmData
+		library.ReadInfoFile(info.Path, &film)
+		old = film
+		fresh, err = refresher.RefreshFilm(film, info.SubDir)
+	case library.COLLECTION_INFO:
+		var collection structs.CollectionData
+		library.ReadInfoFile(info.Path, &collection)
+		old = collection
+		fresh, err = refresher.RefreshCollection(collection, info.SubDir, info.Id)
+	case library.SHOW_INFO:
+		var show structs.ShowData
+		library.ReadInfoFile(info.Path, &show)
+		old = show
+		fresh, err = refresher.RefreshShow(show, info.SubDir)
+	}
+	defer refresher.DropPictures()
+	if err != nil {
+		log.Printf("Skipping '%s': %v\n", info.SubDir, err)
+		return
+	}
+
+	diff := Diff(old, fresh)
+	for _, picture := range refresher.pictures {
+		diff = append(diff, fmt.Sprintf("%s: new picture", picture.Path))
+	}
+	if len(diff) == 0 {
+		log.Printf("'%s' is up to date.\n", info.SubDir)
+		return
+	}
+	for _, line := range diff {
+		fmt.Printf("%s%s\n", common.INDENT, line)
+	}
+	if refresher.yes || YesOrNo("Save these changes? (y/n)") {
+		common.BackupFile(info.Path)
+		log.Printf("Saving '%s'.\n", info.Path)
+		library.WriteInfoFile(info.Path, fresh)
+		refresher.PlacePictures()
+	}
+}
+
+//
+// Makes a refresher for a media root
+//
+func NewRefresher(
+	client *tmdb.Client,
+	media_root string,
+	images bool,
+	yes bool,
+) *Refresher {
+	return &Refresher{
+		client:     client,
+		media_root: media_root,
+		images:     images,
+		yes:        yes,
+	}
+}
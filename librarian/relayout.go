@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"serviam/common"
+	"serviam/library"
+	"serviam/structs"
+	"strings"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// name recorded in journals
+//
+const RELAYOUT_COMMAND = "relayout"
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// Plans the moves which lay a library out with new naming templates,
+// making sure no two files end up with the same name
+// and nothing is moved over a file which is staying.
+// Items which would be named the same are told apart as ingestion does,
+// so claimed holds the directories and ids given out so far
+// and vacated the directories items have been moved out of.
+//
+type Relayout struct {
+	plan         *common.Plan
+	media_root   string
+	naming       library.Naming
+	destinations map[string]string
+	sources      map[string]bool
+	claimed      map[string]bool
+	vacated      map[string]bool
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Starts planning a relayout
+//
+func NewRelayout(media_root string, naming library.Naming) *Relayout {
+	return &Relayout{
+		plan:         common.NewPlan(),
+		media_root:   media_root,
+		naming:       naming,
+		destinations: make(map[string]string),
+		sources:      make(map[string]bool),
+		claimed:      make(map[string]bool),
+		vacated:      make(map[string]bool),
+	}
+}
+
+//
+// Gives an item a directory in parent_sub_dir no other item has,
+// adding its TMDB id to the one it was named if it is taken.
+// Directories of items yet to be laid out are taken,
+// as they may be staying where they are.
+//
+func (relayout *Relayout) UniqueDir(
+	parent_sub_dir string,
+	dir string,
+	tmdb_id int,
+	old_sub_dir string,
+) string {
+	unique := library.UniqueId(dir, tmdb_id, func(dir string) bool {
+		sub_dir := path.Join(parent_sub_dir, dir)
+		if relayout.claimed[sub_dir] {
+			return true
+		}
+		if sub_dir == old_sub_dir || relayout.vacated[sub_dir] {
+			return false
+		}
+		_, err := os.Lstat(path.Join(relayout.media_root, sub_dir))
+		return err == nil
+	})
+	relayout.claimed[path.Join(parent_sub_dir, unique)] = true
+	if path.Join(parent_sub_dir, unique) != old_sub_dir {
+		relayout.vacated[old_sub_dir] = true
+	}
+	return unique
+}
+
+//
+// Gives an item an id in sub_dir no other item laid out there has,
+// such as an episode in its season
+//
+func (relayout *Relayout) UniqueId(sub_dir string, id string, tmdb_id int) string {
+	unique := library.UniqueId(id, tmdb_id, func(id string) bool {
+		return relayout.claimed[path.Join(sub_dir, id)]
+	})
+	relayout.claimed[path.Join(sub_dir, unique)] = true
+	return unique
+}
+
+//
+// Plans to move a file, relative to the media root
+//
+func (relayout *Relayout) Move(source string, destination string) {
+	if source == destination {
+		return
+	}
+	abs_source := common.Absolute(path.Join(relayout.media_root, source))
+	abs_destination := common.Absolute(path.Join(relayout.media_root, destination))
+
+	if other, taken := relayout.destinations[abs_destination]; taken {
+		log.Fatalf(
+			"'%s' and '%s' would both be moved to '%s'.",
+			other,
+			source,
+			destination,
+		)
+	}
+	if _, err := os.Lstat(abs_destination); err == nil && !relayout.sources[abs_destination] {
+		log.Fatalf("Can't move '%s' to '%s' as it already exists.", source, destination)
+	}
+	relayout.destinations[abs_destination] = source
+	relayout.sources[abs_source] = true
+	relayout.plan.MoveFile(abs_source, abs_destination)
+}
+
+//
+// Plans to move an item's file to the item's new directory,
+// renaming it from the item's old id to its new one
+//
+func (relayout *Relayout) MoveFile(
+	file structs.FileData,
+	old_id string,
+	new_id string,
+	new_sub_dir string,
+) structs.FileData {
+	if file.Path == "" {
+		return file
+	}
+	moved := file
+	if strings.HasPrefix(file.Name, old_id) {
+		moved.Name = new_id + strings.TrimPrefix(file.Name, old_id)
+	}
+	moved.Path = path.Join(new_sub_dir, moved.Name)
+	relayout.Move(file.Path, moved.Path)
+	return moved
+}
+
+//
+// Plans to move an item's files to its new directory
+//
+func (relayout *Relayout) MoveFiles(
+	files []structs.FileData,
+	old_id string,
+	new_id string,
+	new_sub_dir string,
+) []structs.FileData {
+	var moved []structs.FileData
+	for _, file := range files {
+		moved = append(moved, relayout.MoveFile(file, old_id, new_id, new_sub_dir))
+	}
+	return moved
+}
+
+//
+// Plans to make a directory, relative to the media root
+//
+func (relayout *Relayout) CheckDir(sub_dir string) {
+	relayout.plan.CheckDir(path.Join(relayout.media_root, sub_dir))
+}
+
+//
+// Plans to move what is left in a directory which has been renamed,
+// such as backups, and then to remove it
+//
+func (relayout *Relayout) LeaveDir(old_sub_dir string, new_sub_dir string) {
+	if old_sub_dir == new_sub_dir {
+		return
+	}
+	old_dir := path.Join(relayout.media_root, old_sub_dir)
+	for _, name := range library.ListFiles(old_dir) {
+		if !relayout.sources[common.Absolute(path.Join(old_dir, name))] {
+			relayout.Move(path.Join(old_sub_dir, name), path.Join(new_sub_dir, name))
+		}
+	}
+	relayout.plan.RemoveDir(old_dir)
+}
+
+//
+// Plans to move an info file to its item's new directory
+// and save the item's new paths in it
+//
+func (relayout *Relayout) SaveInfoFile(
+	info library.InfoFile,
+	new_sub_dir string,
+	new_name string,
+	data interface{},
+) {
+	blob, err := json.MarshalIndent(data, "", common.INDENT)
+	common.CheckErr(err)
+
+	new_path := path.Join(new_sub_dir, new_name+".json")
+	relayout.Move(path.Join(info.SubDir, info.Id+".json"), new_path)
+	location := path.Join(relayout.media_root, new_path)
+	current, err := relayout.plan.ReadFile(location)
+	common.CheckErr(err)
+	if !bytes.Equal(current, blob) {
+		relayout.plan.SaveBlob(blob, location)
+	}
+}
+
+//
+// Plans to lay out a film which isn't in a collection
+//
+func (relayout *Relayout) Film(info library.InfoFile) {
+	var film structs.FilmData
+	relayout.plan.Lock(info.Path)
+	library.ReadInfoFile(info.Path, &film)
+
+	new_dir, new_id := relayout.naming.FilmNames(
+		film.Title,
+		film.ReleaseDate,
+		film.TMDBId,
+	)
+	unique_dir := relayout.UniqueDir(library.FILMS_DIR, new_dir, film.TMDBId, info.SubDir)
+	new_id += strings.TrimPrefix(unique_dir, new_dir)
+	new_dir = unique_dir
+	new_sub_dir := path.Join(library.FILMS_DIR, new_dir)
+	relayout.CheckDir(new_sub_dir)
+	film = relayout.FilmFiles(film, new_id, new_sub_dir)
+	relayout.SaveInfoFile(info, new_sub_dir, new_dir, film)
+	relayout.LeaveDir(info.SubDir, new_sub_dir)
+}
+
+//
+// Plans to move a film's files and pictures and give it its new id
+//
+func (relayout *Relayout) FilmFiles(
+	film structs.FilmData,
+	new_id string,
+	new_sub_dir string,
+) structs.FilmData {
+	film.PosterFile = relayout.MoveFile(film.PosterFile, film.Id, new_id, new_sub_dir)
+	film.BackdropFile = relayout.MoveFile(
+		film.BackdropFile,
+		film.Id,
+		new_id,
+		new_sub_dir,
+	)
+	film.FilmFiles = relayout.MoveFiles(film.FilmFiles, film.Id, new_id, new_sub_dir)
+	film.Id = new_id
+	return film
+}
+
+//
+// Plans to lay out a collection and its films
+//
+func (relayout *Relayout) Collection(info library.InfoFile) {
+	var collection structs.CollectionData
+	relayout.plan.Lock(info.Path)
+	library.ReadInfoFile(info.Path, &collection)
+
+	new_dir := relayout.UniqueDir(
+		library.COLLECTIONS_DIR,
+		relayout.naming.CollectionName(collection.Name, collection.TMDBId),
+		collection.TMDBId,
+		info.SubDir,
+	)
+	new_sub_dir := path.Join(library.COLLECTIONS_DIR, new_dir)
+	relayout.CheckDir(new_sub_dir)
+	collection.PosterFile = relayout.MoveFile(
+		collection.PosterFile,
+		info.Id,
+		new_dir,
+		new_sub_dir,
+	)
+	collection.BackdropFile = relayout.MoveFile(
+		collection.BackdropFile,
+		info.Id,
+		new_dir,
+		new_sub_dir,
+	)
+	for idx, film := range collection.Films {
+		_, new_id := relayout.naming.FilmNames(
+			film.Title,
+			film.ReleaseDate,
+			film.TMDBId,
+		)
+		new_id = relayout.UniqueId(new_sub_dir, new_id, film.TMDBId)
+		collection.Films[idx] = relayout.FilmFiles(film, new_id, new_sub_dir)
+	}
+	relayout.SaveInfoFile(info, new_sub_dir, new_dir, collection)
+	relayout.LeaveDir(info.SubDir, new_sub_dir)
+}
+
+//
+// Plans to lay out a show, its seasons and its episodes
+//
+func (relayout *Relayout) Show(info library.InfoFile) {
+	var show structs.ShowData
+	relayout.plan.Lock(info.Path)
+	library.ReadInfoFile(info.Path, &show)
+
+	new_dir := relayout.UniqueDir(
+		library.SHOWS_DIR,
+		relayout.naming.ShowName(show.Name, show.FirstAirDate, show.TMDBId),
+		show.TMDBId,
+		info.SubDir,
+	)
+	new_sub_dir := path.Join(library.SHOWS_DIR, new_dir)
+	relayout.CheckDir(new_sub_dir)
+	show.PosterFile = relayout.MoveFile(show.PosterFile, show.Id, new_dir, new_sub_dir)
+	show.BackdropFile = relayout.MoveFile(
+		show.BackdropFile,
+		show.Id,
+		new_dir,
+		new_sub_dir,
+	)
+
+	var old_season_dirs []string
+	var new_season_dirs []string
+	for season_idx, season := range show.Seasons {
+		season_fields := library.EpisodeFields{
+			Show:         show.Name,
+			ShowTMDBId:   show.TMDBId,
+			Season:       season.SeasonNumber,
+			SeasonName:   season.Name,
+			SeasonDate:   season.AirDate,
+			SeasonTMDBId: season.TMDBId,
+		}
+		season_id, _ := relayout.naming.EpisodeNames(season_fields)
+		season_id = relayout.UniqueId(new_sub_dir, season_id, season.TMDBId)
+		season_sub_dir := path.Join(new_sub_dir, season_id)
+		relayout.CheckDir(season_sub_dir)
+		season.PosterFile = relayout.MoveFile(
+			season.PosterFile,
+			season.Id,
+			season_id,
+			season_sub_dir,
+		)
+
+		for episode_idx, episode := range season.Episodes {
+			episode_fields := season_fields
+			episode_fields.Episode = episode.EpisodeNumber
+			episode_fields.Name = episode.Name
+			episode_fields.Date = episode.AirDate
+			episode_fields.TMDBId = episode.TMDBId
+			_, episode_id := relayout.naming.EpisodeNames(episode_fields)
+			episode_id = relayout.UniqueId(season_sub_dir, episode_id, episode.TMDBId)
+
+			episode.StillFile = relayout.MoveFile(
+				episode.StillFile,
+				episode.Id,
+				episode_id,
+				season_sub_dir,
+			)
+			episode.Files = relayout.MoveFiles(
+				episode.Files,
+				episode.Id,
+				episode_id,
+				season_sub_dir,
+			)
+			episode.Id = episode_id
+			season.Episodes[episode_idx] = episode
+		}
+		old_season_dirs = append(old_season_dirs, path.Join(info.SubDir, season.Id))
+		new_season_dirs = append(new_season_dirs, season_sub_dir)
+		season.Id = season_id
+		show.Seasons[season_idx] = season
+	}
+	show.Id = new_dir
+
+	relayout.SaveInfoFile(info, new_sub_dir, new_dir, show)
+	for idx := range old_season_dirs {
+		relayout.LeaveDir(old_season_dirs[idx], new_season_dirs[idx])
+	}
+	relayout.LeaveDir(info.SubDir, new_sub_dir)
+}
+
+//
+// Moves a library to new naming templates, rewriting the paths in its info files.
+// The moves are journalled so 'librarian undo' can put them back.
+//
+func RelayoutLibrary(args []string) {
+	flags := flag.NewFlagSet(RELAYOUT_COMMAND, flag.ExitOnError)
+	dry_run := flags.Bool("dry-run", false, "print what would be done without doing it")
+	as_json := flags.Bool("json", false, "print the dry run plan as json")
+	yes := flags.Bool("yes", false, "relayout without asking")
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		println("Please provide the media root and a naming templates file.")
+		return
+	}
+	media_root := flags.Arg(0)
+	naming_file := flags.Arg(1)
+
+	blob, err := ioutil.ReadFile(naming_file)
+	common.CheckErr(err)
+	naming, err := library.ParseNaming(blob)
+	if err != nil {
+		log.Fatalf("Couldn't read '%s': %v.", naming_file, err)
+	}
+
+	relayout := NewRelayout(media_root, naming)
+	defer relayout.plan.Unlock()
+	for _, info := range library.FindInfoFiles(media_root) {
+		switch info.Kind {
+		case library.FILM_INFO:
+			relayout.Film(info)
+		case library.COLLECTION_INFO:
+			relayout.Collection(info)
+		case library.SHOW_INFO:
+			relayout.Show(info)
+		}
+	}
+	naming.Save(relayout.plan, media_root)
+
+	relayout.plan.Print(*as_json)
+	if *dry_run || !*yes && !YesOrNo("Move the library? (y/n)") {
+		return
+	}
+	journal := common.NewJournal(
+		media_root,
+		RELAYOUT_COMMAND,
+		common.Absolute(naming_file),
+		"",
+		relayout.plan,
+	)
+	err = journal.Run(nil)
+	common.CheckErr(err)
+}
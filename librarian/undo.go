@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"serviam/common"
+	"strconv"
+)
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Undoes the last ingestions recorded in the journal,
+// putting their files back where they came from
+//
+func UndoIngestions(args []string) {
+	flags := flag.NewFlagSet("undo", flag.ExitOnError)
+	yes := flags.Bool("yes", false, "undo without asking")
+	force := flags.Bool(
+		"force",
+		false,
+		"undo even if info files have changed since in a way which can't be merged",
+	)
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		println("Please provide the media root and how many ingestions to undo.")
+		return
+	}
+	media_root := flags.Arg(0)
+	count := 1
+	if flags.NArg() > 1 {
+		var err error
+		count, err = strconv.Atoi(flags.Arg(1))
+		if err != nil || count < 1 {
+			log.Fatalf("'%s' is not a number of ingestions.", flags.Arg(1))
+		}
+	}
+
+	// newest first
+	var journals []*common.Journal
+	all_journals := common.FindJournals(media_root)
+	for idx := len(all_journals) - 1; idx >= 0 && len(journals) < count; idx-- {
+		if !all_journals[idx].Undone {
+			journals = append(journals, all_journals[idx])
+		}
+	}
+	if len(journals) == 0 {
+		log.Println("There is nothing to undo.")
+		return
+	}
+
+	for _, journal := range journals {
+		state := "finished"
+		if !journal.Finished {
+			state = "unfinished"
+		}
+		fmt.Printf(
+			"%s  %-12s  %s (%s)\n",
+			journal.Started.Format("2006-01-02 15:04:05"),
+			journal.Command,
+			journal.Item,
+			state,
+		)
+	}
+	if !*yes && !YesOrNo("Undo these ingestions? (y/n)") {
+		return
+	}
+
+	for _, journal := range journals {
+		log.Printf("Undoing '%s'.\n", journal.Location)
+		err := journal.Undo(*force)
+		common.CheckErr(err)
+	}
+}
@@ -0,0 +1,102 @@
+package library
+
+import (
+	"serviam/structs"
+)
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Checks whether two films are the same film,
+// by TMDB id or, for films without one, by id
+//
+func SameFilm(a structs.FilmData, b structs.FilmData) bool {
+	if a.TMDBId != 0 || b.TMDBId != 0 {
+		return a.TMDBId == b.TMDBId
+	}
+	return a.Id == b.Id
+}
+
+//
+// Merges fresh film data into an existing entry for the same film.
+// The fresh metadata is used, but files and pictures are kept
+// when the fresh data doesn't have them, and locked fields stay locked.
+// Fresh files replace the existing ones of the same name, keeping their order.
+//
+func MergeFilmData(existing structs.FilmData, fresh structs.FilmData) structs.FilmData {
+	merged := fresh
+	merged.Locked = nil
+	locked := make(map[string]bool)
+	for _, fields := range [][]string{existing.Locked, fresh.Locked} {
+		for _, field := range fields {
+			if !locked[field] {
+				locked[field] = true
+				merged.Locked = append(merged.Locked, field)
+			}
+		}
+	}
+	if merged.PosterFile.Name == "" {
+		merged.PosterFile = existing.PosterFile
+	}
+	if merged.BackdropFile.Name == "" {
+		merged.BackdropFile = existing.BackdropFile
+	}
+
+	merged.FilmFiles = nil
+	fresh_files := make(map[string]structs.FileData)
+	for _, file := range fresh.FilmFiles {
+		fresh_files[file.Name] = file
+	}
+	seen := make(map[string]bool)
+	for _, files := range [][]structs.FileData{existing.FilmFiles, fresh.FilmFiles} {
+		for _, file := range files {
+			if fresh_file, ok := fresh_files[file.Name]; ok {
+				file = fresh_file
+			}
+			if !seen[file.Name] {
+				seen[file.Name] = true
+				merged.FilmFiles = append(merged.FilmFiles, file)
+			}
+		}
+	}
+	return merged
+}
+
+//
+// Puts a film in a list of films,
+// updating its entry if it is already there.
+// Returns the films and whether it was already there.
+//
+func PutFilm(
+	films []structs.FilmData,
+	film structs.FilmData,
+) (
+	[]structs.FilmData,
+	bool,
+) {
+	for idx, existing := range films {
+		if SameFilm(existing, film) {
+			films[idx] = MergeFilmData(existing, film)
+			return films, true
+		}
+	}
+	return append(films, film), false
+}
+
+//
+// Merges films which are in a list more than once,
+// returning the films and how many duplicates were merged
+//
+func DedupeFilms(films []structs.FilmData) ([]structs.FilmData, int) {
+	var deduped []structs.FilmData
+	duplicates := 0
+	for _, film := range films {
+		var found bool
+		deduped, found = PutFilm(deduped, film)
+		if found {
+			duplicates++
+		}
+	}
+	return deduped, duplicates
+}
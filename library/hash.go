@@ -0,0 +1,98 @@
+package library
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"serviam/structs"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Videos are hashed by their size and this many blocks spread through them,
+// from the first block to the last, so hashing doesn't read whole films
+//
+const (
+	HASH_BLOCKS     = 16
+	HASH_BLOCK_SIZE = 64 * 1024
+)
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Hashes a file's size and blocks sampled through it.
+// Files of up to HASH_BLOCKS blocks are hashed whole.
+//
+func HashFile(location string) (int64, string, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+	size := stat.Size()
+
+	hash := sha256.New()
+	binary.Write(hash, binary.BigEndian, size)
+	if size <= HASH_BLOCKS*HASH_BLOCK_SIZE {
+		_, err = io.Copy(hash, file)
+		return size, hex.EncodeToString(hash.Sum(nil)), err
+	}
+	block := make([]byte, HASH_BLOCK_SIZE)
+	last := size - HASH_BLOCK_SIZE
+	for idx := int64(0); idx < HASH_BLOCKS; idx++ {
+		_, err = file.ReadAt(block, last*idx/(HASH_BLOCKS-1))
+		if err != nil {
+			return 0, "", err
+		}
+		hash.Write(block)
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+//
+// Checks whether the file placed at location is the same video as file,
+// by the size and hash recorded for it in placed or else by hashing it.
+// Files which couldn't be hashed are never the same.
+//
+func SameVideo(file structs.FileData, placed structs.FileData, location string) bool {
+	if file.Hash == "" {
+		return false
+	}
+	size, hash := placed.Size, placed.Hash
+	if hash == "" {
+		var err error
+		size, hash, err = HashFile(location)
+		if err != nil {
+			return false
+		}
+	}
+	return size == file.Size && hash == file.Hash
+}
+
+//
+// Records the size and hash of a video at location in its FileData.
+// Files which aren't videos are left as they are.
+//
+func HashVideo(file structs.FileData, location string) structs.FileData {
+	if !IsVideoName(location) {
+		return file
+	}
+	size, hash, err := HashFile(location)
+	if err != nil {
+		log.Printf("Couldn't hash '%s': %v\n", location, err)
+		return file
+	}
+	file.Size = size
+	file.Hash = hash
+	return file
+}
@@ -0,0 +1,296 @@
+package library
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"serviam/common"
+	"serviam/structs"
+	"strings"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// media root directories
+//
+const (
+	FILMS_DIR       = "films"
+	COLLECTIONS_DIR = "collections"
+	SHOWS_DIR       = "shows"
+)
+
+//
+// info file kinds
+//
+const (
+	FILM_INFO       = 0
+	COLLECTION_INFO = 1
+	SHOW_INFO       = 2
+)
+
+//
+// picture name suffixes
+//
+const (
+	POSTER_SUFFIX   = "__P"
+	BACKDROP_SUFFIX = "__B"
+	STILL_SUFFIX    = "__S"
+)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// An info file found in the media root
+//
+type InfoFile struct {
+	Kind   int
+	Id     string
+	SubDir string
+	Path   string
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Finds the info files of one kind in a media root directory
+//
+func FindKindInfoFiles(media_root string, kind int) []InfoFile {
+	var output []InfoFile
+	var kind_dir string
+
+	switch kind {
+	case FILM_INFO:
+		kind_dir = FILMS_DIR
+	case COLLECTION_INFO:
+		kind_dir = COLLECTIONS_DIR
+	case SHOW_INFO:
+		kind_dir = SHOWS_DIR
+	}
+
+	dir := path.Join(media_root, kind_dir)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return output
+	}
+	dir_files, err := ioutil.ReadDir(dir)
+	common.CheckErr(err)
+
+	for _, dir_file := range dir_files {
+		if !dir_file.IsDir() {
+			continue
+		}
+		sub_dir := path.Join(kind_dir, dir_file.Name())
+		json_path := path.Join(media_root, sub_dir, dir_file.Name()+".json")
+		if _, err := os.Stat(json_path); err == nil {
+			output = append(output, InfoFile{
+				Kind:   kind,
+				Id:     dir_file.Name(),
+				SubDir: sub_dir,
+				Path:   json_path,
+			})
+		} else if os.IsNotExist(err) {
+			log.Printf("'%s' doesn't exist.\n", json_path)
+		} else {
+			common.CheckErr(err)
+		}
+	}
+	return output
+}
+
+//
+// Finds the info file of one kind with the given TMDB id
+//
+func FindTMDBId(media_root string, kind int, tmdb_id int) (InfoFile, bool) {
+	for _, info := range FindKindInfoFiles(media_root, kind) {
+		var item struct {
+			TMDBId int `json:"tmdb_id"`
+		}
+		ReadInfoFile(info.Path, &item)
+		if item.TMDBId == tmdb_id {
+			return info, true
+		}
+	}
+	return InfoFile{}, false
+}
+
+//
+// Makes an id for an item which no other item has.
+// taken says whether an id belongs to a different item,
+// if the id does the item's TMDB id is added to it, then a number.
+//
+func UniqueId(id string, tmdb_id int, taken func(id string) bool) string {
+	if !taken(id) {
+		return id
+	}
+	unique := fmt.Sprintf("%s__%d", id, tmdb_id)
+	for num := 2; taken(unique); num++ {
+		unique = fmt.Sprintf("%s__%d_%d", id, tmdb_id, num)
+	}
+	log.Printf("'%s' belongs to something else, using '%s'.\n", id, unique)
+	return unique
+}
+
+//
+// Finds all the info files in a media root directory
+//
+func FindInfoFiles(media_root string) []InfoFile {
+	var output []InfoFile
+	output = append(output, FindKindInfoFiles(media_root, FILM_INFO)...)
+	output = append(output, FindKindInfoFiles(media_root, COLLECTION_INFO)...)
+	output = append(output, FindKindInfoFiles(media_root, SHOW_INFO)...)
+	return output
+}
+
+//
+// Loads an info file into the structure given,
+// upgrading it to the current schema version on the way.
+// The schema version the file had on disk is returned.
+//
+func LoadInfoFile(location string, info interface{}) (int, error) {
+	blob, err := ioutil.ReadFile(location)
+	if err != nil {
+		return 0, err
+	}
+	blob, version, err := MigrateBlob(blob)
+	if err == nil {
+		err = json.Unmarshal(blob, info)
+	}
+	if err != nil {
+		return version, fmt.Errorf("couldn't read '%s': %v", location, err)
+	}
+	return version, nil
+}
+
+//
+// Reads an info file like LoadInfoFile, stopping if it can't be read
+//
+func ReadInfoFile(location string, info interface{}) int {
+	version, err := LoadInfoFile(location, info)
+	common.CheckErr(err)
+	return version
+}
+
+//
+// Reads an info file as it will be once a plan is done.
+// Returns false if there won't be one.
+//
+func ReadPlannedInfoFile(plan *common.Plan, location string, info interface{}) bool {
+	if blob, planned := plan.Planned(location); planned {
+		err := json.Unmarshal(blob, info)
+		common.CheckErr(err)
+		return true
+	}
+	if !plan.Exists(location) {
+		return false
+	}
+	ReadInfoFile(location, info)
+	return true
+}
+
+//
+// Writes the structure given to an info file
+//
+func WriteInfoFile(location string, info interface{}) {
+	blob, err := json.MarshalIndent(info, "", common.INDENT)
+	common.CheckErr(err)
+	common.SaveBlob(blob, location)
+}
+
+//
+// Lists the names of the regular files, and links to files, in a directory
+//
+func ListFiles(dir string) []string {
+	var output []string
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return output
+	}
+	dir_files, err := ioutil.ReadDir(dir)
+	common.CheckErr(err)
+
+	for _, dir_file := range dir_files {
+		if dir_file.Mode().IsRegular() || IsFileLink(dir, dir_file) {
+			output = append(output, dir_file.Name())
+		}
+	}
+	return output
+}
+
+//
+// Checks whether a directory entry is a symlink to a file,
+// or to nothing at all
+//
+func IsFileLink(dir string, dir_file os.FileInfo) bool {
+	if dir_file.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	info, err := os.Stat(path.Join(dir, dir_file.Name()))
+	return err != nil || !info.IsDir()
+}
+
+//
+// Checks whether a file name belongs to the item with the given id.
+// Files are named id+ext, with sidecars such as subtitles allowed
+// extra dot separated parts (id.en.srt).
+// Info files, their backups and half written files never belong to an item.
+//
+func BelongsToId(name string, id string) bool {
+	switch filepath.Ext(name) {
+	case ".json", ".bak", ".tmp", ".part":
+		return false
+	}
+	no_ext := strings.TrimSuffix(name, filepath.Ext(name))
+	return no_ext == id || strings.HasPrefix(name, id+".")
+}
+
+//
+// Gets the files in sub_dir which belong to the item with the given id,
+// reading the language and flags of sidecars from their names
+//
+func FilesForId(
+	dir_files []string,
+	sub_dir string,
+	id string,
+) []structs.FileData {
+	var output []structs.FileData
+	for _, name := range dir_files {
+		if BelongsToId(name, id) {
+			output = append(output, TagSidecar(structs.NewFileData(name, sub_dir), id))
+		}
+	}
+	return output
+}
+
+//
+// Finds a picture called picture_id in sub_dir, whatever its extension
+//
+func FindPicture(
+	dir_files []string,
+	sub_dir string,
+	picture_id string,
+) (
+	structs.FileData,
+	bool,
+) {
+	for _, name := range dir_files {
+		if strings.TrimSuffix(name, filepath.Ext(name)) == picture_id {
+			return structs.NewFileData(name, sub_dir), true
+		}
+	}
+	return structs.FileData{}, false
+}
+
+//
+// Checks whether the file referenced by a FileData exists
+//
+func FileExists(media_root string, file structs.FileData) bool {
+	_, err := os.Stat(path.Join(media_root, file.Path))
+	return err == nil
+}
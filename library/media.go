@@ -0,0 +1,50 @@
+package library
+
+import (
+	"log"
+	"serviam/probe"
+	"serviam/structs"
+	"strings"
+)
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Gets the code a language is recorded with, the same as for sidecars,
+// keeping codes which aren't known as they are
+//
+func LanguageCode(language string) string {
+	if code, ok := LANGUAGE_WORDS[strings.ToLower(language)]; ok {
+		return code
+	}
+	return language
+}
+
+//
+// Probes a video at location for what is in it and hashes it,
+// recording both in the video's FileData.
+// Videos which can't be probed are only hashed,
+// and files which aren't videos are left as they are.
+//
+func ProbeFile(file structs.FileData, location string) structs.FileData {
+	file = HashVideo(file, location)
+	if !probe.CanProbe(location) {
+		return file
+	}
+	media, err := probe.Probe(location)
+	if err != nil {
+		log.Printf("Couldn't probe '%s': %v\n", location, err)
+		return file
+	}
+	for idx := range media.AudioTracks {
+		media.AudioTracks[idx].Language = LanguageCode(media.AudioTracks[idx].Language)
+	}
+	for idx := range media.SubtitleTracks {
+		media.SubtitleTracks[idx].Language = LanguageCode(
+			media.SubtitleTracks[idx].Language,
+		)
+	}
+	file.Media = &media
+	return file
+}
@@ -0,0 +1,294 @@
+package library
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"serviam/common"
+	"strconv"
+	"strings"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// File in the media root holding the naming templates it is laid out with
+//
+const NAMING_FILE = "naming.json"
+
+//
+// Template fields, {name} or {name:02} to pad numbers with zeros
+//
+var TEMPLATE_FIELD = regexp.MustCompile(`\{(\w+)(?::(\d+))?\}`)
+
+//
+// Anything in a date which isn't a digit or a dash
+//
+var UNSAFE_DATE = regexp.MustCompile(`[^0-9\-]+`)
+
+//
+// The layout serviam has always used
+//
+var DEFAULT_NAMING = Naming{
+	Film:       "{title}__{date}/{title}__{date}",
+	Collection: "{name}",
+	Show:       "{name}__{date}",
+	Episode:    "{season:02}__{season_name}__{season_date}/{episode:02}__{name}__{date}",
+	Spaces:     "_",
+}
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// Templates for the names of directories and files in the media root.
+// Film templates are "directory/file", films in a collection only use the file.
+// Episode templates are "season directory/file".
+// Collections and shows are a directory, their info file is named after it.
+// Files are named file+ext, {ext} can be left out,
+// and pictures are named after their item with __P, __B and __S.
+// Spaces says what spaces in titles become.
+//
+type Naming struct {
+	Film       string `json:"film"`
+	Collection string `json:"collection"`
+	Show       string `json:"show"`
+	Episode    string `json:"episode"`
+	Spaces     string `json:"spaces"`
+}
+
+//
+// What an episode's names can be made from
+//
+type EpisodeFields struct {
+	Show         string
+	ShowTMDBId   int
+	Season       int
+	SeasonName   string
+	SeasonDate   string
+	SeasonTMDBId int
+	Episode      int
+	Name         string
+	Date         string
+	TMDBId       int
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Reads the naming templates of a media root,
+// using the default layout for any which aren't set
+//
+func ReadNaming(media_root string) Naming {
+	naming := DEFAULT_NAMING
+	blob, err := ioutil.ReadFile(path.Join(media_root, NAMING_FILE))
+	if os.IsNotExist(err) {
+		return naming
+	}
+	common.CheckErr(err)
+	naming, err = ParseNaming(blob)
+	if err != nil {
+		log.Fatalf("Couldn't read '%s': %v.", NAMING_FILE, err)
+	}
+	return naming
+}
+
+//
+// Reads and checks naming templates,
+// using the default layout for any which aren't set
+//
+func ParseNaming(blob []byte) (Naming, error) {
+	naming := DEFAULT_NAMING
+	err := json.Unmarshal(blob, &naming)
+	if err != nil {
+		return naming, err
+	}
+	return naming, naming.Check()
+}
+
+//
+// Checks every template only uses fields it has
+// and has the right number of parts
+//
+func (naming Naming) Check() error {
+	episode := EpisodeFields{Show: "Show", SeasonName: "Season", Name: "Name"}
+	checks := []struct {
+		name     string
+		template string
+		fields   map[string]interface{}
+		parts    []int
+	}{
+		{"film", naming.Film, naming.FilmFields("Title", "2000-01-01", 1), []int{1, 2}},
+		{"collection", naming.Collection, naming.NameFields("Name", "", 1), []int{1}},
+		{"show", naming.Show, naming.NameFields("Name", "2000-01-01", 1), []int{1}},
+		{"episode", naming.Episode, naming.EpisodeFields(episode), []int{2}},
+	}
+	for _, check := range checks {
+		parts, err := Render(check.template, check.fields)
+		if err != nil {
+			return fmt.Errorf("%s template: %v", check.name, err)
+		}
+		ok := false
+		for _, num_parts := range check.parts {
+			ok = ok || len(parts) == num_parts
+		}
+		if !ok {
+			return fmt.Errorf(
+				"%s template '%s' should have %v parts separated by '/'",
+				check.name,
+				check.template,
+				check.parts,
+			)
+		}
+	}
+	return nil
+}
+
+//
+// Fills a template's fields, giving the parts between its slashes.
+// Numbers are padded to the width given, {ext} is left out.
+//
+func Render(template string, fields map[string]interface{}) ([]string, error) {
+	var err error
+	template = strings.Replace(template, "{ext}", "", -1)
+	rendered := TEMPLATE_FIELD.ReplaceAllStringFunc(template, func(field string) string {
+		match := TEMPLATE_FIELD.FindStringSubmatch(field)
+		value, ok := fields[match[1]]
+		if !ok {
+			err = fmt.Errorf("unknown field '%s'", match[1])
+			return ""
+		}
+		if number, is_number := value.(int); is_number {
+			width, _ := strconv.Atoi(match[2])
+			return fmt.Sprintf("%0*d", width, number)
+		}
+		return fmt.Sprint(value)
+	})
+
+	parts := strings.Split(rendered, "/")
+	for _, part := range parts {
+		if strings.TrimSpace(part) == "" || part == "." || part == ".." {
+			return parts, fmt.Errorf("'%s' gives an empty name", template)
+		}
+	}
+	return parts, err
+}
+
+//
+// Makes a date safe to use in names, keeping only its digits and dashes,
+// as dates come from TMDB and info files which may have anything in them
+//
+func SlugDate(date string) string {
+	return UNSAFE_DATE.ReplaceAllString(date, "")
+}
+
+//
+// Gets the year of a date, or "" if there isn't one
+//
+func Year(date string) string {
+	if len(date) < 4 {
+		return ""
+	}
+	return date[:4]
+}
+
+//
+// Fields for names of things with a name and a date
+//
+func (naming Naming) NameFields(
+	name string,
+	date string,
+	tmdb_id int,
+) map[string]interface{} {
+	date = SlugDate(date)
+	return map[string]interface{}{
+		"name":    common.SlugWith(name, naming.Spaces, tmdb_id),
+		"date":    date,
+		"year":    Year(date),
+		"tmdb_id": tmdb_id,
+	}
+}
+
+//
+// Fields for films' names
+//
+func (naming Naming) FilmFields(
+	title string,
+	date string,
+	tmdb_id int,
+) map[string]interface{} {
+	fields := naming.NameFields(title, date, tmdb_id)
+	fields["title"] = fields["name"]
+	return fields
+}
+
+//
+// Fields for episodes' names
+//
+func (naming Naming) EpisodeFields(episode EpisodeFields) map[string]interface{} {
+	fields := naming.NameFields(episode.Name, episode.Date, episode.TMDBId)
+	fields["show"] = common.SlugWith(episode.Show, naming.Spaces, episode.ShowTMDBId)
+	fields["season"] = episode.Season
+	fields["season_name"] = common.SlugWith(
+		episode.SeasonName,
+		naming.Spaces,
+		episode.SeasonTMDBId,
+	)
+	fields["season_date"] = SlugDate(episode.SeasonDate)
+	fields["episode"] = episode.Episode
+	return fields
+}
+
+//
+// Renders a template which has already been checked
+//
+func MustRender(template string, fields map[string]interface{}) []string {
+	parts, err := Render(template, fields)
+	common.CheckErr(err)
+	return parts
+}
+
+//
+// Names a film's directory and files
+//
+func (naming Naming) FilmNames(title string, date string, tmdb_id int) (string, string) {
+	parts := MustRender(naming.Film, naming.FilmFields(title, date, tmdb_id))
+	return parts[0], parts[len(parts)-1]
+}
+
+//
+// Names a collection's directory
+//
+func (naming Naming) CollectionName(name string, tmdb_id int) string {
+	return MustRender(naming.Collection, naming.NameFields(name, "", tmdb_id))[0]
+}
+
+//
+// Names a show's directory
+//
+func (naming Naming) ShowName(name string, date string, tmdb_id int) string {
+	return MustRender(naming.Show, naming.NameFields(name, date, tmdb_id))[0]
+}
+
+//
+// Names an episode's season directory and files
+//
+func (naming Naming) EpisodeNames(episode EpisodeFields) (string, string) {
+	parts := MustRender(naming.Episode, naming.EpisodeFields(episode))
+	return parts[0], parts[1]
+}
+
+//
+// Saves naming templates in a plan
+//
+func (naming Naming) Save(plan *common.Plan, media_root string) {
+	blob, err := json.MarshalIndent(naming, "", common.INDENT)
+	common.CheckErr(err)
+	plan.SaveBlob(blob, path.Join(media_root, NAMING_FILE))
+}
@@ -0,0 +1,170 @@
+package library
+
+import (
+	"reflect"
+	"testing"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// fields the render tests fill templates with
+//
+var RENDER_FIELDS = map[string]interface{}{
+	"title":   "Dune",
+	"date":    "2021-09-15",
+	"year":    "2021",
+	"season":  1,
+	"episode": 12,
+	"tmdb_id": 438631,
+	"dots":    "..",
+	"blank":   " ",
+}
+
+//
+// templates and the parts they should render to,
+// or nil if rendering should fail
+//
+var RENDER_CASES = []struct {
+	template string
+	parts    []string
+}{
+	{"{title}__{date}/{title}__{date}", []string{"Dune__2021-09-15", "Dune__2021-09-15"}},
+	{"{title} ({year})/{title} ({year}){ext}", []string{"Dune (2021)", "Dune (2021)"}},
+	{"Season {season:02}/S{season:02}E{episode:02}", []string{"Season 01", "S01E12"}},
+	{"{episode:3}", []string{"012"}},
+	{"{tmdb_id}", []string{"438631"}},
+	{"{title}", []string{"Dune"}},
+	{"{name}", nil},
+	{"{title}//{title}", nil},
+	{"/{title}", nil},
+	{"{dots}/{title}", nil},
+	{"{blank}", nil},
+	{".", nil},
+}
+
+//
+// naming templates and whether they should be refused
+//
+var PARSE_NAMING_CASES = []struct {
+	blob  string
+	fails bool
+}{
+	{`{}`, false},
+	{`{"film": "{title} ({year})/{title} ({year})", "spaces": " "}`, false},
+	{`{"film": "{title}"}`, false},
+	{`{"film": "{title}/{title}/{title}"}`, true},
+	{`{"collection": "{name}/{name}"}`, true},
+	{`{"show": "{title}"}`, true},
+	{`{"episode": "{season}__{name}"}`, true},
+	{`{"episode": "{episode}/{season}"}`, false},
+	{`{"film": `, true},
+}
+
+//
+// film titles and dates and the names they should be given
+// with the default templates and with spaces kept
+//
+var FILM_NAMES_CASES = []struct {
+	title  string
+	date   string
+	dir    string
+	file   string
+	spaced string
+}{
+	{"Dune", "2021-09-15", "Dune__2021-09-15", "Dune__2021-09-15", "Dune (2021)"},
+	{"Dune: Part Two", "2024-02-27", "Dune_Part_Two__2024-02-27", "Dune_Part_Two__2024-02-27", "Dune Part Two (2024)"},
+	{"Amélie", "2001/04/25", "Amelie__20010425", "Amelie__20010425", "Amelie (2001)"},
+	{"千と千尋の神隠し", "2001-07-20", "tmdb129__2001-07-20", "tmdb129__2001-07-20", "tmdb129 (2001)"},
+	{"Unreleased", "", "Unreleased__", "Unreleased__", "Unreleased ()"},
+	{"Sneaky", "../../etc", "Sneaky__", "Sneaky__", "Sneaky ()"},
+}
+
+//---------------------------------------------------------------------------
+// Tests
+//---------------------------------------------------------------------------
+//
+func TestRender(t *testing.T) {
+	for _, render_case := range RENDER_CASES {
+		parts, err := Render(render_case.template, RENDER_FIELDS)
+		if render_case.parts == nil {
+			if err == nil {
+				t.Errorf("Render(%q) = %q, want an error", render_case.template, parts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Render(%q): %v", render_case.template, err)
+			continue
+		}
+		if !reflect.DeepEqual(parts, render_case.parts) {
+			t.Errorf("Render(%q) = %q, want %q", render_case.template, parts, render_case.parts)
+		}
+	}
+}
+
+func TestParseNaming(t *testing.T) {
+	for _, parse_case := range PARSE_NAMING_CASES {
+		_, err := ParseNaming([]byte(parse_case.blob))
+		if parse_case.fails && err == nil {
+			t.Errorf("ParseNaming(%s) didn't fail", parse_case.blob)
+		}
+		if !parse_case.fails && err != nil {
+			t.Errorf("ParseNaming(%s): %v", parse_case.blob, err)
+		}
+	}
+}
+
+func TestFilmNames(t *testing.T) {
+	spaced := Naming{Film: "{title} ({year})", Spaces: " "}
+	for _, names_case := range FILM_NAMES_CASES {
+		dir, file := DEFAULT_NAMING.FilmNames(names_case.title, names_case.date, 129)
+		if dir != names_case.dir || file != names_case.file {
+			t.Errorf(
+				"FilmNames(%q, %q) = %q, %q, want %q, %q",
+				names_case.title,
+				names_case.date,
+				dir,
+				file,
+				names_case.dir,
+				names_case.file,
+			)
+		}
+		dir, file = spaced.FilmNames(names_case.title, names_case.date, 129)
+		if dir != names_case.spaced || file != names_case.spaced {
+			t.Errorf(
+				"FilmNames(%q, %q) with spaces = %q, %q, want %q",
+				names_case.title,
+				names_case.date,
+				dir,
+				file,
+				names_case.spaced,
+			)
+		}
+	}
+}
+
+func TestEpisodeNames(t *testing.T) {
+	episode := EpisodeFields{
+		Show:         "Breaking Bad",
+		Season:       2,
+		SeasonName:   "Season 2",
+		SeasonDate:   "2009-03-08",
+		Episode:      7,
+		Name:         "Négro y Azul",
+		Date:         "2009-04-19",
+		TMDBId:       62098,
+		SeasonTMDBId: 3573,
+	}
+	season_dir, file := DEFAULT_NAMING.EpisodeNames(episode)
+	if season_dir != "02__Season_2__2009-03-08" || file != "07__Negro_y_Azul__2009-04-19" {
+		t.Errorf("EpisodeNames gave %q, %q", season_dir, file)
+	}
+
+	naming := Naming{Episode: "Season {season:02}/{show} S{season:02}E{episode:02}", Spaces: "."}
+	season_dir, file = naming.EpisodeNames(episode)
+	if season_dir != "Season 02" || file != "Breaking.Bad S02E07" {
+		t.Errorf("EpisodeNames with templates gave %q, %q", season_dir, file)
+	}
+}
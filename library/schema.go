@@ -0,0 +1,103 @@
+package library
+
+import (
+	"encoding/json"
+	"fmt"
+	"serviam/common"
+	"serviam/structs"
+)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// Upgrades a decoded info file from one schema version to the next.
+// Migrations work on the raw json so they don't depend on
+// the current shape of the structures in the structs package,
+// and keys they don't know about are kept in the order they were in.
+//
+type Migration struct {
+	From        int
+	Description string
+	Migrate     func(info *common.JSONObject)
+}
+
+//---------------------------------------------------------------------------
+// Migrations
+//---------------------------------------------------------------------------
+//
+// The migrations in order, one for each schema version before the current.
+// Files written before versioning was added have no version and count as 0.
+//
+var MIGRATIONS = []Migration{
+	{
+		From:        0,
+		Description: "add schema versions",
+		Migrate: func(info *common.JSONObject) {
+			if films, ok := info.Values["films"].([]interface{}); ok {
+				for _, film := range films {
+					if film_object, ok := film.(*common.JSONObject); ok {
+						film_object.Set("schema_version", 1)
+					}
+				}
+			}
+		},
+	},
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Reads the schema version of an info file.
+// Negative versions were never written, so are refused.
+//
+func SchemaVersion(blob []byte) (int, error) {
+	var versioned struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	err := json.Unmarshal(blob, &versioned)
+	if err == nil && versioned.SchemaVersion < 0 {
+		err = fmt.Errorf("schema version %d is not a schema version", versioned.SchemaVersion)
+	}
+	return versioned.SchemaVersion, err
+}
+
+//
+// Upgrades an info file to the current schema version.
+// The upgraded blob and the version it was upgraded from are returned.
+// Files from versions newer than this serviam knows, or negative ones,
+// are refused.
+//
+func MigrateBlob(blob []byte) ([]byte, int, error) {
+	version, err := SchemaVersion(blob)
+	if err != nil {
+		return blob, version, err
+	}
+	if version > structs.SCHEMA_VERSION {
+		return blob, version, fmt.Errorf(
+			"schema version %d is newer than the %d this program knows,"+
+				" please update serviam",
+			version,
+			structs.SCHEMA_VERSION,
+		)
+	}
+	if version == structs.SCHEMA_VERSION {
+		return blob, version, nil
+	}
+
+	decoded, err := common.DecodeJSON(blob)
+	if err != nil {
+		return blob, version, err
+	}
+	info, ok := decoded.(*common.JSONObject)
+	if !ok {
+		return blob, version, fmt.Errorf("an info file should be a json object")
+	}
+	for _, migration := range MIGRATIONS[version:] {
+		migration.Migrate(info)
+		info.Set("schema_version", migration.From+1)
+	}
+	migrated, err := json.MarshalIndent(info, "", common.INDENT)
+	return migrated, version, err
+}
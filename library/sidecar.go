@@ -0,0 +1,227 @@
+package library
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"serviam/common"
+	"serviam/structs"
+	"strings"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Extensions of files which go alongside a film or episode
+//
+var SIDECAR_EXTENSIONS = []string{
+	".srt",
+	".sub",
+	".idx",
+	".ass",
+	".ssa",
+	".vtt",
+	".nfo",
+}
+
+//
+// Subdirectories releases keep subtitles in, lower case
+//
+var SIDECAR_DIRS = []string{
+	"subs",
+	"subtitles",
+	"sub",
+}
+
+//
+// Sidecar flags, in the order they go in file names
+//
+const (
+	FLAG_FORCED  = "forced"
+	FLAG_SDH     = "sdh"
+	FLAG_DEFAULT = "default"
+)
+
+var FLAGS = []string{
+	FLAG_FORCED,
+	FLAG_SDH,
+	FLAG_DEFAULT,
+}
+
+//
+// Words found in sidecar names for each flag
+//
+var FLAG_WORDS = map[string]string{
+	"forced":  FLAG_FORCED,
+	"foreign": FLAG_FORCED,
+	"sdh":     FLAG_SDH,
+	"cc":      FLAG_SDH,
+	"hi":      FLAG_SDH,
+	"hoh":     FLAG_SDH,
+	"default": FLAG_DEFAULT,
+}
+
+//
+// Language names and ISO 639 codes found in sidecar names,
+// and the code recorded for each.
+// "hi" is left out as it usually means hearing impaired.
+//
+var LANGUAGE_WORDS = map[string]string{
+	"en": "en", "eng": "en", "english": "en",
+	"fr": "fr", "fre": "fr", "fra": "fr", "french": "fr",
+	"de": "de", "ger": "de", "deu": "de", "german": "de",
+	"es": "es", "spa": "es", "spanish": "es",
+	"it": "it", "ita": "it", "italian": "it",
+	"pt": "pt", "por": "pt", "portuguese": "pt",
+	"pt-br": "pt-br", "pob": "pt-br", "brazilian": "pt-br",
+	"nl": "nl", "dut": "nl", "nld": "nl", "dutch": "nl",
+	"sv": "sv", "swe": "sv", "swedish": "sv",
+	"no": "no", "nb": "no", "nor": "no", "norwegian": "no",
+	"da": "da", "dan": "da", "danish": "da",
+	"fi": "fi", "fin": "fi", "finnish": "fi",
+	"pl": "pl", "pol": "pl", "polish": "pl",
+	"cs": "cs", "cze": "cs", "ces": "cs", "czech": "cs",
+	"hu": "hu", "hun": "hu", "hungarian": "hu",
+	"ro": "ro", "rum": "ro", "ron": "ro", "romanian": "ro",
+	"el": "el", "gre": "el", "ell": "el", "greek": "el",
+	"tr": "tr", "tur": "tr", "turkish": "tr",
+	"ru": "ru", "rus": "ru", "russian": "ru",
+	"uk": "uk", "ukr": "uk", "ukrainian": "uk",
+	"ar": "ar", "ara": "ar", "arabic": "ar",
+	"he": "he", "heb": "he", "hebrew": "he",
+	"hin": "hi", "hindi": "hi",
+	"ja": "ja", "jpn": "ja", "japanese": "ja",
+	"ko": "ko", "kor": "ko", "korean": "ko",
+	"zh": "zh", "chi": "zh", "zho": "zh", "chinese": "zh",
+}
+
+//
+// Separators between the parts of a sidecar's name
+//
+var SIDECAR_SEPARATOR = regexp.MustCompile(`[._ ]+`)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// What a sidecar's name says about it
+//
+type SidecarTags struct {
+	Language string
+	Flags    []string
+	Others   []string
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Checks whether a file is a sidecar by its extension
+//
+func IsSidecar(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, sidecar_ext := range SIDECAR_EXTENSIONS {
+		if ext == sidecar_ext {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Checks whether a directory name is one releases keep subtitles in
+//
+func IsSidecarDir(name string) bool {
+	for _, dir := range SIDECAR_DIRS {
+		if strings.ToLower(name) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Reads the language and flags from the part of a sidecar's name
+// between the film's name and the extension, such as "en.forced"
+// or "2_English". Parts which aren't a language or a flag are kept
+// in Others unless they are just numbers.
+//
+func ParseSidecarTags(tags string) SidecarTags {
+	var parsed SidecarTags
+	has_flag := make(map[string]bool)
+
+	for _, part := range SIDECAR_SEPARATOR.Split(strings.ToLower(tags), -1) {
+		if part == "" {
+			continue
+		}
+		if language, ok := LANGUAGE_WORDS[part]; ok && parsed.Language == "" {
+			parsed.Language = language
+		} else if flag, ok := FLAG_WORDS[part]; ok {
+			has_flag[flag] = true
+		} else if strings.Trim(part, "0123456789") != "" {
+			if other := common.PosixFileName(part); other != "" {
+				parsed.Others = append(parsed.Others, other)
+			}
+		}
+	}
+	for _, flag := range FLAGS {
+		if has_flag[flag] {
+			parsed.Flags = append(parsed.Flags, flag)
+		}
+	}
+	return parsed
+}
+
+//
+// Names a sidecar of the item with the given id, id.language.flags.ext,
+// so every sidecar is named the same way whatever it was called
+//
+func SidecarName(id string, tags SidecarTags, ext string) string {
+	parts := []string{id}
+	if tags.Language != "" {
+		parts = append(parts, tags.Language)
+	}
+	parts = append(parts, tags.Flags...)
+	parts = append(parts, tags.Others...)
+	return strings.Join(parts, ".") + strings.ToLower(ext)
+}
+
+//
+// Names a sidecar, numbering it if the name has already been used
+//
+func UniqueSidecarName(
+	id string,
+	tags SidecarTags,
+	ext string,
+	used map[string]bool,
+) string {
+	name := SidecarName(id, tags, ext)
+	for num := 2; used[name]; num++ {
+		numbered := tags
+		numbered.Others = append(
+			append([]string{}, tags.Others...),
+			fmt.Sprint(num),
+		)
+		name = SidecarName(id, numbered, ext)
+	}
+	used[name] = true
+	return name
+}
+
+//
+// Records the language and flags of a sidecar of the item with the given id
+// in its FileData, read from its name
+//
+func TagSidecar(file structs.FileData, id string) structs.FileData {
+	if !IsSidecar(file.Name) || !strings.HasPrefix(file.Name, id+".") {
+		return file
+	}
+	tags := ParseSidecarTags(strings.TrimSuffix(
+		strings.TrimPrefix(file.Name, id),
+		filepath.Ext(file.Name),
+	))
+	file.Language = tags.Language
+	file.Flags = tags.Flags
+	return file
+}
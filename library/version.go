@@ -0,0 +1,118 @@
+package library
+
+import (
+	"fmt"
+	"path/filepath"
+	"serviam/common"
+	"serviam/releasename"
+	"serviam/structs"
+	"strings"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Resolutions by the smallest width or height which counts as them,
+// largest first, so widescreen films cropped short still count
+//
+var RESOLUTION_SIZES = []struct {
+	Name   string
+	Width  int
+	Height int
+}{
+	{"2160p", 3200, 2000},
+	{"1080p", 1800, 1000},
+	{"720p", 1200, 700},
+	{"576p", 0, 560},
+	{"480p", 0, 1},
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Gets the resolution a video's dimensions are known as, "" if they aren't known
+//
+func ResolutionName(width int, height int) string {
+	for _, size := range RESOLUTION_SIZES {
+		if width >= size.Width && size.Width > 0 || height >= size.Height {
+			return size.Name
+		}
+	}
+	return ""
+}
+
+//
+// Labels a video as a version of its film or episode,
+// by the edition and source in the release name it came with
+// and the resolution probing found, or else the one in the release name.
+// A release name of "" only labels its resolution.
+//
+func LabelVersion(file structs.FileData, release_name string) structs.FileData {
+	if release_name != "" {
+		release := releasename.Parse(release_name)
+		file.Edition = release.Edition
+		file.Source = release.Source
+		file.Resolution = release.Resolution
+	}
+	if file.Media != nil {
+		if resolution := ResolutionName(file.Media.Width, file.Media.Height); resolution != "" {
+			file.Resolution = resolution
+		}
+	}
+
+	var parts []string
+	for _, part := range []string{file.Edition, file.Resolution, file.Source} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	file.Label = strings.Join(parts, " ")
+	return file
+}
+
+//
+// Names a version of the item with the given id.
+// It is id+ext unless that is taken, then its label is added,
+// id.2160p.BluRay.mkv, and then a number if that is taken too.
+//
+func VersionName(
+	id string,
+	ext string,
+	label string,
+	taken func(name string) bool,
+) string {
+	name := id + ext
+	if !taken(name) {
+		return name
+	}
+	base := id
+	if label != "" {
+		base = id + "." + common.SlugWith(label, ".", 0)
+		name = base + ext
+	}
+	for number := 2; taken(name); number++ {
+		name = fmt.Sprintf("%s.%d%s", base, number, ext)
+	}
+	return name
+}
+
+//
+// Checks whether a file is a video, rather than a sidecar or a picture,
+// of a film or episode
+//
+func IsVideo(file structs.FileData) bool {
+	return IsVideoName(file.Name) || file.Media != nil
+}
+
+//
+// Checks whether a file is named as a video
+//
+func IsVideoName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp4", ".m4v", ".mov", ".mkv", ".webm", ".avi":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package match
+
+import (
+	"math"
+	"serviam/releasename"
+	"serviam/structs"
+	"sort"
+	"strconv"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Matching settings
+//
+const DEFAULT_THRESHOLD = 0.85
+const MIN_MARGIN = 0.1
+
+//
+// How much each part of a candidate's score counts
+//
+const (
+	TITLE_WEIGHT      = 0.6
+	YEAR_WEIGHT       = 0.25
+	POPULARITY_WEIGHT = 0.15
+)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// A search result and how well it matches the query.
+// Shows are given by their name and first air date.
+//
+type Candidate struct {
+	Id          int     `json:"id"`
+	Title       string  `json:"title"`
+	ReleaseDate string  `json:"release_date"`
+	Overview    string  `json:"overview,omitempty"`
+	Poster      string  `json:"poster_path,omitempty"`
+	Popularity  float64 `json:"popularity"`
+	Score       float64 `json:"score"`
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Gets the year from a TMDB date, or 0 if there isn't one
+//
+func DateYear(date string) int {
+	if len(date) < 4 {
+		return 0
+	}
+	year, err := strconv.Atoi(date[:4])
+	if err != nil {
+		return 0
+	}
+	return year
+}
+
+//
+// Makes candidates of film search results
+//
+func FilmCandidates(results []structs.TMDBMovieSearchResult) []Candidate {
+	var candidates []Candidate
+	for _, result := range results {
+		candidates = append(candidates, Candidate{
+			Id:          result.Id,
+			Title:       result.Title,
+			ReleaseDate: result.ReleaseDate,
+			Overview:    result.Overview,
+			Poster:      result.PosterPath,
+			Popularity:  result.Popularity,
+		})
+	}
+	return candidates
+}
+
+//
+// Makes candidates of show search results
+//
+func ShowCandidates(results []structs.TMDBTVSearchResult) []Candidate {
+	var candidates []Candidate
+	for _, result := range results {
+		candidates = append(candidates, Candidate{
+			Id:          result.Id,
+			Title:       result.Name,
+			ReleaseDate: result.FirstAirDate,
+			Overview:    result.Overview,
+			Poster:      result.PosterPath,
+			Popularity:  result.Popularity,
+		})
+	}
+	return candidates
+}
+
+//
+// Scores candidates against a query, best first.
+// The title counts most, then the year (when known), then popularity
+// relative to the most popular candidate.
+//
+func Score(query string, year int, candidates []Candidate) []Candidate {
+	max_popularity := 0.0
+	for _, candidate := range candidates {
+		max_popularity = math.Max(max_popularity, candidate.Popularity)
+	}
+
+	scored := make([]Candidate, len(candidates))
+	for idx, candidate := range candidates {
+		title_score := releasename.Similarity(query, candidate.Title)
+		popularity_score := 0.0
+		if max_popularity > 0 {
+			popularity_score = candidate.Popularity / max_popularity
+		}
+
+		score := TITLE_WEIGHT*title_score + POPULARITY_WEIGHT*popularity_score
+		if year != 0 {
+			year_score := 0.0
+			switch math.Abs(float64(DateYear(candidate.ReleaseDate) - year)) {
+			case 0:
+				year_score = 1
+			case 1:
+				year_score = 0.5
+			}
+			score += YEAR_WEIGHT * year_score
+		} else {
+			score /= TITLE_WEIGHT + POPULARITY_WEIGHT
+		}
+
+		candidate.Score = math.Round(score*1000) / 1000
+		scored[idx] = candidate
+	}
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].Score > scored[j].Score
+	})
+	return scored
+}
+
+//
+// Checks whether the best candidate is good enough to accept unseen,
+// it must pass the threshold and be clearly ahead of the next best
+//
+func Confident(candidates []Candidate, threshold float64) bool {
+	if len(candidates) == 0 || candidates[0].Score < threshold {
+		return false
+	}
+	return len(candidates) == 1 || candidates[0].Score-candidates[1].Score >= MIN_MARGIN
+}
@@ -0,0 +1,44 @@
+package match
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path"
+)
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Finds a script, in its build directory or the bin directory if one is set,
+// otherwise on the PATH
+//
+func Script(bin_dir string, name string) string {
+	if bin_dir == "" {
+		return name
+	}
+	built := path.Join(bin_dir, name, name)
+	if info, err := os.Stat(built); err == nil && !info.IsDir() {
+		return built
+	}
+	return path.Join(bin_dir, name)
+}
+
+//
+// Runs a script in a directory, such as an inbox,
+// writing everything it outputs to output
+//
+func RunScript(
+	bin_dir string,
+	dir string,
+	output io.Writer,
+	name string,
+	args ...string,
+) error {
+	cmd := exec.Command(Script(bin_dir, name), args...)
+	cmd.Dir = dir
+	cmd.Stdout = output
+	cmd.Stderr = output
+	return cmd.Run()
+}
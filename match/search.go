@@ -0,0 +1,37 @@
+package match
+
+import (
+	"context"
+	"serviam/tmdb"
+)
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Searches TMDB for films or shows, scored against the query, best first.
+// If nothing is found for the year, every year is searched.
+//
+func Search(client *tmdb.Client, show bool, query string, year int) ([]Candidate, error) {
+	ctx := context.Background()
+	if show {
+		search, err := client.SearchTV(ctx, query, year)
+		if err == nil && len(search.Results) == 0 && year != 0 {
+			year = 0
+			search, err = client.SearchTV(ctx, query, 0)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return Score(query, year, ShowCandidates(search.Results)), nil
+	}
+	search, err := client.SearchMovie(ctx, query, year)
+	if err == nil && len(search.Results) == 0 && year != 0 {
+		year = 0
+		search, err = client.SearchMovie(ctx, query, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Score(query, year, FilmCandidates(search.Results)), nil
+}
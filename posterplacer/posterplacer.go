@@ -2,12 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"serviam/common"
+	"serviam/library"
 	"serviam/structs"
 	"strings"
 )
@@ -22,10 +24,13 @@ var EXTENSIONS_TO_MOVE = []string{
 	".mp4",
 	".mkv",
 	".avi",
-	".srt",
-	".sub",
 }
 
+//
+// name recorded in journals
+//
+const COMMAND = "posterplacer"
+
 //
 // directories
 //
@@ -37,6 +42,19 @@ const (
 	MEDIA_COLLECTION_DIR = "collections"
 )
 
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// A film file to be moved. Sidecars keep the part of their name
+// which says their language and flags.
+//
+type FileToMove struct {
+	Source  string
+	Sidecar bool
+	Tags    string
+}
+
 //---------------------------------------------------------------------------
 // Functions
 //---------------------------------------------------------------------------
@@ -44,13 +62,13 @@ const (
 // Move Picture
 //
 func MovePicture(
+	plan *common.Plan,
 	current_pic_name string,
 	media_root string,
 	new_sub_dir string,
 	new_pic_name string,
 ) structs.FileData {
 	var pic_file structs.FileData
-	var err error
 
 	pic_ext := filepath.Ext(current_pic_name)
 	current_pic_path := path.Join(PICTURE_DIR, current_pic_name)
@@ -58,23 +76,20 @@ func MovePicture(
 	new_pic_path := path.Join(media_root, new_pic_sub_path)
 
 	if current_pic_name != "" {
-		err = os.Rename(current_pic_path, new_pic_path)
-		common.CheckErr(err)
-		log.Printf("Moved '%s' to '%s'.\n", current_pic_path, new_pic_path)
-		pic_file = structs.FileData{
-			new_pic_name + pic_ext,
-			new_pic_sub_path,
-			pic_ext[1:],
-		}
+		plan.MoveFile(current_pic_path, new_pic_path)
+		pic_file = structs.NewFileData(new_pic_name+pic_ext, new_sub_dir)
 	}
 	return pic_file
 }
 
 //
-// gets all the files associated with a film that need to be moved
+// gets all the files associated with a film that need to be moved:
+// the film itself and its sidecars, such as name.en.forced.srt,
+// next to it or in a subtitle directory (Subs/name.en.srt, Subs/name/English.srt)
 //
-func GetFilesToBeMoved(name string) []string {
-	var output_files []string
+func GetFilesToBeMoved(name string) []FileToMove {
+	var output_files []FileToMove
+	var dir_files []FileToMove
 	var files_in_dir []os.FileInfo
 	var err error
 
@@ -86,37 +101,168 @@ func GetFilesToBeMoved(name string) []string {
 		f_ext := filepath.Ext(f_name)
 		no_ext := strings.TrimSuffix(f_name, f_ext)
 
-		if no_ext == name {
+		if f.IsDir() {
+			if library.IsSidecarDir(f_name) {
+				dir_files = append(dir_files, GetSidecarsInDir(f_name, name)...)
+			}
+		} else if library.IsSidecar(f_name) {
+			if strings.HasPrefix(f_name, name+".") {
+				output_files = append(output_files, FileToMove{
+					Source:  f_name,
+					Sidecar: true,
+					Tags:    strings.TrimPrefix(no_ext, name),
+				})
+			}
+		} else if no_ext == name {
 			for _, m_ext := range EXTENSIONS_TO_MOVE {
 				if f_ext == m_ext {
-					output_files = append(output_files, f_name)
+					output_files = append(output_files, FileToMove{Source: f_name})
 				}
 			}
 		}
 	}
+
+	// sidecars next to the film get the plainer names
+	return append(output_files, dir_files...)
+}
+
+//
+// gets the sidecars of a film in a subtitle directory,
+// those named after the film and those in a directory named after it
+//
+func GetSidecarsInDir(dir string, name string) []FileToMove {
+	var output_files []FileToMove
+
+	files_in_dir, err := ioutil.ReadDir(dir)
+	common.CheckErr(err)
+
+	for _, f := range files_in_dir {
+		f_name := f.Name()
+		no_ext := strings.TrimSuffix(f_name, filepath.Ext(f_name))
+
+		if f.IsDir() && f_name == name {
+			for _, sidecar := range library.ListFiles(path.Join(dir, f_name)) {
+				if library.IsSidecar(sidecar) {
+					output_files = append(output_files, FileToMove{
+						Source:  path.Join(dir, f_name, sidecar),
+						Sidecar: true,
+						Tags:    strings.TrimSuffix(sidecar, filepath.Ext(sidecar)),
+					})
+				}
+			}
+		} else if !f.IsDir() && library.IsSidecar(f_name) &&
+			(no_ext == name || strings.HasPrefix(f_name, name+".")) {
+			output_files = append(output_files, FileToMove{
+				Source:  path.Join(dir, f_name),
+				Sidecar: true,
+				Tags:    strings.TrimPrefix(no_ext, name),
+			})
+		}
+	}
 	return output_files
 }
 
 //
-// Converts TMDB data to a Serviam format
+// Finds the directory and id of a film which isn't in a collection:
+// the ones it already has if it is in the library,
+// otherwise ones made with the media root's naming templates
+// which no other film has
+//
+func FilmId(
+	plan *common.Plan,
+	media_root string,
+	tmdb structs.TMDBMovie,
+) (
+	string,
+	string,
+) {
+	if info, found := library.FindTMDBId(media_root, library.FILM_INFO, tmdb.Id); found {
+		var film structs.FilmData
+		library.ReadInfoFile(info.Path, &film)
+		return info.Id, film.Id
+	}
+	naming := library.ReadNaming(media_root)
+	dir, id := naming.FilmNames(tmdb.Title, tmdb.ReleaseDate, tmdb.Id)
+	unique_dir := library.UniqueId(dir, tmdb.Id, func(dir string) bool {
+		var film structs.FilmData
+		info_file := path.Join(media_root, MEDIA_FILM_DIR, dir, dir+".json")
+		return library.ReadPlannedInfoFile(plan, info_file, &film) &&
+			film.TMDBId != tmdb.Id
+	})
+	return unique_dir, id + strings.TrimPrefix(unique_dir, dir)
+}
+
+//
+// Finds the id of a film in a collection, the same way
+//
+func CollectionFilmId(
+	naming library.Naming,
+	collection structs.CollectionData,
+	tmdb structs.TMDBMovie,
+) string {
+	for _, film := range collection.Films {
+		if film.TMDBId == tmdb.Id {
+			return film.Id
+		}
+	}
+	_, id := naming.FilmNames(tmdb.Title, tmdb.ReleaseDate, tmdb.Id)
+	return library.UniqueId(id, tmdb.Id, func(id string) bool {
+		for _, film := range collection.Films {
+			if film.Id == id {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+//
+// Finds the directory of a collection, the same way
+//
+func CollectionId(
+	plan *common.Plan,
+	media_root string,
+	tmdb structs.TMDBCollection,
+) string {
+	info, found := library.FindTMDBId(media_root, library.COLLECTION_INFO, tmdb.Id)
+	if found {
+		return info.Id
+	}
+	naming := library.ReadNaming(media_root)
+	return library.UniqueId(
+		naming.CollectionName(tmdb.Name, tmdb.Id),
+		tmdb.Id,
+		func(id string) bool {
+			var collection structs.CollectionData
+			info_file := path.Join(media_root, MEDIA_COLLECTION_DIR, id, id+".json")
+			return library.ReadPlannedInfoFile(plan, info_file, &collection) &&
+				collection.TMDBId != tmdb.Id
+		},
+	)
+}
+
+//
+// Converts TMDB data to a Serviam format.
+// Videos are versions of the film, named apart from the existing
+// versions unless they are the same version placed again.
 //
 func MoveAndMakeFilmData(
+	plan *common.Plan,
 	tmdb structs.TMDBMovie,
 	tmdb_file string,
 	media_root string,
 	sub_dir string,
+	id string,
+	existing []structs.FileData,
 ) structs.FilmData {
-	var err error
 	var film_files []structs.FileData
-	var s_film_files []string
+	var s_film_files []FileToMove
 	var poster_file structs.FileData
 	var backdrop_file structs.FileData
 
-	u_title := common.PosixFileName(strings.Replace(tmdb.Title, " ", "_", -1))
-	id := u_title + "__" + tmdb.ReleaseDate
-
 	// move poster
 	poster_file = MovePicture(
+		plan,
 		tmdb.PosterPath,
 		media_root,
 		sub_dir,
@@ -125,33 +271,57 @@ func MoveAndMakeFilmData(
 
 	// move backdrop
 	backdrop_file = MovePicture(
+		plan,
 		tmdb.BackdropPath,
 		media_root,
 		sub_dir,
 		id+"__B",
 	)
 
-	// move other film files
+	// move other film files, naming sidecars by their language and flags
+	// and videos by their version
 	s_film_files = GetFilesToBeMoved(strings.TrimSuffix(tmdb_file, ".json"))
+	used_names := make(map[string]bool)
+	existing_files := make(map[string]structs.FileData)
+	for _, file := range existing {
+		existing_files[file.Name] = file
+	}
 	for _, film_file := range s_film_files {
-		file_name := id + filepath.Ext(film_file)
-		file_path := path.Join(sub_dir, file_name)
-		file_type := filepath.Ext(film_file)[1:]
-		err = os.Rename(
-			film_file,
-			path.Join(media_root, sub_dir, file_name),
-		)
-		common.CheckErr(err)
-		log.Printf(
-			"Moved '%s' to '%s'.\n",
-			film_file,
-			path.Join(media_root, sub_dir, file_name),
-		)
-		film_files = append(film_files, structs.FileData{
-			file_name,
-			file_path,
-			file_type,
-		})
+		var file_data structs.FileData
+		ext := filepath.Ext(film_file.Source)
+		tags := library.ParseSidecarTags(film_file.Tags)
+		if film_file.Sidecar {
+			file_data.Name = library.UniqueSidecarName(id, tags, ext, used_names)
+			file_data.Language = tags.Language
+			file_data.Flags = tags.Flags
+		} else {
+			file_data = library.ProbeFile(file_data, film_file.Source)
+			file_data = library.LabelVersion(file_data, film_file.Source)
+			file_data.Name = library.VersionName(
+				id,
+				ext,
+				file_data.Label,
+				func(name string) bool {
+					// placing the same video again keeps its name
+					if existing_file, found := existing_files[name]; found {
+						return !library.SameVideo(
+							file_data,
+							existing_file,
+							path.Join(media_root, sub_dir, name),
+						)
+					}
+					return used_names[name] ||
+						plan.Exists(path.Join(media_root, sub_dir, name))
+				},
+			)
+			used_names[file_data.Name] = true
+		}
+		plan.PlaceFile(film_file.Source, path.Join(media_root, sub_dir, file_data.Name))
+		placed := structs.NewFileData(file_data.Name, sub_dir)
+		file_data.Path = placed.Path
+		file_data.Type = placed.Type
+		file_data.Placement = plan.Placement
+		film_files = append(film_files, file_data)
 	}
 
 	return structs.TMDBMovieToFilmData(
@@ -167,6 +337,7 @@ func MoveAndMakeFilmData(
 // Moves a film with its info and posters
 //
 func MoveFilm(
+	plan *common.Plan,
 	media_root string,
 	tmdb_file string,
 	tmdb structs.TMDBMovie,
@@ -176,30 +347,47 @@ func MoveFilm(
 	var film_data structs.FilmData
 
 	// make id
-	u_title := common.PosixFileName(strings.Replace(tmdb.Title, " ", "_", -1))
-	id := u_title + "__" + tmdb.ReleaseDate
+	dir, id := FilmId(plan, media_root, tmdb)
 
 	// create directory for film
-	sub_dir := path.Join(MEDIA_FILM_DIR, id)
+	sub_dir := path.Join(MEDIA_FILM_DIR, dir)
 	film_dir := path.Join(media_root, sub_dir)
-	common.CheckDir(film_dir)
+	plan.CheckDir(film_dir)
+
+	// keep what is already known if the film has been placed before
+	film_info_file := path.Join(film_dir, dir+".json")
+	plan.Lock(film_info_file)
+	var existing_film structs.FilmData
+	placed_before := library.ReadPlannedInfoFile(plan, film_info_file, &existing_film)
 
 	// Move files and film info
-	film_data = MoveAndMakeFilmData(tmdb, tmdb_file, media_root, sub_dir)
+	film_data = MoveAndMakeFilmData(
+		plan,
+		tmdb,
+		tmdb_file,
+		media_root,
+		sub_dir,
+		id,
+		existing_film.FilmFiles,
+	)
+	if placed_before {
+		film_data = library.MergeFilmData(existing_film, film_data)
+	}
 
 	// create info file
 	blob, err = json.MarshalIndent(film_data, "", common.INDENT)
 	common.CheckErr(err)
-	film_info_file := path.Join(film_dir, id+".json")
-	log.Printf("Making '%s'.\n", id+".json")
-	common.SaveBlob(blob, film_info_file)
+	log.Printf("Making '%s'.\n", dir+".json")
+	plan.SaveBlob(blob, film_info_file)
 }
 
 //
 // Adds a film to a collection and moves its posters to the collection
 //
 func AddFilmToCollection(
+	plan *common.Plan,
 	media_root string,
+	u_name string,
 	tmdb_file string,
 	tmdb structs.TMDBMovie,
 ) {
@@ -208,39 +396,54 @@ func AddFilmToCollection(
 	var collection_data structs.CollectionData
 
 	// find
-	u_name := common.PosixFileName(strings.Replace(
-		tmdb.BelongsToCollection.Name,
-		" ",
-		"_",
-		-1,
-	))
 	sub_dir := path.Join(MEDIA_COLLECTION_DIR, u_name)
 	info_file := path.Join(media_root, sub_dir, u_name+".json")
 
-	// open collection file
-	blob, err = ioutil.ReadFile(info_file)
-	common.CheckErr(err)
-	err = json.Unmarshal(blob, &collection_data)
-	common.CheckErr(err)
-
-	// add film data to collection info file and move file files
-	collection_data.Films = append(
+	// open collection file, as the plan will have left it,
+	// locked so no one else changes it before the plan is done
+	plan.Lock(info_file)
+	library.ReadPlannedInfoFile(plan, info_file, &collection_data)
+
+	// add film data to collection info file and move file files,
+	// updating the film if it is already in the collection
+	var existing_files []structs.FileData
+	for _, film := range collection_data.Films {
+		if film.TMDBId == tmdb.Id {
+			existing_files = film.FilmFiles
+		}
+	}
+	var in_collection bool
+	collection_data.Films, in_collection = library.PutFilm(
 		collection_data.Films,
-		MoveAndMakeFilmData(tmdb, tmdb_file, media_root, sub_dir),
+		MoveAndMakeFilmData(
+			plan,
+			tmdb,
+			tmdb_file,
+			media_root,
+			sub_dir,
+			CollectionFilmId(library.ReadNaming(media_root), collection_data, tmdb),
+			existing_files,
+		),
 	)
 
 	// create info file
 	blob, err = json.MarshalIndent(collection_data, "", common.INDENT)
 	common.CheckErr(err)
-	log.Printf("Adding film to '%s'.\n", u_name+".json")
-	common.SaveBlob(blob, info_file)
+	if in_collection {
+		log.Printf("Updating film in '%s'.\n", u_name+".json")
+	} else {
+		log.Printf("Adding film to '%s'.\n", u_name+".json")
+	}
+	plan.SaveBlob(blob, info_file)
 }
 
 //
 // moves collection files to a directory and creates an info file
 //
 func MoveAndMakeCollection(
+	plan *common.Plan,
 	media_root string,
+	u_name string,
 	tmdb structs.TMDBCollection,
 ) {
 	var err error
@@ -251,13 +454,13 @@ func MoveAndMakeCollection(
 	var collection_data structs.CollectionData
 
 	// create collection directory
-	u_name := common.PosixFileName(strings.Replace(tmdb.Name, " ", "_", -1))
 	sub_dir := path.Join(MEDIA_COLLECTION_DIR, u_name)
 	collection_dir := path.Join(media_root, sub_dir)
-	common.CheckDir(collection_dir)
+	plan.CheckDir(collection_dir)
 
 	// move poster
 	poster_file = MovePicture(
+		plan,
 		tmdb.PosterPath,
 		media_root,
 		sub_dir,
@@ -266,6 +469,7 @@ func MoveAndMakeCollection(
 
 	// move backdrop
 	backdrop_file = MovePicture(
+		plan,
 		tmdb.BackdropPath,
 		media_root,
 		sub_dir,
@@ -285,13 +489,14 @@ func MoveAndMakeCollection(
 	blob, err = json.MarshalIndent(collection_data, "", common.INDENT)
 	common.CheckErr(err)
 	log.Printf("Making '%s'.\n", u_name+".json")
-	common.SaveBlob(blob, collection_info_file)
+	plan.SaveBlob(blob, collection_info_file)
 }
 
 //
 // Processes Film
 //
 func ProcessFilm(
+	plan *common.Plan,
 	media_root string,
 	tmdb_file string,
 ) {
@@ -306,77 +511,121 @@ func ProcessFilm(
 
 	if tmdb_film.BelongsToCollection.Name == "" {
 		MoveFilm(
+			plan,
 			media_root,
 			tmdb_file,
 			tmdb_film,
 		)
 	} else {
-		u_name := common.PosixFileName(strings.Replace(
-			tmdb_film.BelongsToCollection.Name,
-			" ",
-			"_",
-			-1,
-		))
+		u_name := CollectionId(plan, media_root, tmdb_film.BelongsToCollection)
 		collection_dir := path.Join(media_root, MEDIA_COLLECTION_DIR, u_name)
 
-		if _, err = os.Stat(collection_dir); err == nil {
+		if plan.Exists(collection_dir) {
 			log.Printf(
 				"The '%s' collection already saved.\n",
 				tmdb_film.BelongsToCollection.Name,
 			)
-		} else if os.IsNotExist(err) {
+		} else {
 			log.Printf(
 				"Moving '%s' collection.\n",
 				tmdb_film.BelongsToCollection.Name,
 			)
 			MoveAndMakeCollection(
+				plan,
 				media_root,
+				u_name,
 				tmdb_film.BelongsToCollection,
 			)
-		} else {
-			common.CheckErr(err)
 		}
 		AddFilmToCollection(
+			plan,
 			media_root,
+			u_name,
 			tmdb_file,
 			tmdb_film,
 		)
 	}
 }
 
+//
+// Plans to place a film and put its TMDB file in the moved directory
+//
+func PlanFilm(plan *common.Plan, media_root string, tmdb_file string) {
+	ProcessFilm(plan, media_root, tmdb_file)
+	plan.CheckDir(MOVED_DIR)
+	plan.MoveFile(tmdb_file, path.Join(MOVED_DIR, tmdb_file))
+}
+
+//
+// Places a film, resuming the journal of an earlier attempt if it didn't finish
+//
+func PlaceFilm(media_root string, tmdb_file string, placement string) {
+	item := common.Absolute(tmdb_file)
+	journal, unfinished := common.FindUnfinishedJournal(media_root, COMMAND, item)
+	if unfinished {
+		log.Printf("Resuming '%s' from '%s'.\n", tmdb_file, journal.Location)
+	} else {
+		plan := common.NewPlan()
+		plan.Placement = placement
+		defer plan.Unlock()
+		PlanFilm(plan, media_root, tmdb_file)
+		journal = common.NewJournal(media_root, COMMAND, item, "", plan)
+	}
+	err := journal.Run(nil)
+	common.CheckErr(err)
+}
+
 //---------------------------------------------------------------------------
 // Main
 //---------------------------------------------------------------------------
 //
 func main() {
-	if len(os.Args) < 3 {
+	dry_run := flag.Bool("dry-run", false, "print what would be done without doing it")
+	as_json := flag.Bool("json", false, "print the dry run plan as json")
+	placement := flag.String(
+		"placement",
+		common.PLACE_MOVE,
+		"how film files are put in the media directory: "+
+			strings.Join(common.PLACEMENTS, ", "),
+	)
+	flag.Parse()
+
+	if flag.NArg() < 2 {
 		println("Please provide the media root and some films to place.")
 		return
 	}
-	media_root := os.Args[1]
-
-	common.CheckDir(media_root)
-	common.CheckDir(MOVED_DIR)
-	common.CheckDir(PICTURE_DIR)
-	common.CheckDir(COLLECTION_DIR)
+	media_root := flag.Arg(0)
+	err := common.CheckPlacement(*placement)
+	common.CheckErr(err)
 
-	for idx := 2; idx < len(os.Args); idx++ {
+	// a dry run shares one plan so later films see earlier ones
+	plan := common.NewPlan()
+	plan.Placement = *placement
+	for _, dir := range []string{media_root, PICTURE_DIR, COLLECTION_DIR} {
+		if *dry_run {
+			plan.CheckDir(dir)
+		} else {
+			common.CheckDir(dir)
+		}
+	}
+	for _, tmdb_file := range flag.Args()[1:] {
 
-		if filepath.Ext(os.Args[idx]) != ".json" {
+		if filepath.Ext(tmdb_file) != ".json" {
 			log.Printf(
 				"'%s' does not appear to be a json file. Ingnoring.\n",
-				os.Args[idx],
+				tmdb_file,
 			)
+		} else if *dry_run {
+			log.Printf("Planning '%s'.\n", tmdb_file)
+			PlanFilm(plan, media_root, tmdb_file)
 		} else {
-			log.Printf("Working on '%s'.\n", os.Args[idx])
-			ProcessFilm(
-				media_root,
-				os.Args[idx],
-			)
-			new_location := path.Join(MOVED_DIR, os.Args[idx])
-			err := os.Rename(os.Args[idx], new_location)
-			common.CheckErr(err)
-			log.Printf("Moved '%s' to '%s'.\n", os.Args[idx], new_location)
+			log.Printf("Working on '%s'.\n", tmdb_file)
+			PlaceFilm(media_root, tmdb_file, *placement)
 		}
 	}
+
+	if *dry_run {
+		plan.Print(*as_json)
+		plan.Unlock()
+	}
 }
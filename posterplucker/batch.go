@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"serviam/common"
+	"serviam/match"
+	"serviam/releasename"
+	"serviam/tmdb"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Batch settings
+//
+const DEFAULT_REVIEW_FILE = "review.json"
+const TOP_CANDIDATES = 5
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// A file which could not be matched with confidence.
+// Set choice to the TMDB id of the right film to resolve it.
+//
+type Review struct {
+	File       string            `json:"file"`
+	Query      string            `json:"query"`
+	Year       int               `json:"year,omitempty"`
+	Candidates []match.Candidate `json:"candidates"`
+	Choice     int               `json:"choice"`
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Saves the info file, pictures and collection of a film
+//
+func PluckFilm(client *tmdb.Client, id int, info_path string) {
+	tmdb_film := MakeTMDBFilmInfoFile(client, id, info_path)
+	for _, tmdb_img := range []string{tmdb_film.PosterPath, tmdb_film.BackdropPath} {
+		if tmdb_img == "" {
+			continue
+		}
+		location := path.Join(PICTURE_DIR, tmdb_img)
+		if _, err := os.Stat(location); err == nil {
+			continue
+		}
+		DownloadImage(client, tmdb_img, location)
+	}
+	if tmdb_film.BelongsToCollection.Name != "" {
+		MakeTMDBCollectionInfoFile(client, tmdb_film.BelongsToCollection)
+	}
+}
+
+//
+// Reads a review file, a missing file has nothing to review
+//
+func ReadReviews(review_file string) []Review {
+	var reviews []Review
+
+	blob, err := ioutil.ReadFile(review_file)
+	if os.IsNotExist(err) {
+		return reviews
+	}
+	common.CheckErr(err)
+	common.CheckErr(json.Unmarshal(blob, &reviews))
+	return reviews
+}
+
+//
+// Writes a review file, removing it when there is nothing left to review
+//
+func WriteReviews(review_file string, reviews []Review) {
+	if len(reviews) == 0 {
+		if err := os.Remove(review_file); err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		return
+	}
+	blob, err := json.MarshalIndent(reviews, "", common.INDENT)
+	common.CheckErr(err)
+	common.SaveBlob(blob, review_file)
+}
+
+//
+// Matches files without asking, accepting confident matches
+// and adding the rest to the review file with their top candidates
+//
+func BatchMatch(
+	client *tmdb.Client,
+	files []string,
+	threshold float64,
+	review_file string,
+) {
+	var kept []Review
+
+	reviews := ReadReviews(review_file)
+	pending := make(map[string]bool)
+	for _, file := range files {
+		pending[file] = true
+	}
+	for _, review := range reviews {
+		if !pending[review.File] {
+			kept = append(kept, review)
+		}
+	}
+
+	accepted := 0
+	for _, file := range files {
+		name := InfoName(file)
+		if _, err := os.Stat(name + ".json"); err == nil {
+			log.Printf("Skipping '%s' (already has a json file).\n", name)
+			continue
+		}
+
+		query, year := releasename.Query(file)
+		candidates, err := match.Search(client, false, query, year)
+		if err != nil {
+			log.Printf("Error searching for '%s': %v\n", query, err)
+			continue
+		}
+
+		if match.Confident(candidates, threshold) {
+			log.Printf(
+				"Matched '%s' to '%s' (%s) with a score of %.3f.\n",
+				file,
+				candidates[0].Title,
+				candidates[0].ReleaseDate,
+				candidates[0].Score,
+			)
+			PluckFilm(client, candidates[0].Id, name+".json")
+			accepted++
+			continue
+		}
+
+		if len(candidates) > TOP_CANDIDATES {
+			candidates = candidates[:TOP_CANDIDATES]
+		}
+		log.Printf("Adding '%s' to the review file.\n", file)
+		kept = append(kept, Review{
+			File:       file,
+			Query:      query,
+			Year:       year,
+			Candidates: candidates,
+		})
+	}
+
+	WriteReviews(review_file, kept)
+	log.Printf(
+		"Matched %d files, %d left to review in '%s'.\n",
+		accepted,
+		len(kept),
+		review_file,
+	)
+}
+
+//
+// Resolves a review file.
+// Reviews with a choice are saved without asking,
+// the rest are searched for interactively.
+// Anything still unresolved stays in the review file.
+//
+func ResolveReviews(client *tmdb.Client, review_file string) {
+	var kept []Review
+
+	for _, review := range ReadReviews(review_file) {
+		name := InfoName(review.File)
+		if _, err := os.Stat(name + ".json"); err == nil {
+			log.Printf("Skipping '%s' (already has a json file).\n", name)
+			continue
+		}
+
+		if review.Choice != 0 {
+			log.Printf("Using TMDB id %d for '%s'.\n", review.Choice, review.File)
+			PluckFilm(client, review.Choice, name+".json")
+			continue
+		}
+
+		log.Printf("Resolving '%s'.\n", review.File)
+		tmdb_result, film_found := FindFilm(client, review.Query, review.Year)
+		if film_found {
+			PluckFilm(client, tmdb_result.Id, name+".json")
+		} else {
+			kept = append(kept, review)
+		}
+	}
+
+	WriteReviews(review_file, kept)
+}
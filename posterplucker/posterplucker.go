@@ -2,20 +2,20 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"serviam/common"
+	"serviam/match"
+	"serviam/releasename"
 	"serviam/structs"
-	"strconv"
+	"serviam/tmdb"
 	"strings"
-	"time"
 )
 
 //---------------------------------------------------------------------------
@@ -24,41 +24,19 @@ import (
 //
 // Settings
 //
-const TIMEOUT = 30
 const DISPLAY_POSTER = true
 const PICTURE_DIR = "pictures"
 const COLLECTION_DIR = "collections"
 
-//
-// URL Prefixes
-//
-const MOVIE_GET_URL = "https://api.themoviedb.org/3/movie/"
-const MOVIE_SEARCH_URL = "https://api.themoviedb.org/3/search/movie"
-const TV_GET_URL = "https://api.themoviedb.org/3/tv/"
-const TV_SEARCH_URL = "https://api.themoviedb.org/3/search/tv"
-const GENRE_URL = "https://api.themoviedb.org/3/genre/movie/list"
-const IMAGE_URL = "https://image.tmdb.org/t/p/original"
-
 //---------------------------------------------------------------------------
 // Functions
 //---------------------------------------------------------------------------
 //
 // Downloads an image from the TMDB site.
 //
-func DownloadImage(client http.Client, tmdb_img string, location string) {
-	url := IMAGE_URL + tmdb_img
+func DownloadImage(client *tmdb.Client, tmdb_img string, location string) {
 	log.Printf("Downloading '%s'.\n", location)
-
-	// open file
-	file, err := os.Create(location)
-	common.CheckErr(err)
-	defer file.Close()
-	// download image
-	resp, err := client.Get(url)
-	common.CheckErr(err)
-	defer resp.Body.Close()
-	// save image
-	size, err := io.Copy(file, resp.Body)
+	size, err := client.DownloadImage(context.Background(), tmdb_img, location)
 	common.CheckErr(err)
 	log.Printf("Downloaded '%s' of size %d.\n", location, size)
 }
@@ -88,32 +66,20 @@ func YesOrNo(question string) bool {
 	}
 }
 
-func NotOK(resp *http.Response) bool {
-	if resp.StatusCode != 200 {
-		log.Printf("Status Code: %d\n", resp.StatusCode)
-		defer resp.Body.Close()
-		body_bytes, err := ioutil.ReadAll(resp.Body)
-		common.CheckErr(err)
-		log.Printf("Response Body:\n%s\n", string(body_bytes))
-		return true
-	} else {
-		return false
-	}
-}
-
 //
 // Searches for a film in the TMDB and downloads its poster and backdrop.
+// A year of 0 searches every year.
 //
 func FindFilm(
-	client http.Client,
-	api_key string,
+	client *tmdb.Client,
 	query string,
+	year int,
 ) (
 	structs.TMDBMovieSearchResult,
 	bool,
 ) {
 	var stdin_reader *bufio.Reader
-	var tmdb structs.TMDBMovieSearch
+	var search structs.TMDBMovieSearch
 	var results []structs.TMDBMovieSearchResult
 	var err error
 
@@ -132,11 +98,15 @@ func FindFilm(
 			query, err = stdin_reader.ReadString('\n')
 			common.CheckErr(err)
 			query = strings.Trim(query, "\n")
+			year = 0
 			change_query = false
 		}
 
-		query = strings.Replace(query, " ", "%20", -1)
-		log.Printf("Current query is '%s'.\n", query)
+		if year != 0 {
+			log.Printf("Current query is '%s' (%d).\n", query, year)
+		} else {
+			log.Printf("Current query is '%s'.\n", query)
+		}
 		if YesOrNo("Are you happy with this query? (y/n)") {
 			change_query = false
 		} else {
@@ -144,25 +114,19 @@ func FindFilm(
 		}
 
 		if !change_query {
-			url := MOVIE_SEARCH_URL + "?api_key=" + api_key + "&query=" + query
-
 			log.Printf("Searching the TMDB data base for '%s'.\n", query)
-			resp, err := client.Get(url)
-			common.CheckErr(err)
-			if NotOK(resp) {
-				return structs.TMDBMovieSearchResult{}, false
+			search, err = client.SearchMovie(context.Background(), query, year)
+			if err == nil && len(search.Results) == 0 && year != 0 {
+				log.Printf("Nothing from %d, searching every year.\n", year)
+				year = 0
+				search, err = client.SearchMovie(context.Background(), query, 0)
 			}
-			defer resp.Body.Close()
-			body_bytes, err := ioutil.ReadAll(resp.Body)
-			common.CheckErr(err)
-			err = json.Unmarshal(body_bytes, &tmdb)
 			if err != nil {
-				log.Printf("Error decoding search response: %v\n", err)
-				log.Printf("Response Body: %s\n", string(body_bytes))
+				log.Printf("Error searching: %v\n", err)
 				return structs.TMDBMovieSearchResult{}, false
 			}
 
-			results = tmdb.Results
+			results = search.Results
 			len_results = len(results)
 			log.Printf(
 				"There are %d results for the query '%s'.\n",
@@ -252,53 +216,46 @@ func FindFilm(
 // Saves tmdb info json file of a film
 //
 func MakeTMDBFilmInfoFile(
-	client http.Client,
-	api_key string,
+	client *tmdb.Client,
 	id int,
 	file_path string,
 ) structs.TMDBMovie {
-	var tmdb structs.TMDBMovie
+	var movie structs.TMDBMovie
 	var blob []byte
 	var err error
 
 	log.Println("Getting Film Data.")
-	url := MOVIE_GET_URL + strconv.Itoa(id) + "?api_key=" + api_key
-	resp, err := client.Get(url)
-	common.CheckErr(err)
-	if NotOK(resp) {
-		log.Fatal("Reponse not OK")
-	}
-	defer resp.Body.Close()
-	blob, err = ioutil.ReadAll(resp.Body)
+	movie, err = client.Movie(context.Background(), id)
 	common.CheckErr(err)
 
 	// indent blob
-	err = json.Unmarshal(blob, &tmdb)
-	common.CheckErr(err)
-	blob, err = json.MarshalIndent(tmdb, "", common.INDENT)
+	blob, err = json.MarshalIndent(movie, "", common.INDENT)
 	common.CheckErr(err)
 
 	// save blob
 	log.Println("Saving Film Data.")
 	common.SaveBlob(blob, file_path)
 
-	return tmdb
+	return movie
 }
 
 //
 // Saves tmdb info json file of a collection and downloads its images.
 //
 func MakeTMDBCollectionInfoFile(
-	client http.Client,
-	tmdb structs.TMDBCollection,
+	client *tmdb.Client,
+	collection structs.TMDBCollection,
 ) {
 	var blob []byte
 	var err error
 
-	blob, err = json.MarshalIndent(tmdb, "", common.INDENT)
+	blob, err = json.MarshalIndent(collection, "", common.INDENT)
 	common.CheckErr(err)
 
-	collection_name := common.PosixFileName(tmdb.Name)
+	collection_name := common.Slug(
+		strings.Replace(collection.Name, " ", "", -1),
+		collection.Id,
+	)
 	collection_path := path.Join(COLLECTION_DIR, collection_name+".json")
 
 	if _, err := os.Stat(collection_path); err == nil {
@@ -308,66 +265,81 @@ func MakeTMDBCollectionInfoFile(
 		log.Printf("Saving the '%s' collection.\n", collection_name)
 		common.SaveBlob(blob, collection_path)
 
-		if tmdb.PosterPath != "" {
+		if collection.PosterPath != "" {
 			DownloadImage(
 				client,
-				tmdb.PosterPath,
-				path.Join(PICTURE_DIR, tmdb.PosterPath),
+				collection.PosterPath,
+				path.Join(PICTURE_DIR, collection.PosterPath),
 			)
 		}
-		if tmdb.BackdropPath != "" {
+		if collection.BackdropPath != "" {
 			DownloadImage(
 				client,
-				tmdb.BackdropPath,
-				path.Join(PICTURE_DIR, tmdb.BackdropPath),
+				collection.BackdropPath,
+				path.Join(PICTURE_DIR, collection.BackdropPath),
 			)
 		}
 	}
 }
 
+//
+// Gets the name of a film file's info file, without the extension
+//
+func InfoName(file string) string {
+	return strings.TrimSuffix(file, filepath.Ext(file))
+}
+
 //---------------------------------------------------------------------------
 // Main
 //---------------------------------------------------------------------------
 //
 func main() {
-	if len(os.Args) < 3 {
+	batch := flag.Bool("batch", false, "match without asking, leaving doubtful files for review")
+	threshold := flag.Float64("threshold", match.DEFAULT_THRESHOLD, "lowest score accepted in batch mode")
+	review_file := flag.String("review", DEFAULT_REVIEW_FILE, "file of matches to review")
+	resolve := flag.Bool("resolve", false, "resolve the review file")
+	tmdb_id := flag.Int("id", 0, "TMDB id of the film, saved for the files without searching")
+	flag.Parse()
+
+	if *resolve {
+		if flag.NArg() < 1 {
+			println("Please provide an API key.")
+			return
+		}
+	} else if flag.NArg() < 2 {
 		println("Please provide an API key and some film files to find.")
 		return
 	}
 	var err error
 
-	timeout := time.Duration(TIMEOUT * time.Second)
-	client := http.Client{
-		Timeout: timeout,
-	}
-
 	common.CheckDir(PICTURE_DIR)
 	common.CheckDir(COLLECTION_DIR)
 
-	api_key := os.Args[1]
-	for idx := 2; idx < len(os.Args); idx++ {
+	client := tmdb.NewClient(flag.Arg(0))
+	if *resolve {
+		ResolveReviews(client, *review_file)
+		return
+	}
+	if *batch {
+		BatchMatch(client, flag.Args()[1:], *threshold, *review_file)
+		return
+	}
 
-		query := strings.TrimSuffix(os.Args[idx], filepath.Ext(os.Args[idx]))
+	for _, file := range flag.Args()[1:] {
+		name := InfoName(file)
+		query, year := releasename.Query(file)
 
-		_, err = os.Stat(query + ".json")
-		if os.IsNotExist(err) {
-			tmdb_result, film_found := FindFilm(client, api_key, query)
+		_, err = os.Stat(name + ".json")
+		if os.IsNotExist(err) && *tmdb_id != 0 {
+			log.Printf("Using TMDB id %d for '%s'.\n", *tmdb_id, file)
+			PluckFilm(client, *tmdb_id, name+".json")
+		} else if os.IsNotExist(err) {
+			tmdb_result, film_found := FindFilm(client, query, year)
 			if film_found {
-				tmdb_film := MakeTMDBFilmInfoFile(
-					client,
-					api_key,
-					tmdb_result.Id,
-					query+".json",
-				)
-				if tmdb_film.BelongsToCollection.Name != "" {
-					MakeTMDBCollectionInfoFile(
-						client,
-						tmdb_film.BelongsToCollection,
-					)
-				}
+				PluckFilm(client, tmdb_result.Id, name+".json")
 			}
 		} else if err == nil {
-			log.Printf("Skipping '%s' (already has a json file).\n", query)
+			log.Printf("Skipping '%s' (already has a json file).\n", name)
 		} else {
 			log.Fatal(err)
 		}
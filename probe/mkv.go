@@ -0,0 +1,402 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"serviam/structs"
+	"strings"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// EBML element ids, with their length markers
+//
+const (
+	MKV_EBML          = 0x1A45DFA3
+	MKV_DOC_TYPE      = 0x4282
+	MKV_SEGMENT       = 0x18538067
+	MKV_INFO          = 0x1549A966
+	MKV_TIMESTAMP     = 0x2AD7B1
+	MKV_DURATION      = 0x4489
+	MKV_TRACKS        = 0x1654AE6B
+	MKV_TRACK_ENTRY   = 0xAE
+	MKV_TRACK_TYPE    = 0x83
+	MKV_CODEC_ID      = 0x86
+	MKV_LANGUAGE      = 0x22B59C
+	MKV_LANGUAGE_IETF = 0x22B59D
+	MKV_VIDEO         = 0xE0
+	MKV_PIXEL_WIDTH   = 0xB0
+	MKV_PIXEL_HEIGHT  = 0xBA
+	MKV_CHAPTERS      = 0x1043A770
+	MKV_EDITION       = 0x45B9
+	MKV_EDITION_FLAG  = 0x45DB
+	MKV_CHAPTER_ATOM  = 0xB6
+	MKV_CHAPTER_START = 0x91
+	MKV_CHAPTER_HIDE  = 0x98
+	MKV_CHAPTER_SHOW  = 0x80
+	MKV_CHAPTER_TITLE = 0x85
+)
+
+//
+// Track types
+//
+const (
+	MKV_VIDEO_TRACK    = 1
+	MKV_AUDIO_TRACK    = 2
+	MKV_SUBTITLE_TRACK = 17
+)
+
+//
+// Nanoseconds in a tick unless the segment says otherwise
+//
+const MKV_DEFAULT_TIMESTAMP = 1000000
+
+//
+// The most of a master element which is read at once,
+// clusters of video are never read so this is only for headers
+//
+const MKV_MAX_PAYLOAD = 16 << 20
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// An EBML element, its payload runs from Start to End.
+// Elements whose size isn't known run to the end of their parent.
+//
+type Element struct {
+	Id    uint64
+	Start int64
+	End   int64
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Reads a variable length integer,
+// keeping its length marker for ids and dropping it for sizes.
+// Sizes of all ones are unknown and given as -1.
+//
+func ReadVint(file io.ReaderAt, offset int64, is_id bool) (int64, int, error) {
+	first := make([]byte, 1)
+	_, err := file.ReadAt(first, offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	length := 1
+	for marker := byte(0x80); length <= 8 && first[0]&marker == 0; marker >>= 1 {
+		length++
+	}
+	if length > 8 || is_id && length > 4 {
+		return 0, 0, fmt.Errorf("bad element at %d", offset)
+	}
+
+	blob := make([]byte, length)
+	_, err = file.ReadAt(blob, offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !is_id {
+		blob[0] &= 0xff >> uint(length)
+	}
+	value := int64(0)
+	all_ones := true
+	for idx, part := range blob {
+		value = value<<8 | int64(part)
+		all_ones = all_ones && (part == 0xff || idx == 0 && part == 0xff>>uint(length))
+	}
+	if !is_id && all_ones {
+		return -1, length, nil
+	}
+	return value, length, nil
+}
+
+//
+// Reads the elements between two offsets.
+// Sizes past the end are cut short, while headers past it are an error.
+//
+func ReadElements(file io.ReaderAt, start int64, end int64) ([]Element, error) {
+	var elements []Element
+	for start < end {
+		id, id_length, err := ReadVint(file, start, true)
+		if err != nil {
+			return elements, err
+		}
+		size, size_length, err := ReadVint(file, start+int64(id_length), false)
+		if err != nil {
+			return elements, err
+		}
+		element := Element{Id: uint64(id), Start: start + int64(id_length+size_length)}
+		if element.Start > end {
+			return elements, fmt.Errorf("element %x at %d runs past its parent", id, start)
+		}
+		element.End = element.Start + size
+		if size < 0 || element.End > end {
+			element.End = end
+		}
+		elements = append(elements, element)
+		start = element.End
+	}
+	return elements, nil
+}
+
+//
+// Reads an element's payload
+//
+func ReadElementPayload(file io.ReaderAt, element Element) ([]byte, error) {
+	if element.End-element.Start > MKV_MAX_PAYLOAD {
+		return nil, fmt.Errorf("element %x at %d is too large", element.Id, element.Start)
+	}
+	payload := make([]byte, element.End-element.Start)
+	_, err := file.ReadAt(payload, element.Start)
+	return payload, err
+}
+
+//
+// Reads the children of a master element whose payload has been read
+//
+func Children(payload []byte) []Element {
+	// a damaged element only loses the children after it
+	elements, _ := ReadElements(bytes.NewReader(payload), 0, int64(len(payload)))
+	return elements
+}
+
+//
+// Gets the payload of an element whose parent's payload has been read
+//
+func Payload(parent []byte, element Element) []byte {
+	return parent[element.Start:element.End]
+}
+
+//
+// Reads a big endian unsigned integer of up to 8 bytes
+//
+func ReadUint(blob []byte) uint64 {
+	value := uint64(0)
+	for _, part := range blob {
+		value = value<<8 | uint64(part)
+	}
+	return value
+}
+
+//
+// Reads a float of 4 or 8 bytes
+//
+func ReadFloat(blob []byte) float64 {
+	switch len(blob) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(blob)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(blob))
+	}
+	return 0
+}
+
+//
+// Reads a string, which may be padded with zeros
+//
+func ReadString(blob []byte) string {
+	return strings.TrimRight(string(blob), "\x00")
+}
+
+//
+// Reads a track entry into the media info
+//
+func ReadTrackEntry(payload []byte, info *structs.MediaInfo) {
+	var track_type uint64
+	var codec string
+	var width, height int
+	language := "eng"
+	ietf_language := ""
+
+	for _, element := range Children(payload) {
+		value := Payload(payload, element)
+		switch element.Id {
+		case MKV_TRACK_TYPE:
+			track_type = ReadUint(value)
+		case MKV_CODEC_ID:
+			codec = ReadString(value)
+		case MKV_LANGUAGE:
+			language = ReadString(value)
+		case MKV_LANGUAGE_IETF:
+			ietf_language = ReadString(value)
+		case MKV_VIDEO:
+			for _, video_element := range Children(value) {
+				switch video_element.Id {
+				case MKV_PIXEL_WIDTH:
+					width = int(ReadUint(Payload(value, video_element)))
+				case MKV_PIXEL_HEIGHT:
+					height = int(ReadUint(Payload(value, video_element)))
+				}
+			}
+		}
+	}
+	if ietf_language != "" {
+		language = ietf_language
+	}
+
+	track := structs.TrackInfo{Codec: codec, Language: Language(language)}
+	switch track_type {
+	case MKV_VIDEO_TRACK:
+		if info.VideoCodec == "" {
+			info.VideoCodec = codec
+			info.Width = width
+			info.Height = height
+		}
+	case MKV_AUDIO_TRACK:
+		info.AudioTracks = append(info.AudioTracks, track)
+	case MKV_SUBTITLE_TRACK:
+		info.SubtitleTracks = append(info.SubtitleTracks, track)
+	}
+}
+
+//
+// Reads the chapters of an edition which aren't hidden,
+// titled by their first display
+//
+func ReadEdition(payload []byte) []structs.ChapterInfo {
+	var chapters []structs.ChapterInfo
+	for _, atom := range Children(payload) {
+		if atom.Id != MKV_CHAPTER_ATOM {
+			continue
+		}
+		atom_payload := Payload(payload, atom)
+		var chapter structs.ChapterInfo
+		hidden := false
+		for _, element := range Children(atom_payload) {
+			value := Payload(atom_payload, element)
+			switch element.Id {
+			case MKV_CHAPTER_START:
+				chapter.Start = float64(ReadUint(value)) / 1e9
+			case MKV_CHAPTER_HIDE:
+				hidden = ReadUint(value) == 1
+			case MKV_CHAPTER_SHOW:
+				for _, display := range Children(value) {
+					if display.Id == MKV_CHAPTER_TITLE && chapter.Title == "" {
+						chapter.Title = ReadString(Payload(value, display))
+					}
+				}
+			}
+		}
+		if !hidden {
+			chapters = append(chapters, chapter)
+		}
+	}
+	return chapters
+}
+
+//
+// Reads the chapters of the default edition, or the first one
+//
+func ReadChapters(payload []byte) []structs.ChapterInfo {
+	var chapters []structs.ChapterInfo
+	found := false
+	for _, edition := range Children(payload) {
+		if edition.Id != MKV_EDITION {
+			continue
+		}
+		edition_payload := Payload(payload, edition)
+		is_default := false
+		for _, element := range Children(edition_payload) {
+			if element.Id == MKV_EDITION_FLAG {
+				is_default = ReadUint(Payload(edition_payload, element)) == 1
+			}
+		}
+		if !found || is_default {
+			chapters = ReadEdition(edition_payload)
+		}
+		if is_default {
+			break
+		}
+		found = true
+	}
+	return chapters
+}
+
+//
+// Reads a Matroska or WebM file's duration, tracks and chapters
+// from the headers of its segment, skipping over its clusters
+//
+func ProbeMKV(location string) (structs.MediaInfo, error) {
+	info := structs.MediaInfo{Container: CONTAINER_MATROSKA}
+
+	file, err := os.Open(location)
+	if err != nil {
+		return info, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return info, err
+	}
+
+	elements, err := ReadElements(file, 0, stat.Size())
+	if len(elements) == 0 || elements[0].Id != MKV_EBML {
+		return info, fmt.Errorf("'%s' has no EBML header", location)
+	}
+	header, err := ReadElementPayload(file, elements[0])
+	if err != nil {
+		return info, err
+	}
+	for _, element := range Children(header) {
+		if element.Id == MKV_DOC_TYPE && ReadString(Payload(header, element)) == "webm" {
+			info.Container = CONTAINER_WEBM
+		}
+	}
+
+	var segment Element
+	found := false
+	for _, element := range elements {
+		if element.Id == MKV_SEGMENT {
+			segment, found = element, true
+			break
+		}
+	}
+	if !found {
+		return info, fmt.Errorf("'%s' has no segment", location)
+	}
+
+	// a file cut short can still be probed if its headers are whole
+	children, _ := ReadElements(file, segment.Start, segment.End)
+	for _, element := range children {
+		switch element.Id {
+		case MKV_INFO, MKV_TRACKS, MKV_CHAPTERS:
+		default:
+			continue
+		}
+		payload, err := ReadElementPayload(file, element)
+		if err != nil {
+			return info, err
+		}
+		switch element.Id {
+		case MKV_INFO:
+			timestamp := uint64(MKV_DEFAULT_TIMESTAMP)
+			duration := 0.0
+			for _, info_element := range Children(payload) {
+				switch info_element.Id {
+				case MKV_TIMESTAMP:
+					timestamp = ReadUint(Payload(payload, info_element))
+				case MKV_DURATION:
+					duration = ReadFloat(Payload(payload, info_element))
+				}
+			}
+			info.Duration = duration * float64(timestamp) / 1e9
+		case MKV_TRACKS:
+			for _, entry := range Children(payload) {
+				if entry.Id == MKV_TRACK_ENTRY {
+					ReadTrackEntry(Payload(payload, entry), &info)
+				}
+			}
+		case MKV_CHAPTERS:
+			info.Chapters = ReadChapters(payload)
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,284 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"serviam/structs"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// A WebM file's headers, with a VP9 video, French Opus sound
+// and an edition of chapters which isn't the default before one which is
+//
+var MKV_HEADERS = bytes.Join([][]byte{
+	MakeElement(MKV_EBML, MakeElement(MKV_DOC_TYPE, []byte("webm"))),
+	MakeElement(
+		MKV_SEGMENT,
+		MakeElement(
+			MKV_INFO,
+			MakeUintElement(MKV_TIMESTAMP, 1000000),
+			MakeFloatElement(MKV_DURATION, 90000),
+		),
+		MakeElement(
+			MKV_TRACKS,
+			MakeElement(
+				MKV_TRACK_ENTRY,
+				MakeUintElement(MKV_TRACK_TYPE, MKV_VIDEO_TRACK),
+				MakeElement(MKV_CODEC_ID, []byte("V_VP9")),
+				MakeElement(
+					MKV_VIDEO,
+					MakeUintElement(MKV_PIXEL_WIDTH, 1920),
+					MakeUintElement(MKV_PIXEL_HEIGHT, 1080),
+				),
+			),
+			MakeElement(
+				MKV_TRACK_ENTRY,
+				MakeUintElement(MKV_TRACK_TYPE, MKV_AUDIO_TRACK),
+				MakeElement(MKV_CODEC_ID, []byte("A_OPUS")),
+				MakeElement(MKV_LANGUAGE, []byte("fre\x00")),
+			),
+		),
+		MakeElement(
+			MKV_CHAPTERS,
+			MakeElement(MKV_EDITION, MakeChapterElement(0, "Other", false)),
+			MakeElement(
+				MKV_EDITION,
+				MakeUintElement(MKV_EDITION_FLAG, 1),
+				MakeChapterElement(0, "Start", false),
+				MakeChapterElement(30e9, "Hidden", true),
+				MakeChapterElement(60e9, "End", false),
+			),
+		),
+	),
+}, nil)
+
+//
+// What should be probed from MKV_HEADERS
+//
+var MKV_INFO_WANTED = structs.MediaInfo{
+	Container:   CONTAINER_WEBM,
+	Duration:    90,
+	Width:       1920,
+	Height:      1080,
+	VideoCodec:  "V_VP9",
+	AudioTracks: []structs.TrackInfo{{Codec: "A_OPUS", Language: "fre"}},
+	Chapters:    []structs.ChapterInfo{{Start: 0, Title: "Start"}, {Start: 60, Title: "End"}},
+}
+
+//
+// files and what should be probed from them,
+// or whether probing them should fail
+//
+var PROBE_MKV_CASES = []struct {
+	name  string
+	blob  []byte
+	info  structs.MediaInfo
+	fails bool
+}{
+	{"whole headers", MKV_HEADERS, MKV_INFO_WANTED, false},
+	{
+		"headers followed by a cluster cut short",
+		append(append([]byte(nil), MKV_HEADERS...), 0x1F, 0x43, 0xB6, 0x75, 0x01, 0, 0),
+		MKV_INFO_WANTED,
+		false,
+	},
+	{"nothing", nil, structs.MediaInfo{}, true},
+	{"not EBML", []byte("RIFF....AVI LIST"), structs.MediaInfo{}, true},
+	{"no segment", MakeElement(MKV_EBML), structs.MediaInfo{}, true},
+	{
+		"an element id which is too long",
+		append(MakeElement(MKV_EBML), 0x08, 0, 0, 0, 0),
+		structs.MediaInfo{},
+		true,
+	},
+	{
+		"a segment header cut short",
+		append(MakeElement(MKV_EBML), 0x18, 0x53, 0x80, 0x67, 0x01, 0),
+		structs.MediaInfo{},
+		true,
+	},
+	{
+		"a size past the end of its parent stops there",
+		append(
+			MakeElement(MKV_EBML, []byte{0x42, 0x82, 0x40, 0x10, 'w', 'e', 'b', 'm'}),
+			MakeElement(MKV_SEGMENT)...,
+		),
+		structs.MediaInfo{Container: CONTAINER_WEBM},
+		false,
+	},
+	{
+		"an element header past the end of its parent",
+		append(
+			MakeElement(MKV_EBML),
+			append(MakeElement(MKV_SEGMENT, []byte{0x15, 0x49}), 0xA9, 0x66, 0x81, 0)...,
+		),
+		structs.MediaInfo{Container: CONTAINER_MATROSKA},
+		false,
+	},
+	{
+		"a segment of an unknown size",
+		append(
+			MakeElement(MKV_EBML),
+			append(
+				[]byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+				MakeElement(MKV_INFO, MakeFloatElement(MKV_DURATION, 5000))...,
+			)...,
+		),
+		structs.MediaInfo{Container: CONTAINER_MATROSKA, Duration: 5},
+		false,
+	},
+}
+
+//
+// master element payloads and the elements which should be read from them,
+// or whether reading them should fail
+//
+var READ_ELEMENTS_CASES = []struct {
+	name     string
+	blob     []byte
+	elements []Element
+	fails    bool
+}{
+	{
+		"two elements",
+		[]byte{0x86, 0x81, 'x', 0x83, 0x81, 1},
+		[]Element{{MKV_CODEC_ID, 2, 3}, {MKV_TRACK_TYPE, 5, 6}},
+		false,
+	},
+	{
+		"a size of all ones runs to the end",
+		[]byte{0x86, 0xff, 'x', 'y'},
+		[]Element{{MKV_CODEC_ID, 2, 4}},
+		false,
+	},
+	{
+		"a size past the end stops at the end",
+		[]byte{0x86, 0x85, 'x'},
+		[]Element{{MKV_CODEC_ID, 2, 3}},
+		false,
+	},
+	{"an id of zeros", []byte{0x00, 0x81, 1}, nil, true},
+	{"a size cut short", []byte{0x86, 0x40}, nil, true},
+	{"a size of zeros", []byte{0x86, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}, nil, true},
+}
+
+//---------------------------------------------------------------------------
+// Helper Functions
+//---------------------------------------------------------------------------
+//
+// Makes an element whose size is written in 8 bytes,
+// with a payload which may be shorter than its size
+//
+func MakeSizedElement(id uint64, size uint64, payload []byte) []byte {
+	var element []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if id>>uint(shift) > 0 {
+			element = append(element, byte(id>>uint(shift)))
+		}
+	}
+	size_blob := make([]byte, 8)
+	binary.BigEndian.PutUint64(size_blob, size)
+	size_blob[0] = 0x01
+	element = append(element, size_blob...)
+	return append(element, payload...)
+}
+
+//
+// Makes an element holding the payloads given one after another
+//
+func MakeElement(id uint64, payloads ...[]byte) []byte {
+	payload := bytes.Join(payloads, nil)
+	return MakeSizedElement(id, uint64(len(payload)), payload)
+}
+
+//
+// Makes an element holding an unsigned integer
+//
+func MakeUintElement(id uint64, value uint64) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, value)
+	return MakeElement(id, payload)
+}
+
+//
+// Makes an element holding a float
+//
+func MakeFloatElement(id uint64, value float64) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, math.Float64bits(value))
+	return MakeElement(id, payload)
+}
+
+//
+// Makes a chapter atom starting at a time in nanoseconds
+//
+func MakeChapterElement(start uint64, title string, hidden bool) []byte {
+	hide := uint64(0)
+	if hidden {
+		hide = 1
+	}
+	return MakeElement(
+		MKV_CHAPTER_ATOM,
+		MakeUintElement(MKV_CHAPTER_START, start),
+		MakeUintElement(MKV_CHAPTER_HIDE, hide),
+		MakeElement(MKV_CHAPTER_SHOW, MakeElement(MKV_CHAPTER_TITLE, []byte(title))),
+	)
+}
+
+//---------------------------------------------------------------------------
+// Tests
+//---------------------------------------------------------------------------
+//
+func TestReadElements(t *testing.T) {
+	for _, read_case := range READ_ELEMENTS_CASES {
+		file := bytes.NewReader(read_case.blob)
+		elements, err := ReadElements(file, 0, int64(len(read_case.blob)))
+		if read_case.fails {
+			if err == nil {
+				t.Errorf("%s: read %v, want an error", read_case.name, elements)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", read_case.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(elements, read_case.elements) {
+			t.Errorf("%s: read %v, want %v", read_case.name, elements, read_case.elements)
+		}
+	}
+}
+
+func TestProbeMKV(t *testing.T) {
+	dir := t.TempDir()
+	for idx, probe_case := range PROBE_MKV_CASES {
+		location := filepath.Join(dir, string(rune('a'+idx))+".mkv")
+		err := ioutil.WriteFile(location, probe_case.blob, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := ProbeMKV(location)
+		if probe_case.fails {
+			if err == nil {
+				t.Errorf("%s: probed %+v, want an error", probe_case.name, info)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", probe_case.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(info, probe_case.info) {
+			t.Errorf("%s: probed %+v, want %+v", probe_case.name, info, probe_case.info)
+		}
+	}
+}
@@ -0,0 +1,655 @@
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"serviam/structs"
+	"unicode/utf16"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Boxes only holding other boxes, which are walked into
+//
+var MP4_CONTAINER_BOXES = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+	"mvex": true,
+	"tref": true,
+	"udta": true,
+}
+
+//
+// Track handlers, from a track's hdlr box
+//
+const (
+	MP4_VIDEO_HANDLER = "vide"
+	MP4_AUDIO_HANDLER = "soun"
+)
+
+var MP4_SUBTITLE_HANDLERS = map[string]bool{
+	"sbtl": true,
+	"subt": true,
+	"text": true,
+	"clcp": true,
+}
+
+//
+// The most of a box's payload which is read, stsd boxes can be large
+//
+const MP4_MAX_PAYLOAD = 1 << 20
+
+//
+// The most of a chapter title sample which is read
+//
+const MP4_MAX_TITLE = 1024
+
+//
+// The most chapters read from a chapter track, one for each sample.
+// Samples of the same size are only counted in the sample table,
+// so a broken count would otherwise make billions of them.
+//
+const MP4_MAX_CHAPTERS = 10000
+
+//
+// The deepest boxes are nested in other boxes,
+// real files go no deeper than moov.trak.mdia.minf.stbl
+//
+const MP4_MAX_DEPTH = 16
+
+//
+// Ticks in a second of Nero chapter start times
+//
+const MP4_CHPL_TIMESCALE = 10000000
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// An ISO base media file format box,
+// its payload runs from Start to End in the file
+//
+type Box struct {
+	Type     string
+	Start    int64
+	End      int64
+	Children []Box
+}
+
+//
+// What is read from a trak box
+//
+type MP4Track struct {
+	Box       Box
+	Id        uint64
+	Chapters  []uint64
+	Handler   string
+	Codec     string
+	Language  string
+	Width     int
+	Height    int
+	Timescale uint64
+	Duration  uint64
+}
+
+//
+// Where a sample of a track is and when it starts, in the track's timescale
+//
+type MP4Sample struct {
+	Time   uint64
+	Offset int64
+	Size   uint64
+}
+
+//
+// Chunks from First on, until the next run, which have the same number of samples
+//
+type MP4ChunkRun struct {
+	First   uint64
+	Samples uint64
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Reads the boxes between two offsets of a file,
+// walking into the ones which only hold other boxes,
+// depth boxes deep already.
+// Other boxes' payloads, such as the film's mdat, are skipped over.
+//
+func ReadBoxes(file io.ReaderAt, start int64, end int64, depth int) ([]Box, error) {
+	var boxes []Box
+	header := make([]byte, 16)
+
+	if depth > MP4_MAX_DEPTH {
+		return boxes, fmt.Errorf("boxes nested over %d deep at %d", MP4_MAX_DEPTH, start)
+	}
+	for start+8 <= end {
+		_, err := file.ReadAt(header[:8], start)
+		if err != nil {
+			return boxes, err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		box := Box{Type: string(header[4:8]), Start: start + 8}
+		switch size {
+		case 0:
+			size = end - start
+		case 1:
+			_, err = file.ReadAt(header[8:16], start+8)
+			if err != nil {
+				return boxes, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			box.Start = start + 16
+		}
+		if size < box.Start-start || size > end-start {
+			return boxes, fmt.Errorf("bad %q box at %d", box.Type, start)
+		}
+		box.End = start + size
+
+		if MP4_CONTAINER_BOXES[box.Type] {
+			box.Children, err = ReadBoxes(file, box.Start, box.End, depth+1)
+			if err != nil {
+				return boxes, err
+			}
+		}
+		boxes = append(boxes, box)
+		start = box.End
+	}
+	return boxes, nil
+}
+
+//
+// Finds the first box of a type among boxes
+//
+func FindBox(boxes []Box, box_type string) (Box, bool) {
+	for _, box := range boxes {
+		if box.Type == box_type {
+			return box, true
+		}
+	}
+	return Box{}, false
+}
+
+//
+// Finds a box by the types of the boxes leading to it
+//
+func FindBoxPath(boxes []Box, box_types ...string) (Box, bool) {
+	var box Box
+	found := false
+	for _, box_type := range box_types {
+		box, found = FindBox(boxes, box_type)
+		if !found {
+			return box, false
+		}
+		boxes = box.Children
+	}
+	return box, found
+}
+
+//
+// Reads a box's payload, or as much of it as is ever needed
+//
+func ReadPayload(file io.ReaderAt, box Box) (*FieldReader, error) {
+	size := box.End - box.Start
+	if size > MP4_MAX_PAYLOAD {
+		size = MP4_MAX_PAYLOAD
+	}
+	payload := make([]byte, size)
+	_, err := file.ReadAt(payload, box.Start)
+	return NewFieldReader(payload), err
+}
+
+//
+// Reads a full box's version, skipping its flags
+//
+func ReadVersion(reader *FieldReader) uint64 {
+	version := reader.Uint(1)
+	reader.Skip(3)
+	return version
+}
+
+//
+// Reads a timescale and duration from an mvhd or mdhd box,
+// whose times are 32 bits in version 0 and 64 in version 1
+//
+func ReadTimes(reader *FieldReader) (uint64, uint64) {
+	time_size := 4
+	if ReadVersion(reader) == 1 {
+		time_size = 8
+	}
+	reader.Skip(2 * time_size)
+	timescale := reader.Uint(4)
+	duration := reader.Uint(time_size)
+	if time_size == 4 && duration == 0xffffffff {
+		duration = 0
+	}
+	return timescale, duration
+}
+
+//
+// Unpacks an mdhd box's language, three letters of 5 bits each
+//
+func UnpackLanguage(packed uint64) string {
+	if packed == 0 || packed == 0x7fff {
+		return ""
+	}
+	letters := []byte{
+		byte(packed>>10&0x1f) + 0x60,
+		byte(packed>>5&0x1f) + 0x60,
+		byte(packed&0x1f) + 0x60,
+	}
+	return string(letters)
+}
+
+//
+// Reads a track's handler, codec, language, dimensions and duration
+//
+func ReadMP4Track(file io.ReaderAt, trak Box) (MP4Track, error) {
+	track := MP4Track{Box: trak}
+
+	if box, found := FindBox(trak.Children, "tkhd"); found {
+		reader, err := ReadPayload(file, box)
+		if err != nil {
+			return track, err
+		}
+		time_size := 4
+		if ReadVersion(reader) == 1 {
+			time_size = 8
+		}
+		reader.Skip(2 * time_size)
+		track.Id = reader.Uint(4)
+		reader.Skip(4 + time_size)
+		// reserved, layer, alternate group, volume, reserved and matrix
+		reader.Skip(8 + 2 + 2 + 2 + 2 + 36)
+		track.Width = int(reader.Uint(4) >> 16)
+		track.Height = int(reader.Uint(4) >> 16)
+	}
+
+	if box, found := FindBoxPath(trak.Children, "mdia", "mdhd"); found {
+		reader, err := ReadPayload(file, box)
+		if err != nil {
+			return track, err
+		}
+		track.Timescale, track.Duration = ReadTimes(reader)
+		track.Language = UnpackLanguage(reader.Uint(2))
+	}
+
+	if box, found := FindBoxPath(trak.Children, "mdia", "hdlr"); found {
+		reader, err := ReadPayload(file, box)
+		if err != nil {
+			return track, err
+		}
+		ReadVersion(reader)
+		reader.Skip(4)
+		track.Handler = reader.String(4)
+	}
+
+	// tracks holding this track's chapter titles
+	if box, found := FindBoxPath(trak.Children, "tref", "chap"); found {
+		reader, err := ReadPayload(file, box)
+		if err != nil {
+			return track, err
+		}
+		for chapters := reader.Uint(4); !reader.Short(); chapters = reader.Uint(4) {
+			track.Chapters = append(track.Chapters, chapters)
+		}
+	}
+
+	// extended languages, such as "pt-BR", override the packed one
+	if box, found := FindBoxPath(trak.Children, "mdia", "elng"); found {
+		reader, err := ReadPayload(file, box)
+		if err != nil {
+			return track, err
+		}
+		ReadVersion(reader)
+		track.Language = reader.Rest()
+	}
+
+	// the first sample entry's type is the codec
+	if box, found := FindBoxPath(trak.Children, "mdia", "minf", "stbl", "stsd"); found {
+		reader, err := ReadPayload(file, box)
+		if err != nil {
+			return track, err
+		}
+		ReadVersion(reader)
+		if reader.Uint(4) > 0 {
+			reader.Skip(4)
+			track.Codec = reader.String(4)
+			if track.Handler == MP4_VIDEO_HANDLER && track.Width == 0 {
+				// reserved, data reference index and pre-defined
+				reader.Skip(6 + 2 + 16)
+				track.Width = int(reader.Uint(2))
+				track.Height = int(reader.Uint(2))
+			}
+		}
+	}
+	return track, nil
+}
+
+//
+// Reads a full box found by the types of the boxes leading to it,
+// skipping its version and flags
+//
+func ReadFullBox(
+	file io.ReaderAt,
+	boxes []Box,
+	box_types ...string,
+) (
+	*FieldReader,
+	bool,
+	error,
+) {
+	box, found := FindBoxPath(boxes, box_types...)
+	if !found {
+		return nil, false, nil
+	}
+	reader, err := ReadPayload(file, box)
+	if err == nil {
+		ReadVersion(reader)
+	}
+	return reader, true, err
+}
+
+//
+// Reads where a track's first max_samples samples are and when they start
+// from its sample table
+//
+func ReadMP4Samples(file io.ReaderAt, trak Box, max_samples uint64) ([]MP4Sample, error) {
+	var samples []MP4Sample
+	stbl := []string{"mdia", "minf", "stbl"}
+
+	// sizes, all the same if one is given
+	reader, found, err := ReadFullBox(file, trak.Children, append(stbl, "stsz")...)
+	if !found || err != nil {
+		return samples, err
+	}
+	sample_size := reader.Uint(4)
+	num_samples := reader.Uint(4)
+	if num_samples > max_samples {
+		num_samples = max_samples
+	}
+	for idx := uint64(0); idx < num_samples; idx++ {
+		sample := MP4Sample{Size: sample_size}
+		if sample_size == 0 {
+			sample.Size = reader.Uint(4)
+		}
+		if reader.Short() {
+			break
+		}
+		samples = append(samples, sample)
+	}
+
+	// start times, from runs of samples of the same duration
+	reader, found, err = ReadFullBox(file, trak.Children, append(stbl, "stts")...)
+	if !found || err != nil {
+		return nil, err
+	}
+	time := uint64(0)
+	sample_idx := 0
+	for num_runs := reader.Uint(4); num_runs > 0; num_runs-- {
+		run_length := reader.Uint(4)
+		delta := reader.Uint(4)
+		if reader.Short() {
+			break
+		}
+		for ; run_length > 0 && sample_idx < len(samples); run_length-- {
+			samples[sample_idx].Time = time
+			time += delta
+			sample_idx++
+		}
+	}
+
+	// chunk offsets, 32 or 64 bits
+	var chunks []int64
+	offset_size := 4
+	reader, found, err = ReadFullBox(file, trak.Children, append(stbl, "stco")...)
+	if !found && err == nil {
+		offset_size = 8
+		reader, found, err = ReadFullBox(file, trak.Children, append(stbl, "co64")...)
+	}
+	if !found || err != nil {
+		return nil, err
+	}
+	for num_chunks := reader.Uint(4); num_chunks > 0; num_chunks-- {
+		chunk := int64(reader.Uint(offset_size))
+		if reader.Short() {
+			break
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	// runs of chunks with the same number of samples,
+	// each run lasting until the next one's first chunk
+	reader, found, err = ReadFullBox(file, trak.Children, append(stbl, "stsc")...)
+	if !found || err != nil {
+		return nil, err
+	}
+	var runs []MP4ChunkRun
+	for num_runs := reader.Uint(4); num_runs > 0; num_runs-- {
+		run := MP4ChunkRun{First: reader.Uint(4), Samples: reader.Uint(4)}
+		reader.Skip(4)
+		if reader.Short() {
+			break
+		}
+		if run.First == 0 || (len(runs) > 0 && run.First <= runs[len(runs)-1].First) {
+			return nil, fmt.Errorf("stsc chunk run starting at %d is out of order", run.First)
+		}
+		runs = append(runs, run)
+	}
+	sample_idx = 0
+	for run_idx, run := range runs {
+		if sample_idx == len(samples) {
+			break
+		}
+		last_chunk := uint64(len(chunks))
+		if run_idx+1 < len(runs) && runs[run_idx+1].First-1 < last_chunk {
+			last_chunk = runs[run_idx+1].First - 1
+		}
+		for chunk := run.First; chunk <= last_chunk && sample_idx < len(samples); chunk++ {
+			offset := chunks[chunk-1]
+			for idx := uint64(0); idx < run.Samples && sample_idx < len(samples); idx++ {
+				samples[sample_idx].Offset = offset
+				offset += int64(samples[sample_idx].Size)
+				sample_idx++
+			}
+		}
+	}
+	return samples[:sample_idx], nil
+}
+
+//
+// Reads a QuickTime text sample, a length and then UTF-8 or UTF-16 text
+//
+func ReadMP4Text(file io.ReaderAt, sample MP4Sample) (string, error) {
+	size := sample.Size
+	if size > MP4_MAX_TITLE {
+		size = MP4_MAX_TITLE
+	}
+	blob := make([]byte, size)
+	_, err := file.ReadAt(blob, sample.Offset)
+	if err != nil {
+		return "", err
+	}
+	reader := NewFieldReader(blob)
+	text := reader.Bytes(int(reader.Uint(2)))
+	if text == nil {
+		text = blob[reader.offset:]
+	}
+	if len(text) >= 2 && text[0] == 0xfe && text[1] == 0xff {
+		var units []uint16
+		for idx := 2; idx+1 < len(text); idx += 2 {
+			units = append(units, binary.BigEndian.Uint16(text[idx:]))
+		}
+		return string(utf16.Decode(units)), nil
+	}
+	return string(text), nil
+}
+
+//
+// Reads the chapters held in a QuickTime text track,
+// one sample for each chapter
+//
+func ReadMP4TextChapters(file io.ReaderAt, track MP4Track) ([]structs.ChapterInfo, error) {
+	var chapters []structs.ChapterInfo
+	if track.Timescale == 0 {
+		return chapters, nil
+	}
+	samples, err := ReadMP4Samples(file, track.Box, MP4_MAX_CHAPTERS)
+	if err != nil {
+		return chapters, err
+	}
+	for _, sample := range samples {
+		title, err := ReadMP4Text(file, sample)
+		if err != nil {
+			return chapters, err
+		}
+		chapters = append(chapters, structs.ChapterInfo{
+			Start: float64(sample.Time) / float64(track.Timescale),
+			Title: title,
+		})
+	}
+	return chapters, nil
+}
+
+//
+// Reads the chapters of a Nero chpl box
+//
+func ReadMP4NeroChapters(file io.ReaderAt, moov Box) ([]structs.ChapterInfo, error) {
+	var chapters []structs.ChapterInfo
+	box, found := FindBoxPath(moov.Children, "udta", "chpl")
+	if !found {
+		return chapters, nil
+	}
+	reader, err := ReadPayload(file, box)
+	if err != nil {
+		return chapters, err
+	}
+	if ReadVersion(reader) > 0 {
+		reader.Skip(4)
+	}
+	for num_chapters := reader.Uint(1); num_chapters > 0; num_chapters-- {
+		start := reader.Uint(8)
+		title := reader.String(int(reader.Uint(1)))
+		if reader.Short() {
+			break
+		}
+		chapters = append(chapters, structs.ChapterInfo{
+			Start: float64(start) / MP4_CHPL_TIMESCALE,
+			Title: title,
+		})
+	}
+	return chapters, nil
+}
+
+//
+// Reads an MP4's duration, dimensions, tracks and chapters from its moov box
+//
+func ProbeMP4(location string) (structs.MediaInfo, error) {
+	info := structs.MediaInfo{Container: CONTAINER_MP4}
+
+	file, err := os.Open(location)
+	if err != nil {
+		return info, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return info, err
+	}
+
+	// a file cut short can still be probed if its moov box is whole
+	boxes, err := ReadBoxes(file, 0, stat.Size(), 0)
+	moov, found := FindBox(boxes, "moov")
+	if !found && err != nil {
+		return info, err
+	}
+	if !found {
+		return info, fmt.Errorf("'%s' has no moov box", location)
+	}
+
+	if box, found := FindBox(moov.Children, "mvhd"); found {
+		reader, err := ReadPayload(file, box)
+		if err != nil {
+			return info, err
+		}
+		timescale, duration := ReadTimes(reader)
+		if timescale > 0 {
+			info.Duration = float64(duration) / float64(timescale)
+		}
+		// fragmented files give the whole duration in mvex
+		if box, found := FindBoxPath(moov.Children, "mvex", "mehd"); found {
+			reader, err = ReadPayload(file, box)
+			if err != nil {
+				return info, err
+			}
+			size := 4
+			if ReadVersion(reader) == 1 {
+				size = 8
+			}
+			if fragment_duration := reader.Uint(size); timescale > 0 && duration == 0 {
+				info.Duration = float64(fragment_duration) / float64(timescale)
+			}
+		}
+	}
+
+	var tracks []MP4Track
+	chapter_tracks := make(map[uint64]bool)
+	for _, trak := range moov.Children {
+		if trak.Type != "trak" {
+			continue
+		}
+		track, err := ReadMP4Track(file, trak)
+		if err != nil {
+			return info, err
+		}
+		tracks = append(tracks, track)
+		for _, chapters := range track.Chapters {
+			chapter_tracks[chapters] = true
+		}
+	}
+
+	// QuickTime chapters, or else Nero ones.
+	// Chapters which can't be read are left out rather than failing the probe.
+	for _, track := range tracks {
+		if chapter_tracks[track.Id] && len(info.Chapters) == 0 {
+			info.Chapters, _ = ReadMP4TextChapters(file, track)
+		}
+	}
+	if len(info.Chapters) == 0 {
+		info.Chapters, _ = ReadMP4NeroChapters(file, moov)
+	}
+
+	for _, track := range tracks {
+		if info.Duration == 0 && track.Timescale > 0 {
+			info.Duration = float64(track.Duration) / float64(track.Timescale)
+		}
+		switch {
+		case track.Handler == MP4_VIDEO_HANDLER:
+			if info.VideoCodec == "" {
+				info.VideoCodec = track.Codec
+				info.Width = track.Width
+				info.Height = track.Height
+			}
+		case track.Handler == MP4_AUDIO_HANDLER:
+			info.AudioTracks = append(info.AudioTracks, structs.TrackInfo{
+				Codec:    track.Codec,
+				Language: Language(track.Language),
+			})
+		case MP4_SUBTITLE_HANDLERS[track.Handler] && !chapter_tracks[track.Id]:
+			info.SubtitleTracks = append(info.SubtitleTracks, structs.TrackInfo{
+				Codec:    track.Codec,
+				Language: Language(track.Language),
+			})
+		}
+	}
+	return info, nil
+}
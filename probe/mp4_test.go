@@ -0,0 +1,336 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// files and the boxes which should be read from them,
+// or whether reading them should fail
+//
+var READ_BOXES_CASES = []struct {
+	name  string
+	blob  []byte
+	types []string
+	fails bool
+}{
+	{
+		"boxes in boxes",
+		append(MakeBox("ftyp", []byte("isom")), MakeBox("moov", MakeBox("mvhd"), MakeBox("trak"))...),
+		[]string{"ftyp", "moov", "mvhd", "trak"},
+		false,
+	},
+	{
+		"a size of 0 runs to the end",
+		append(MakeBox("ftyp"), 0, 0, 0, 0, 'm', 'd', 'a', 't', 1, 2, 3),
+		[]string{"ftyp", "mdat"},
+		false,
+	},
+	{
+		"a 64 bit size",
+		[]byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0, 0, 0, 0, 0, 0, 0, 18, 1, 2},
+		[]string{"mdat"},
+		false,
+	},
+	{
+		"a header cut short is left alone",
+		append(MakeBox("ftyp"), 0, 0, 0),
+		[]string{"ftyp"},
+		false,
+	},
+	{
+		"a box past the end",
+		[]byte{0, 0, 0, 64, 'm', 'o', 'o', 'v', 0, 0, 0, 8, 'f', 'r', 'e', 'e'},
+		nil,
+		true,
+	},
+	{
+		"a box smaller than its header",
+		[]byte{0, 0, 0, 4, 'f', 'r', 'e', 'e', 0, 0, 0, 0},
+		nil,
+		true,
+	},
+	{
+		"a 64 bit size past the end",
+		[]byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0x7f, 0, 0, 0, 0, 0, 0, 0},
+		nil,
+		true,
+	},
+	{
+		"a 64 bit size cut short",
+		[]byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0, 0},
+		nil,
+		true,
+	},
+	{
+		"a box past the end of the box holding it",
+		MakeBox("moov", []byte{0, 0, 0, 64, 't', 'r', 'a', 'k'}),
+		nil,
+		true,
+	},
+	{
+		"boxes nested as deep as they can be",
+		NestBoxes("moov", MP4_MAX_DEPTH),
+		nil,
+		false,
+	},
+	{
+		"boxes nested too deep",
+		NestBoxes("moov", MP4_MAX_DEPTH+1),
+		nil,
+		true,
+	},
+}
+
+//
+// sample tables and the samples which should be read from them,
+// or whether reading them should fail
+//
+var READ_SAMPLES_CASES = []struct {
+	name    string
+	trak    []byte
+	samples []MP4Sample
+	fails   bool
+}{
+	{
+		"two chunks of two samples",
+		MakeTrak(
+			MakeFullBox("stsz", 0, 4, 10, 20, 30, 40),
+			MakeFullBox("stts", 1, 4, 100),
+			MakeFullBox("stco", 2, 1000, 2000),
+			MakeFullBox("stsc", 1, 1, 2, 1),
+		),
+		[]MP4Sample{{0, 1000, 10}, {100, 1010, 20}, {200, 2000, 30}, {300, 2030, 40}},
+		false,
+	},
+	{
+		"runs of chunks with different numbers of samples",
+		MakeTrak(
+			MakeFullBox("stsz", 5, 3),
+			MakeFullBox("stts", 2, 1, 10, 2, 20),
+			MakeFullBox("stco", 2, 1000, 2000),
+			MakeFullBox("stsc", 2, 1, 1, 1, 2, 2, 1),
+		),
+		[]MP4Sample{{0, 1000, 5}, {10, 2000, 5}, {30, 2005, 5}},
+		false,
+	},
+	{
+		"more samples than the chunks hold",
+		MakeTrak(
+			MakeFullBox("stsz", 5, 4),
+			MakeFullBox("stts", 1, 4, 10),
+			MakeFullBox("stco", 1, 1000),
+			MakeFullBox("stsc", 1, 1, 2, 1),
+		),
+		[]MP4Sample{{0, 1000, 5}, {10, 1005, 5}},
+		false,
+	},
+	{
+		"a chunk run past the chunks",
+		MakeTrak(
+			MakeFullBox("stsz", 5, 2),
+			MakeFullBox("stts", 1, 2, 10),
+			MakeFullBox("stco", 1, 1000),
+			MakeFullBox("stsc", 2, 1, 1, 1, 5, 1, 1),
+		),
+		[]MP4Sample{{0, 1000, 5}},
+		false,
+	},
+	{
+		"more runs of samples than samples",
+		MakeTrak(
+			MakeFullBox("stsz", 5, 1),
+			MakeFullBox("stts", 1, 1000000, 10),
+			MakeFullBox("stco", 3, 1000, 2000, 3000),
+			MakeFullBox("stsc", 1, 1, 1000000, 1),
+		),
+		[]MP4Sample{{0, 1000, 5}},
+		false,
+	},
+	{
+		"sample sizes cut short",
+		MakeTrak(
+			MakeFullBox("stsz", 0, 4, 10),
+			MakeFullBox("stts", 1, 4, 10),
+			MakeFullBox("stco", 1, 1000),
+			MakeFullBox("stsc", 1, 1, 4, 1),
+		),
+		[]MP4Sample{{0, 1000, 10}},
+		false,
+	},
+	{
+		"chunk offsets cut short",
+		MakeTrak(
+			MakeFullBox("stsz", 5, 2),
+			MakeFullBox("stts", 1, 2, 10),
+			MakeFullBox("stco", 2, 1000),
+			MakeFullBox("stsc", 1, 1, 1, 1),
+		),
+		[]MP4Sample{{0, 1000, 5}},
+		false,
+	},
+	{
+		"chunk runs cut short",
+		MakeTrak(
+			MakeFullBox("stsz", 5, 2),
+			MakeFullBox("stts", 1, 2, 10),
+			MakeFullBox("stco", 2, 1000, 2000),
+			MakeFullBox("stsc", 2, 1, 1, 1, 2),
+		),
+		[]MP4Sample{{0, 1000, 5}, {10, 2000, 5}},
+		false,
+	},
+	{
+		"no chunk offsets",
+		MakeTrak(
+			MakeFullBox("stsz", 5, 1),
+			MakeFullBox("stts", 1, 1, 10),
+			MakeFullBox("stsc", 1, 1, 1, 1),
+		),
+		nil,
+		false,
+	},
+	{
+		"a chunk run starting at 0",
+		MakeTrak(
+			MakeFullBox("stsz", 5, 1),
+			MakeFullBox("stts", 1, 1, 10),
+			MakeFullBox("stco", 1, 1000),
+			MakeFullBox("stsc", 1, 0, 1, 1),
+		),
+		nil,
+		true,
+	},
+	{
+		"chunk runs out of order",
+		MakeTrak(
+			MakeFullBox("stsz", 5, 2),
+			MakeFullBox("stts", 1, 2, 10),
+			MakeFullBox("stco", 2, 1000, 2000),
+			MakeFullBox("stsc", 2, 2, 1, 1, 1, 1, 1),
+		),
+		nil,
+		true,
+	},
+	{
+		"chunk runs starting at the same chunk",
+		MakeTrak(
+			MakeFullBox("stsz", 5, 2),
+			MakeFullBox("stts", 1, 2, 10),
+			MakeFullBox("stco", 2, 1000, 2000),
+			MakeFullBox("stsc", 2, 1, 1, 1, 1, 1, 1),
+		),
+		nil,
+		true,
+	},
+}
+
+//---------------------------------------------------------------------------
+// Helper Functions
+//---------------------------------------------------------------------------
+//
+// Makes a box of a type holding the payloads given one after another
+//
+func MakeBox(box_type string, payloads ...[]byte) []byte {
+	payload := bytes.Join(payloads, nil)
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], box_type)
+	return append(box, payload...)
+}
+
+//
+// Makes a full box, with version and flags 0, holding 32 bit fields
+//
+func MakeFullBox(box_type string, fields ...uint32) []byte {
+	payload := make([]byte, 4+4*len(fields))
+	for idx, field := range fields {
+		binary.BigEndian.PutUint32(payload[4+4*idx:], field)
+	}
+	return MakeBox(box_type, payload)
+}
+
+//
+// Makes a trak box with a sample table of its boxes
+//
+func MakeTrak(stbl ...[]byte) []byte {
+	return MakeBox("trak", MakeBox("mdia", MakeBox("minf", MakeBox("stbl", stbl...))))
+}
+
+//
+// Lists the types of boxes, and of the boxes in them, depth first
+//
+func BoxTypes(boxes []Box) []string {
+	var types []string
+	for _, box := range boxes {
+		types = append(types, box.Type)
+		types = append(types, BoxTypes(box.Children)...)
+	}
+	return types
+}
+
+//
+// Nests boxes of a container type depth deep
+//
+func NestBoxes(box_type string, depth int) []byte {
+	box := MakeBox("free")
+	for ; depth > 0; depth-- {
+		box = MakeBox(box_type, box)
+	}
+	return box
+}
+
+//---------------------------------------------------------------------------
+// Tests
+//---------------------------------------------------------------------------
+//
+func TestReadBoxes(t *testing.T) {
+	for _, read_case := range READ_BOXES_CASES {
+		file := bytes.NewReader(read_case.blob)
+		boxes, err := ReadBoxes(file, 0, int64(len(read_case.blob)), 0)
+		if read_case.fails {
+			if err == nil {
+				t.Errorf("%s: read %v, want an error", read_case.name, BoxTypes(boxes))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", read_case.name, err)
+			continue
+		}
+		if read_case.types != nil && !reflect.DeepEqual(BoxTypes(boxes), read_case.types) {
+			t.Errorf("%s: read %v, want %v", read_case.name, BoxTypes(boxes), read_case.types)
+		}
+	}
+}
+
+func TestReadMP4Samples(t *testing.T) {
+	for _, read_case := range READ_SAMPLES_CASES {
+		file := bytes.NewReader(read_case.trak)
+		boxes, err := ReadBoxes(file, 0, int64(len(read_case.trak)), 0)
+		if err != nil {
+			t.Errorf("%s: %v", read_case.name, err)
+			continue
+		}
+		samples, err := ReadMP4Samples(file, boxes[0], 100)
+		if read_case.fails {
+			if err == nil {
+				t.Errorf("%s: read %v, want an error", read_case.name, samples)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", read_case.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(samples, read_case.samples) {
+			t.Errorf("%s: read %v, want %v", read_case.name, samples, read_case.samples)
+		}
+	}
+}
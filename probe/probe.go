@@ -0,0 +1,220 @@
+package probe
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"serviam/structs"
+	"strings"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Containers which can be probed, keyed by their extensions.
+// WebM is a kind of Matroska and is read the same way.
+//
+var CONTAINERS = map[string]string{
+	".mp4":  CONTAINER_MP4,
+	".m4v":  CONTAINER_MP4,
+	".mov":  CONTAINER_MP4,
+	".mkv":  CONTAINER_MATROSKA,
+	".webm": CONTAINER_MATROSKA,
+}
+
+const (
+	CONTAINER_MP4      = "mp4"
+	CONTAINER_MATROSKA = "matroska"
+	CONTAINER_WEBM     = "webm"
+)
+
+//
+// Codecs browsers can play in each container.
+// Matroska which isn't WebM is only played by recent browsers,
+// so the server prefers other versions to it and the watch page
+// skips it in browsers which say they can't play it.
+//
+var BROWSER_CODECS = map[string]map[string]bool{
+	CONTAINER_MP4: {
+		"avc1": true,
+		"avc3": true,
+		"vp09": true,
+		"av01": true,
+		"mp4a": true,
+		"Opus": true,
+		".mp3": true,
+	},
+	CONTAINER_WEBM: {
+		"V_VP8":    true,
+		"V_VP9":    true,
+		"V_AV1":    true,
+		"A_OPUS":   true,
+		"A_VORBIS": true,
+	},
+	CONTAINER_MATROSKA: {
+		"V_MPEG4/ISO/AVC": true,
+		"V_VP8":           true,
+		"V_VP9":           true,
+		"V_AV1":           true,
+		"A_AAC":           true,
+		"A_OPUS":          true,
+		"A_VORBIS":        true,
+		"A_MPEG/L3":       true,
+	},
+}
+
+//
+// The types browsers are told videos in each container are
+//
+var BROWSER_TYPES = map[string]string{
+	CONTAINER_MP4:      "mp4",
+	CONTAINER_WEBM:     "webm",
+	CONTAINER_MATROSKA: "x-matroska",
+}
+
+//
+// Returned for files which aren't in a container that can be probed
+//
+var ERR_UNSUPPORTED = errors.New("can't probe this kind of file")
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// Reads big endian fields one after another from a blob,
+// remembering if it ran out rather than failing on every read
+//
+type FieldReader struct {
+	blob   []byte
+	offset int
+	short  bool
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Starts reading fields at the beginning of a blob
+//
+func NewFieldReader(blob []byte) *FieldReader {
+	return &FieldReader{blob: blob}
+}
+
+//
+// Skips bytes
+//
+func (reader *FieldReader) Skip(num_bytes int) {
+	reader.Bytes(num_bytes)
+}
+
+//
+// Reads bytes, nil if there aren't enough left
+//
+func (reader *FieldReader) Bytes(num_bytes int) []byte {
+	if num_bytes < 0 || reader.offset+num_bytes > len(reader.blob) {
+		reader.short = true
+		reader.offset = len(reader.blob)
+		return nil
+	}
+	field := reader.blob[reader.offset : reader.offset+num_bytes]
+	reader.offset += num_bytes
+	return field
+}
+
+//
+// Reads an unsigned integer of 1, 2, 4 or 8 bytes
+//
+func (reader *FieldReader) Uint(num_bytes int) uint64 {
+	field := reader.Bytes(num_bytes)
+	switch {
+	case field == nil:
+		return 0
+	case num_bytes == 1:
+		return uint64(field[0])
+	case num_bytes == 2:
+		return uint64(binary.BigEndian.Uint16(field))
+	case num_bytes == 4:
+		return uint64(binary.BigEndian.Uint32(field))
+	default:
+		return binary.BigEndian.Uint64(field)
+	}
+}
+
+//
+// Reads a string of a fixed number of bytes
+//
+func (reader *FieldReader) String(num_bytes int) string {
+	return string(reader.Bytes(num_bytes))
+}
+
+//
+// Reads what is left of the blob as a string
+//
+func (reader *FieldReader) Rest() string {
+	return reader.String(len(reader.blob) - reader.offset)
+}
+
+//
+// Checks whether every read had enough bytes
+//
+func (reader *FieldReader) Short() bool {
+	return reader.short
+}
+
+//
+// Gets the container of a file from its extension, "" if it can't be probed
+//
+func Container(location string) string {
+	return CONTAINERS[strings.ToLower(filepath.Ext(location))]
+}
+
+//
+// Checks whether a file is in a container which can be probed
+//
+func CanProbe(location string) bool {
+	return Container(location) != ""
+}
+
+//
+// Reads a video's duration, dimensions and tracks
+// without anything besides the file itself
+//
+func Probe(location string) (structs.MediaInfo, error) {
+	var media structs.MediaInfo
+	var err error
+	switch Container(location) {
+	case CONTAINER_MP4:
+		media, err = ProbeMP4(location)
+	case CONTAINER_MATROSKA:
+		media, err = ProbeMKV(location)
+	default:
+		return media, ERR_UNSUPPORTED
+	}
+	media.BrowserPlayable = BrowserPlayable(media)
+	return media, err
+}
+
+//
+// Checks whether browsers can play a video without it being converted,
+// by its container, its video's codec and its first audio track's codec.
+// Other audio tracks are left to the browser to ignore.
+//
+func BrowserPlayable(media structs.MediaInfo) bool {
+	codecs := BROWSER_CODECS[media.Container]
+	if media.VideoCodec == "" || !codecs[media.VideoCodec] {
+		return false
+	}
+	return len(media.AudioTracks) == 0 || codecs[media.AudioTracks[0].Codec]
+}
+
+//
+// Drops the "undetermined" language code containers use for no language
+//
+func Language(code string) string {
+	code = strings.TrimRight(code, "\x00 ")
+	if code == "und" || code == "zxx" {
+		return ""
+	}
+	return code
+}
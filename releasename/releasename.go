@@ -0,0 +1,569 @@
+package releasename
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// extensions which are stripped before parsing
+//
+var MEDIA_EXTENSIONS = []string{
+	".mp4",
+	".mkv",
+	".avi",
+	".m4v",
+	".mov",
+	".wmv",
+	".mpg",
+	".mpeg",
+	".webm",
+	".srt",
+	".sub",
+	".idx",
+	".ass",
+	".ssa",
+	".vtt",
+	".nfo",
+	".json",
+}
+
+//
+// normalised tags, keyed by their lower case spellings
+//
+var SOURCES = map[string]string{
+	"bluray":   "BluRay",
+	"blu-ray":  "BluRay",
+	"bdrip":    "BluRay",
+	"brrip":    "BluRay",
+	"bdremux":  "BluRay",
+	"remux":    "Remux",
+	"webdl":    "WEB-DL",
+	"webrip":   "WEBRip",
+	"web":      "WEB",
+	"hdtv":     "HDTV",
+	"pdtv":     "HDTV",
+	"dvdrip":   "DVD",
+	"dvd":      "DVD",
+	"dvdscr":   "DVD",
+	"hdrip":    "HDRip",
+	"cam":      "CAM",
+	"hdcam":    "CAM",
+	"telesync": "TS",
+	"vhsrip":   "VHS",
+}
+
+var CODECS = map[string]string{
+	"x264":  "H.264",
+	"h264":  "H.264",
+	"avc":   "H.264",
+	"x265":  "H.265",
+	"h265":  "H.265",
+	"hevc":  "H.265",
+	"xvid":  "XviD",
+	"divx":  "DivX",
+	"av1":   "AV1",
+	"vp9":   "VP9",
+	"mpeg2": "MPEG-2",
+}
+
+var EDITIONS = map[string]string{
+	"directorscut":       "Director's Cut",
+	"extended":           "Extended",
+	"extendededition":    "Extended",
+	"extendedcut":        "Extended",
+	"unrated":            "Unrated",
+	"uncut":              "Uncut",
+	"theatrical":         "Theatrical",
+	"theatricalcut":      "Theatrical",
+	"remastered":         "Remastered",
+	"specialedition":     "Special Edition",
+	"ultimateedition":    "Ultimate Edition",
+	"collectorsedition":  "Collector's Edition",
+	"anniversaryedition": "Anniversary Edition",
+	"finalcut":           "Final Cut",
+	"imax":               "IMAX",
+	"criterion":          "Criterion",
+}
+
+var RESOLUTIONS = map[string]string{
+	"480p":  "480p",
+	"480i":  "480p",
+	"576p":  "576p",
+	"576i":  "576p",
+	"720p":  "720p",
+	"1080p": "1080p",
+	"1080i": "1080p",
+	"2160p": "2160p",
+	"4k":    "2160p",
+	"uhd":   "2160p",
+}
+
+//
+// tags which are also common words, so only end a title
+// when they come just before other tags
+//
+var WEAK_TAGS = map[string]bool{
+	"web":        true,
+	"cam":        true,
+	"dvd":        true,
+	"avc":        true,
+	"uhd":        true,
+	"extended":   true,
+	"unrated":    true,
+	"uncut":      true,
+	"theatrical": true,
+	"remastered": true,
+	"imax":       true,
+	"criterion":  true,
+	"finalcut":   true,
+	"proper":     true,
+	"internal":   true,
+	"limited":    true,
+	"multi":      true,
+	"dual":       true,
+	"dv":         true,
+	"dd":         true,
+	"complete":   true,
+}
+
+//
+// tags which mark the end of a title but aren't recorded
+//
+var OTHER_TAGS = map[string]bool{
+	"proper":   true,
+	"repack":   true,
+	"rerip":    true,
+	"internal": true,
+	"limited":  true,
+	"multi":    true,
+	"dual":     true,
+	"subbed":   true,
+	"dubbed":   true,
+	"hdr":      true,
+	"hdr10":    true,
+	"dv":       true,
+	"10bit":    true,
+	"8bit":     true,
+	"aac":      true,
+	"ac3":      true,
+	"eac3":     true,
+	"dts":      true,
+	"dd":       true,
+	"ddp":      true,
+	"truehd":   true,
+	"atmos":    true,
+	"flac":     true,
+	"mp3":      true,
+	"audio":    true,
+	"complete": true,
+}
+
+//
+// how many years ahead a year in a name can be, for releases dated
+// the year they're out, so later years are part of the title
+//
+const YEARS_AHEAD = 1
+
+var ROMAN_NUMERALS = map[string]int{
+	"i":    1,
+	"ii":   2,
+	"iii":  3,
+	"iv":   4,
+	"v":    5,
+	"vi":   6,
+	"vii":  7,
+	"viii": 8,
+	"ix":   9,
+	"x":    10,
+}
+
+//
+// patterns
+//
+var (
+	// multi word tags which are joined into a single token
+	WEB_DL_REGEXP  = regexp.MustCompile(`(?i)\bweb[ ._-]?dl\b`)
+	BLU_RAY_REGEXP = regexp.MustCompile(`(?i)\bblu[ ._-]ray\b`)
+	CODEC_REGEXP   = regexp.MustCompile(`(?i)\b[hx][ .]?26([45])\b`)
+	AUDIO_REGEXP   = regexp.MustCompile(
+		`(?i)\b(ddp?|e?ac3|aac|dts(-hd)?(\.ma)?|truehd|flac|opus)?[ .]?[1-7][ .][01]\b`,
+	)
+	EDITION_REGEXP = regexp.MustCompile(
+		`(?i)\b(director'?s|extended|theatrical|special|ultimate|` +
+			`collector'?s|anniversary|final)[ ._-]+(cut|edition|version)\b`,
+	)
+
+	// episode markers: S01E02, S01E02E03, S01E02-E04, 1x02, 1x02-03
+	SXXEYY_REGEXP = regexp.MustCompile(
+		`(?i)(^|[ ._\-\[(])s(\d{1,2})[ ._-]?e(\d{1,3})((?:[ ._-]?-?e\d{1,3}|-\d{1,3})*)`,
+	)
+	NXNN_REGEXP = regexp.MustCompile(
+		`(?i)(^|[ ._\-\[(])(\d{1,2})x(\d{2,3})((?:-x?\d{2,3})*)($|[^\da-z])`,
+	)
+	EPISODE_LIST_REGEXP = regexp.MustCompile(`(?i)(-?)[ex]?(\d{1,3})`)
+
+	SPLIT_REGEXP = regexp.MustCompile(`[\s._\[\](){}+]+`)
+	YEAR_REGEXP  = regexp.MustCompile(`^(19|20)\d\d$`)
+	DISC_REGEXP  = regexp.MustCompile(`(?i)^(cd|dis[ck])(\d{1,2})$`)
+	NUM_REGEXP   = regexp.MustCompile(`^\d{1,2}$`)
+)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// The information found in a release style file name
+//
+type Release struct {
+	Title      string
+	Year       int
+	Resolution string
+	Source     string
+	Codec      string
+	Edition    string
+	Part       int
+	Season     int
+	Episodes   []int
+}
+
+//
+// Checks whether the release is an episode of a show
+//
+func (release Release) IsEpisode() bool {
+	return len(release.Episodes) > 0
+}
+
+//---------------------------------------------------------------------------
+// Helper Functions
+//---------------------------------------------------------------------------
+//
+// Removes a known media extension from a file name
+//
+func StripExtension(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, media_ext := range MEDIA_EXTENSIONS {
+		if ext == media_ext {
+			return strings.TrimSuffix(name, filepath.Ext(name))
+		}
+	}
+	return name
+}
+
+//
+// Parses a list of episodes following a first episode, e.g. "E03E04" or "-05".
+// A dash makes a range from the previous episode.
+//
+func ParseEpisodes(first int, rest string) []int {
+	episodes := []int{first}
+	for _, match := range EPISODE_LIST_REGEXP.FindAllStringSubmatch(rest, -1) {
+		episode, _ := strconv.Atoi(match[2])
+		last := episodes[len(episodes)-1]
+		if match[1] == "-" && episode > last && episode-last < 100 {
+			for between := last + 1; between < episode; between++ {
+				episodes = append(episodes, between)
+			}
+		}
+		if episode != last {
+			episodes = append(episodes, episode)
+		}
+	}
+	return episodes
+}
+
+//
+// Finds an episode marker, returning where it starts
+// or -1 if there isn't one
+//
+func FindEpisode(name string, release *Release) int {
+	if match := SXXEYY_REGEXP.FindStringSubmatchIndex(name); match != nil {
+		release.Season, _ = strconv.Atoi(name[match[4]:match[5]])
+		first, _ := strconv.Atoi(name[match[6]:match[7]])
+		release.Episodes = ParseEpisodes(first, name[match[8]:match[9]])
+		return match[3]
+	}
+	if match := NXNN_REGEXP.FindStringSubmatchIndex(name); match != nil {
+		release.Season, _ = strconv.Atoi(name[match[4]:match[5]])
+		first, _ := strconv.Atoi(name[match[6]:match[7]])
+		release.Episodes = ParseEpisodes(first, name[match[8]:match[9]])
+		return match[3]
+	}
+	return -1
+}
+
+//
+// Joins multi word tags into single tokens
+//
+func JoinTags(name string) string {
+	name = WEB_DL_REGEXP.ReplaceAllString(name, " webdl ")
+	name = BLU_RAY_REGEXP.ReplaceAllString(name, " bluray ")
+	name = CODEC_REGEXP.ReplaceAllString(name, " h26$1 ")
+	name = AUDIO_REGEXP.ReplaceAllString(name, " audio ")
+	name = EDITION_REGEXP.ReplaceAllStringFunc(name, func(edition string) string {
+		return " " + strings.Map(func(r rune) rune {
+			if r == '\'' || r == ' ' || r == '.' || r == '_' || r == '-' {
+				return -1
+			}
+			return r
+		}, edition) + " "
+	})
+	return name
+}
+
+//
+// Tag strengths
+//
+const (
+	NOT_A_TAG  = 0
+	WEAK_TAG   = 1
+	STRONG_TAG = 2
+)
+
+//
+// Works out whether a token is a tag, and how sure that is
+//
+func TagStrength(token string) int {
+	lower := strings.ToLower(token)
+	_, resolution := RESOLUTIONS[lower]
+	_, source := SOURCES[lower]
+	_, codec := CODECS[lower]
+	_, edition := EDITIONS[lower]
+	if resolution || source || codec || edition || OTHER_TAGS[lower] ||
+		DISC_REGEXP.MatchString(lower) {
+		if WEAK_TAGS[lower] {
+			return WEAK_TAG
+		}
+		return STRONG_TAG
+	}
+	// a release group stuck to a tag, e.g. x264-GROUP
+	if dash := strings.LastIndex(token, "-"); dash > 0 {
+		return TagStrength(token[:dash])
+	}
+	return NOT_A_TAG
+}
+
+//
+// Checks whether a year-like token could be when something was released,
+// which isn't more than YEARS_AHEAD years from now
+//
+func IsReleaseYear(token string) bool {
+	year, err := strconv.Atoi(token)
+	return err == nil && year <= time.Now().Year()+YEARS_AHEAD
+}
+
+//
+// Checks whether a token is an edition, such as "Extended"
+//
+func IsEdition(token string) bool {
+	_, edition := EDITIONS[strings.ToLower(token)]
+	return edition
+}
+
+//
+// Records the information in a tag
+//
+func RecordTag(token string, release *Release) {
+	lower := strings.ToLower(token)
+	if dash := strings.LastIndex(lower, "-"); dash > 0 && TagStrength(lower) != NOT_A_TAG {
+		if _, ok := SOURCES[lower]; !ok {
+			lower = lower[:dash]
+		}
+	}
+	if resolution, ok := RESOLUTIONS[lower]; ok {
+		release.Resolution = resolution
+	}
+	if source, ok := SOURCES[lower]; ok {
+		if release.Source == "" || source != "Remux" {
+			release.Source = source
+		}
+	}
+	if codec, ok := CODECS[lower]; ok {
+		release.Codec = codec
+	}
+	if edition, ok := EDITIONS[lower]; ok {
+		release.Edition = edition
+	}
+	if match := DISC_REGEXP.FindStringSubmatch(lower); match != nil {
+		release.Part, _ = strconv.Atoi(match[2])
+	}
+}
+
+//
+// Reads a part number, as digits or roman numerals
+//
+func PartNumber(token string) (int, bool) {
+	if NUM_REGEXP.MatchString(token) {
+		number, _ := strconv.Atoi(token)
+		return number, true
+	}
+	number, ok := ROMAN_NUMERALS[strings.ToLower(token)]
+	return number, ok
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Parses a release style file name such as
+// "The.Matrix.1999.1080p.BluRay.x264-GROUP.mkv" or "Show.Name.S01E02.mkv"
+//
+func Parse(name string) Release {
+	var release Release
+
+	name = StripExtension(filepath.Base(name))
+	if start := FindEpisode(name, &release); start >= 0 {
+		// everything after the episode marker is the episode's name or tags
+		for _, token := range SPLIT_REGEXP.Split(JoinTags(name[start:]), -1) {
+			if TagStrength(token) != NOT_A_TAG {
+				RecordTag(token, &release)
+			}
+		}
+		name = name[:start]
+	}
+
+	var tokens []string
+	for _, token := range SPLIT_REGEXP.Split(JoinTags(name), -1) {
+		token = strings.Trim(token, "-")
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+
+	// the title ends at the first strong tag
+	strong_end := len(tokens)
+	for idx, token := range tokens {
+		if TagStrength(token) == STRONG_TAG {
+			strong_end = idx
+			break
+		}
+	}
+
+	// editions often come before the year, so it is looked for
+	// up to the first strong tag which isn't an edition
+	year_end := strong_end
+	for year_end < len(tokens) &&
+		(TagStrength(tokens[year_end]) != STRONG_TAG || IsEdition(tokens[year_end])) {
+		year_end++
+	}
+
+	// or at the year, the last year-like token before the tags
+	// as long as it isn't the title and isn't still to come,
+	// so Blade.Runner.2049 keeps its number
+	title_end := strong_end
+	year_idx := -1
+	for idx := 1; idx < year_end; idx++ {
+		if YEAR_REGEXP.MatchString(tokens[idx]) {
+			year_idx = idx
+		}
+	}
+	if year_idx >= 0 && !IsReleaseYear(tokens[year_idx]) {
+		year_idx = -1
+	}
+	if year_idx >= 0 {
+		release.Year, _ = strconv.Atoi(tokens[year_idx])
+		if year_idx < title_end {
+			title_end = year_idx
+		}
+	} else if strong_end < len(tokens) {
+		// or at a run of weak tags leading up to the strong ones
+		for title_end > 1 && TagStrength(tokens[title_end-1]) == WEAK_TAG {
+			title_end--
+		}
+	}
+
+	for idx := title_end; idx < len(tokens); idx++ {
+		if TagStrength(tokens[idx]) != NOT_A_TAG {
+			RecordTag(tokens[idx], &release)
+		}
+	}
+
+	// parts stay in the title, as they are usually part of it
+	for idx := 0; idx+1 < title_end; idx++ {
+		switch strings.ToLower(tokens[idx]) {
+		case "part", "pt":
+			if part, ok := PartNumber(tokens[idx+1]); ok {
+				release.Part = part
+			}
+		}
+	}
+
+	release.Title = strings.Join(tokens[:title_end], " ")
+	return release
+}
+
+//
+// Makes a search query from a file name,
+// returning the query and a year to filter by (0 for any year)
+//
+func Query(name string) (string, int) {
+	release := Parse(name)
+	if release.Title == "" {
+		return StripExtension(filepath.Base(name)), 0
+	}
+	return release.Title, release.Year
+}
+
+//
+// Lower cases a title and reduces it to words of letters and digits
+// so differently punctuated spellings compare equal
+//
+func Normalise(title string) string {
+	title = strings.ToLower(strings.ReplaceAll(title, "&", " and "))
+	title = strings.Map(func(r rune) rune {
+		if r == '\'' {
+			return -1
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return ' '
+	}, title)
+	return strings.Join(strings.Fields(title), " ")
+}
+
+//
+// Scores how alike two titles are, from 0 (nothing alike) to 1 (the same),
+// using the edit distance between their normalised forms
+//
+func Similarity(a string, b string) float64 {
+	a_runes := []rune(Normalise(a))
+	b_runes := []rune(Normalise(b))
+	longest := len(a_runes)
+	if len(b_runes) > longest {
+		longest = len(b_runes)
+	}
+	if longest == 0 {
+		return 1
+	}
+
+	previous := make([]int, len(b_runes)+1)
+	current := make([]int, len(b_runes)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a_runes); i++ {
+		current[0] = i
+		for j := 1; j <= len(b_runes); j++ {
+			cost := 1
+			if a_runes[i-1] == b_runes[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+	return 1 - float64(previous[len(b_runes)])/float64(longest)
+}
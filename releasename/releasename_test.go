@@ -0,0 +1,223 @@
+package releasename
+
+import (
+	"reflect"
+	"testing"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// file names and what should be parsed from them
+//
+var PARSE_CASES = []struct {
+	name    string
+	release Release
+}{
+	// films
+	{
+		"The.Matrix.1999.1080p.BluRay.x264-GROUP.mkv",
+		Release{Title: "The Matrix", Year: 1999, Resolution: "1080p", Source: "BluRay", Codec: "H.264"},
+	},
+	{
+		"Blade Runner 2049 (2017) [2160p].mkv",
+		Release{Title: "Blade Runner 2049", Year: 2017, Resolution: "2160p"},
+	},
+	{
+		"2001.A.Space.Odyssey.1968.720p.mkv",
+		Release{Title: "2001 A Space Odyssey", Year: 1968, Resolution: "720p"},
+	},
+	{
+		"1917.2019.1080p.WEB-DL.mkv",
+		Release{Title: "1917", Year: 2019, Resolution: "1080p", Source: "WEB-DL"},
+	},
+	{
+		"Rocky.IV.1985.mkv",
+		Release{Title: "Rocky IV", Year: 1985},
+	},
+	{
+		"Extended.Family.2019.mkv",
+		Release{Title: "Extended Family", Year: 2019},
+	},
+
+	// numbers in titles, only the last year-like one is the year
+	// and only if it isn't still to come
+	{
+		"Blade.Runner.2049.mkv",
+		Release{Title: "Blade Runner 2049"},
+	},
+	{
+		"Blade.Runner.2049.2017.2160p.UHD.BluRay.x265.mkv",
+		Release{Title: "Blade Runner 2049", Year: 2017, Resolution: "2160p", Source: "BluRay", Codec: "H.265"},
+	},
+	{
+		"Blade.Runner.2049.1080p.WEB-DL.mkv",
+		Release{Title: "Blade Runner 2049", Resolution: "1080p", Source: "WEB-DL"},
+	},
+	{
+		"2012.2009.720p.BluRay.mkv",
+		Release{Title: "2012", Year: 2009, Resolution: "720p", Source: "BluRay"},
+	},
+	{
+		"1984.1984.mkv",
+		Release{Title: "1984", Year: 1984},
+	},
+	{
+		"2046.2004.DVDRip.mkv",
+		Release{Title: "2046", Year: 2004, Source: "DVD"},
+	},
+	{
+		"Death.Race.2000.1975.mkv",
+		Release{Title: "Death Race 2000", Year: 1975},
+	},
+	{
+		"12.Angry.Men.1957.mkv",
+		Release{Title: "12 Angry Men", Year: 1957},
+	},
+	{
+		"10.Cloverfield.Lane.2016.1080p.mkv",
+		Release{Title: "10 Cloverfield Lane", Year: 2016, Resolution: "1080p"},
+	},
+	{
+		"Se7en.1995.mkv",
+		Release{Title: "Se7en", Year: 1995},
+	},
+	{
+		"300.2006.mkv",
+		Release{Title: "300", Year: 2006},
+	},
+	{
+		"Apollo.13.1995.mkv",
+		Release{Title: "Apollo 13", Year: 1995},
+	},
+	{
+		"District.9.2009.mkv",
+		Release{Title: "District 9", Year: 2009},
+	},
+	{
+		"21.Jump.Street.2012.mkv",
+		Release{Title: "21 Jump Street", Year: 2012},
+	},
+	{
+		"The.Number.23.2007.mkv",
+		Release{Title: "The Number 23", Year: 2007},
+	},
+	{
+		"Ocean's.Eleven.2001.mkv",
+		Release{Title: "Ocean's Eleven", Year: 2001},
+	},
+
+	// editions, before and after the year
+	{
+		"The.Lord.of.the.Rings.Extended.Edition.2001.mkv",
+		Release{Title: "The Lord of the Rings", Year: 2001, Edition: "Extended"},
+	},
+	{
+		"Alien.Directors.Cut.1979.DVDRip.mkv",
+		Release{Title: "Alien", Year: 1979, Source: "DVD", Edition: "Director's Cut"},
+	},
+	{
+		"Blade.Runner.1982.Final.Cut.1080p.BluRay.mkv",
+		Release{Title: "Blade Runner", Year: 1982, Resolution: "1080p", Source: "BluRay", Edition: "Final Cut"},
+	},
+	{
+		"Aliens.1986.Special.Edition.BDRip.mkv",
+		Release{Title: "Aliens", Year: 1986, Source: "BluRay", Edition: "Special Edition"},
+	},
+
+	// no year
+	{
+		"Amelie.mkv",
+		Release{Title: "Amelie"},
+	},
+	{
+		"Heat.Remastered.1080p.BluRay.x265.mkv",
+		Release{Title: "Heat", Resolution: "1080p", Source: "BluRay", Codec: "H.265", Edition: "Remastered"},
+	},
+	{
+		"Unrated.Movie.WEB.1080p.mkv",
+		Release{Title: "Unrated Movie", Resolution: "1080p", Source: "WEB"},
+	},
+
+	// parts
+	{
+		"Harry.Potter.and.the.Deathly.Hallows.Part.2.2011.720p.mkv",
+		Release{Title: "Harry Potter and the Deathly Hallows Part 2", Year: 2011, Resolution: "720p", Part: 2},
+	},
+	{
+		"Dune.Part.II.1080p.WEBRip.mkv",
+		Release{Title: "Dune Part II", Resolution: "1080p", Source: "WEBRip", Part: 2},
+	},
+	{
+		"Lawrence.of.Arabia.1962.CD1.avi",
+		Release{Title: "Lawrence of Arabia", Year: 1962, Part: 1},
+	},
+	{
+		"Kill.Bill.Vol.1.2003.mkv",
+		Release{Title: "Kill Bill Vol 1", Year: 2003},
+	},
+
+	// episodes
+	{
+		"Show.Name.S01E02.720p.HDTV.x264.mkv",
+		Release{Title: "Show Name", Resolution: "720p", Source: "HDTV", Codec: "H.264", Season: 1, Episodes: []int{2}},
+	},
+	{
+		"Show.Name.S01E02E03.mkv",
+		Release{Title: "Show Name", Season: 1, Episodes: []int{2, 3}},
+	},
+	{
+		"Show.Name.S02E05-E07.1080p.mkv",
+		Release{Title: "Show Name", Resolution: "1080p", Season: 2, Episodes: []int{5, 6, 7}},
+	},
+	{
+		"Show Name - 1x02 - Episode Title.mkv",
+		Release{Title: "Show Name", Season: 1, Episodes: []int{2}},
+	},
+	{
+		"show.name.3x10-11.mkv",
+		Release{Title: "show name", Season: 3, Episodes: []int{10, 11}},
+	},
+	{
+		"Doctor.Who.2005.S03E07.mkv",
+		Release{Title: "Doctor Who", Year: 2005, Season: 3, Episodes: []int{7}},
+	},
+	{
+		"The.Office.US.s05e14.WEB.h264.mkv",
+		Release{Title: "The Office US", Source: "WEB", Codec: "H.264", Season: 5, Episodes: []int{14}},
+	},
+}
+
+//---------------------------------------------------------------------------
+// Tests
+//---------------------------------------------------------------------------
+//
+func TestParse(t *testing.T) {
+	for _, parse_case := range PARSE_CASES {
+		release := Parse(parse_case.name)
+		if !reflect.DeepEqual(release, parse_case.release) {
+			t.Errorf("Parse(%q) = %+v, want %+v", parse_case.name, release, parse_case.release)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	query, year := Query("Alien.Directors.Cut.1979.DVDRip.mkv")
+	if query != "Alien" || year != 1979 {
+		t.Errorf("Query gave %q, %d, want \"Alien\", 1979", query, year)
+	}
+	query, year = Query("1080p.mkv")
+	if query != "1080p" || year != 0 {
+		t.Errorf("Query gave %q, %d, want \"1080p\", 0", query, year)
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	if similarity := Similarity("Amelie", "amélie"); similarity >= 1 {
+		t.Errorf("Similarity of different titles is %v", similarity)
+	}
+	if similarity := Similarity("Fast & Furious", "fast and furious"); similarity != 1 {
+		t.Errorf("Similarity of the same title is %v", similarity)
+	}
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"encoding/xml"
+	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
@@ -12,9 +12,12 @@ import (
 	"os"
 	"path"
 	"serviam/common"
+	"serviam/library"
+	"serviam/probe"
 	"serviam/structs"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 //---------------------------------------------------------------------------
@@ -89,6 +92,7 @@ type InfoCard struct {
 // Watch cards structure
 //
 type WatchCards struct {
+	Id    string
 	Name  string
 	Cards []WatchCard
 }
@@ -101,6 +105,32 @@ type WatchCard struct {
 	Text      string
 	Video     string
 	VideoType string
+	Media     string
+	Chapters  []WatchChapter
+	Versions  []WatchVersion
+}
+
+//
+// Watch version structure, a version of a video browsers can play.
+// Height is 0 if it isn't known.
+//
+type WatchVersion struct {
+	Label     string
+	Video     string
+	VideoType string
+	Height    int
+	Default   bool
+	Chapters  []WatchChapter
+}
+
+//
+// Watch chapter structure, its start and end in seconds
+//
+type WatchChapter struct {
+	Start float64
+	End   float64
+	Time  string
+	Title string
 }
 
 //---------------------------------------------------------------------------
@@ -126,16 +156,90 @@ func FindFileType(
 	return file, false
 }
 
+//
+// finds a file browsers can play in a slice of FileData,
+// preferring one probing found playable to an mp4,
+// and one which isn't Matroska as fewer browsers play that,
+// and gives the type to serve it as
+//
+func FindPlayableFile(
+	files []structs.FileData,
+) (
+	structs.FileData,
+	string,
+	bool,
+) {
+	var matroska_file structs.FileData
+	found_matroska := false
+	for _, file := range files {
+		if file.Media == nil || !file.Media.BrowserPlayable {
+			continue
+		}
+		if file.Media.Container != probe.CONTAINER_MATROSKA {
+			return file, probe.BROWSER_TYPES[file.Media.Container], true
+		}
+		if !found_matroska {
+			matroska_file, found_matroska = file, true
+		}
+	}
+	if found_matroska {
+		return matroska_file, probe.BROWSER_TYPES[probe.CONTAINER_MATROSKA], true
+	}
+	file, found := FindFileType(files, "mp4")
+	return file, file.Type, found
+}
+
+//
+// lists the versions of a video browsers can play in a slice of FileData,
+// those probing found playable or else mp4s,
+// marking the file served by default
+//
+func FindVersions(
+	files []structs.FileData,
+	default_file structs.FileData,
+) []WatchVersion {
+	var versions []WatchVersion
+	for _, file := range files {
+		if !library.IsVideo(file) {
+			continue
+		}
+		version := WatchVersion{
+			file.Label,
+			file.Path,
+			file.Type,
+			0,
+			file.Path == default_file.Path,
+			WatchChapters(file.Media),
+		}
+		if file.Media != nil {
+			if !file.Media.BrowserPlayable {
+				continue
+			}
+			version.Height = file.Media.Height
+			version.VideoType = probe.BROWSER_TYPES[file.Media.Container]
+		} else if file.Type != "mp4" {
+			continue
+		}
+		if version.Label == "" {
+			version.Label = file.Name
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
 //
 // finds the json info files in a directory
 //
-func GetInfoFiles(directory string) []string {
+func GetInfoFiles(directory string) ([]string, error) {
 	var err error
 	var output []string
 	var files_slice []os.FileInfo
 
 	files_slice, err = ioutil.ReadDir(directory)
-	common.CheckErr(err)
+	if err != nil {
+		return nil, err
+	}
 
 	for _, file := range files_slice {
 		if file.IsDir() {
@@ -149,33 +253,55 @@ func GetInfoFiles(directory string) []string {
 			} else if os.IsNotExist(err) {
 				log.Printf("'%s' doesn't exist.\n", json_path)
 			} else {
-				common.CheckErr(err)
+				return nil, err
 			}
 		}
 	}
-	return output
+	return output, nil
 }
 
 //
-// Build database
+// Reads an info file, upgrading it in memory if it is from an old schema.
+// Files from a schema newer than this serviam knows can't be read.
 //
-func BuildDatabase(site_server *SiteServer) {
-	var err error
-	var blob []byte
+func ReadInfoFile(file string, info interface{}) error {
+	version, err := library.LoadInfoFile(file, info)
+	if err != nil {
+		return err
+	}
+	if version < structs.SCHEMA_VERSION {
+		log.Printf(
+			"'%s' is schema version %d and was upgraded to %d in memory."+
+				" Run 'librarian migrate' to upgrade it on disk.\n",
+			file,
+			version,
+			structs.SCHEMA_VERSION,
+		)
+	}
+	return nil
+}
 
+//
+// Build database, returning the info files which couldn't be loaded
+//
+func BuildDatabase(site_server *SiteServer) []error {
+	var errs []error
 	site_server.id2idx = make(map[string][2]int)
 
 	site_server.permutations = make(map[string][][2]int)
 
 	// import lonely films
 	films_dir := path.Join(MEDIA_ROOT, MEDIA_FILMS_DIR)
-	films_dir_files := GetInfoFiles(films_dir)
+	films_dir_files, err := GetInfoFiles(films_dir)
+	if err != nil {
+		errs = append(errs, err)
+	}
 	for _, file := range films_dir_files {
 		var film_data structs.FilmData
-		blob, err = ioutil.ReadFile(file)
-		common.CheckErr(err)
-		err = json.Unmarshal(blob, &film_data)
-		common.CheckErr(err)
+		if err := ReadInfoFile(file, &film_data); err != nil {
+			errs = append(errs, err)
+			continue
+		}
 
 		film_idx := [2]int{
 			LONELY_FILM_IDX,
@@ -191,13 +317,16 @@ func BuildDatabase(site_server *SiteServer) {
 
 	// import collection films
 	collections_dir := path.Join(MEDIA_ROOT, MEDIA_COLLECTIONS_DIR)
-	collections_dir_files := GetInfoFiles(collections_dir)
+	collections_dir_files, err := GetInfoFiles(collections_dir)
+	if err != nil {
+		errs = append(errs, err)
+	}
 	for _, file := range collections_dir_files {
 		var collection_data structs.CollectionData
-		blob, err = ioutil.ReadFile(file)
-		common.CheckErr(err)
-		err = json.Unmarshal(blob, &collection_data)
-		common.CheckErr(err)
+		if err := ReadInfoFile(file, &collection_data); err != nil {
+			errs = append(errs, err)
+			continue
+		}
 
 		collection_idx := [2]int{
 			COLLECTION_IDX,
@@ -226,13 +355,16 @@ func BuildDatabase(site_server *SiteServer) {
 
 	// import shows
 	shows_dir := path.Join(MEDIA_ROOT, MEDIA_SHOWS_DIR)
-	shows_dir_files := GetInfoFiles(shows_dir)
+	shows_dir_files, err := GetInfoFiles(shows_dir)
+	if err != nil {
+		errs = append(errs, err)
+	}
 	for _, file := range shows_dir_files {
 		var show_data structs.ShowData
-		blob, err = ioutil.ReadFile(file)
-		common.CheckErr(err)
-		err = json.Unmarshal(blob, &show_data)
-		common.CheckErr(err)
+		if err := ReadInfoFile(file, &show_data); err != nil {
+			errs = append(errs, err)
+			continue
+		}
 
 		show_idx := [2]int{
 			SHOW_IDX,
@@ -254,6 +386,7 @@ func BuildDatabase(site_server *SiteServer) {
 			site_server.seasons = append(site_server.seasons, season_data)
 		}
 	}
+	return errs
 }
 
 //
@@ -311,8 +444,7 @@ func ShufflePermutation(
 	permutation [][2]int,
 	seed int64,
 ) {
-	rand.Seed(seed)
-	rand.Shuffle(
+	rand.New(rand.NewSource(seed)).Shuffle(
 		len(permutation),
 		func(i, j int) {
 			permutation[i], permutation[j] = permutation[j], permutation[i]
@@ -332,7 +464,8 @@ func MakeResultCards(
 	var result_cards ResultCards
 	var len_permutation, num_cards int
 
-	len_permutation = len(site_server.permutations[perm_key])
+	permutation := site_server.Permutation(perm_key)
+	len_permutation = len(permutation)
 
 	if first >= last {
 		log.Printf("Invalid range: first = %d  and last = %d", first, last)
@@ -352,7 +485,7 @@ func MakeResultCards(
 
 		card_idx := 0
 		for permutation_idx := first; permutation_idx < last; permutation_idx++ {
-			value := site_server.permutations[perm_key][permutation_idx]
+			value := permutation[permutation_idx]
 
 			if value[0] == LONELY_FILM_IDX || value[0] == COLLECTION_FILM_IDX {
 				film := site_server.films[value[1]]
@@ -368,9 +501,8 @@ func MakeResultCards(
 					result_cards.Cards[card_idx].Picture =
 						"files/empty_poster.jpg"
 				}
-				_, result_cards.Cards[card_idx].Watchable = FindFileType(
+				_, _, result_cards.Cards[card_idx].Watchable = FindPlayableFile(
 					film.FilmFiles,
-					"mp4",
 				)
 			}
 			switch value[0] {
@@ -470,6 +602,120 @@ func MakeInfoCards(
 	return info_cards
 }
 
+//
+// Describes a track by its language and codec
+//
+func TrackSummary(track structs.TrackInfo) string {
+	if track.Language == "" {
+		return track.Codec
+	}
+	return track.Language + " " + track.Codec
+}
+
+//
+// Describes what probing a video found in it,
+// its dimensions, codec, duration and tracks,
+// or "" if it hasn't been probed
+//
+func MediaSummary(media *structs.MediaInfo) string {
+	if media == nil {
+		return ""
+	}
+	var parts []string
+	if media.Width > 0 {
+		parts = append(
+			parts,
+			fmt.Sprintf("%dx%d %s", media.Width, media.Height, media.VideoCodec),
+		)
+	}
+	if media.Duration > 0 {
+		seconds := int(media.Duration)
+		parts = append(
+			parts,
+			fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60),
+		)
+	}
+	var tracks []string
+	for _, track := range media.AudioTracks {
+		tracks = append(tracks, TrackSummary(track))
+	}
+	if len(tracks) > 0 {
+		parts = append(parts, "audio: "+strings.Join(tracks, ", "))
+	}
+	tracks = nil
+	for _, track := range media.SubtitleTracks {
+		tracks = append(tracks, TrackSummary(track))
+	}
+	if len(tracks) > 0 {
+		parts = append(parts, "subtitles: "+strings.Join(tracks, ", "))
+	}
+	if !media.BrowserPlayable {
+		parts = append(parts, "may not play in browsers")
+	}
+	return strings.Join(parts, " | ")
+}
+
+//
+// Formats seconds as a WebVTT time, 01:02:03.500
+//
+func VTTTime(seconds float64) string {
+	millis := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf(
+		"%02d:%02d:%02d.%03d",
+		millis/3600000,
+		millis/60000%60,
+		millis/1000%60,
+		millis%1000,
+	)
+}
+
+//
+// Lists a video's chapters for its watch card.
+// Each chapter lasts until the next one and the last until the video ends.
+//
+func WatchChapters(media *structs.MediaInfo) []WatchChapter {
+	if media == nil {
+		return nil
+	}
+	chapters := make([]WatchChapter, len(media.Chapters))
+	for idx, chapter := range media.Chapters {
+		end := media.Duration
+		if idx+1 < len(media.Chapters) {
+			end = media.Chapters[idx+1].Start
+		}
+		if end < chapter.Start {
+			end = chapter.Start
+		}
+		chapters[idx] = WatchChapter{
+			chapter.Start,
+			end,
+			VTTTime(chapter.Start)[:8],
+			chapter.Title,
+		}
+	}
+	return chapters
+}
+
+//
+// Writes chapters as a WebVTT chapters track
+//
+func ChaptersVTT(chapters []WatchChapter) string {
+	escaper := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\n", " ")
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	for idx, chapter := range chapters {
+		fmt.Fprintf(
+			&vtt,
+			"\n%d\n%s --> %s\n%s\n",
+			idx+1,
+			VTTTime(chapter.Start),
+			VTTTime(chapter.End),
+			escaper.Replace(chapter.Title),
+		)
+	}
+	return vtt.String()
+}
+
 //
 // Returns watch cards for items with the provided index
 //
@@ -480,10 +726,11 @@ func MakeWatchCards(
 	var watch_cards WatchCards
 
 	item_idx := site_server.id2idx[item_id]
+	watch_cards.Id = item_id
 
 	if item_idx[0] == LONELY_FILM_IDX || item_idx[0] == COLLECTION_FILM_IDX {
 		film := site_server.films[item_idx[1]]
-		film_file, _ := FindFileType(film.FilmFiles, "mp4")
+		film_file, video_type, _ := FindPlayableFile(film.FilmFiles)
 
 		watch_cards.Name = film.Title
 
@@ -492,7 +739,10 @@ func MakeWatchCards(
 			film.Title,
 			film.ReleaseDate,
 			film_file.Path,
-			film_file.Type,
+			video_type,
+			MediaSummary(film_file.Media),
+			WatchChapters(film_file.Media),
+			FindVersions(film.FilmFiles, film_file),
 		}
 	}
 	switch item_idx[0] {
@@ -503,13 +753,16 @@ func MakeWatchCards(
 		watch_cards.Cards = make([]WatchCard, len(collection.Films))
 
 		for idx, film := range collection.Films {
-			film_file, _ := FindFileType(film.FilmFiles, "mp4")
+			film_file, video_type, _ := FindPlayableFile(film.FilmFiles)
 
 			watch_cards.Cards[idx] = WatchCard{
 				film.Title,
 				film.ReleaseDate,
 				film_file.Path,
-				film_file.Type,
+				video_type,
+				MediaSummary(film_file.Media),
+				WatchChapters(film_file.Media),
+				FindVersions(film.FilmFiles, film_file),
 			}
 		}
 
@@ -520,13 +773,16 @@ func MakeWatchCards(
 		watch_cards.Cards = make([]WatchCard, len(season.Episodes))
 
 		for idx, episode := range season.Episodes {
-			episode_file, _ := FindFileType(episode.Files, "mp4")
+			episode_file, video_type, _ := FindPlayableFile(episode.Files)
 
 			watch_cards.Cards[idx] = WatchCard{
 				episode.Name,
 				episode.AirDate,
 				episode_file.Path,
-				episode_file.Type,
+				video_type,
+				MediaSummary(episode_file.Media),
+				WatchChapters(episode_file.Media),
+				FindVersions(episode.Files, episode_file),
 			}
 		}
 
@@ -544,13 +800,16 @@ func MakeWatchCards(
 
 		for _, season := range show.Seasons {
 			for _, episode := range season.Episodes {
-				episode_file, _ := FindFileType(episode.Files, "mp4")
+				episode_file, video_type, _ := FindPlayableFile(episode.Files)
 
 				watch_cards.Cards[card_idx] = WatchCard{
 					episode.Name,
 					episode.AirDate,
 					episode_file.Path,
-					episode_file.Type,
+					video_type,
+					MediaSummary(episode_file.Media),
+					WatchChapters(episode_file.Media),
+					FindVersions(episode.Files, episode_file),
 				}
 				card_idx++
 			}
@@ -559,6 +818,54 @@ func MakeWatchCards(
 	return watch_cards
 }
 
+//
+// Finds a file of an item's films or episodes by its path
+//
+func FindItemFile(
+	site_server *SiteServer,
+	item_id string,
+	file_path string,
+) (
+	structs.FileData,
+	bool,
+) {
+	var files [][]structs.FileData
+
+	item_idx, found := site_server.id2idx[item_id]
+	if !found {
+		return structs.FileData{}, false
+	}
+	switch item_idx[0] {
+	case LONELY_FILM_IDX, COLLECTION_FILM_IDX:
+		files = append(files, site_server.films[item_idx[1]].FilmFiles)
+
+	case COLLECTION_IDX:
+		for _, film := range site_server.collections[item_idx[1]].Films {
+			files = append(files, film.FilmFiles)
+		}
+
+	case SEASON_IDX:
+		for _, episode := range site_server.seasons[item_idx[1]].Episodes {
+			files = append(files, episode.Files)
+		}
+
+	case SHOW_IDX:
+		for _, season := range site_server.shows[item_idx[1]].Seasons {
+			for _, episode := range season.Episodes {
+				files = append(files, episode.Files)
+			}
+		}
+	}
+	for _, item_files := range files {
+		for _, file := range item_files {
+			if file.Path == file_path {
+				return file, true
+			}
+		}
+	}
+	return structs.FileData{}, false
+}
+
 //
 // Handles root requests.
 //
@@ -570,16 +877,67 @@ func RootHandler(w http.ResponseWriter, r *http.Request) {
 // Site Server
 //---------------------------------------------------------------------------
 //
-// Holds data for the site server
+// Holds data for the site server.
+// Pages are served under a read lock, while reloading swaps the library
+// in under the write lock.
+// Permutations are made as pages are served, so they have their own lock.
 //
 type SiteServer struct {
-	media_root   string
-	collections  []structs.CollectionData
-	films        []structs.FilmData
-	shows        []structs.ShowData
-	seasons      []structs.SeasonData
-	id2idx       map[string][2]int
-	permutations map[string][][2]int
+	lock              sync.RWMutex
+	permutations_lock sync.Mutex
+	media_root        string
+	collections       []structs.CollectionData
+	films             []structs.FilmData
+	shows             []structs.ShowData
+	seasons           []structs.SeasonData
+	id2idx            map[string][2]int
+	permutations      map[string][][2]int
+}
+
+//
+// Reloads the library, such as after something has been placed in it.
+// If any info file can't be loaded, such as one being rewritten
+// by a relayout, the library is kept as it was.
+//
+func (data *SiteServer) Reload() error {
+	fresh := new(SiteServer)
+	if errs := BuildDatabase(fresh); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("%v\n", err)
+		}
+		return fmt.Errorf(
+			"%d info files couldn't be loaded, keeping the library as it was",
+			len(errs),
+		)
+	}
+
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	data.collections = fresh.collections
+	data.films = fresh.films
+	data.shows = fresh.shows
+	data.seasons = fresh.seasons
+	data.id2idx = fresh.id2idx
+	data.permutations = fresh.permutations
+	return nil
+}
+
+//
+// Gets a permutation of the library's items
+//
+func (data *SiteServer) Permutation(key string) [][2]int {
+	data.permutations_lock.Lock()
+	defer data.permutations_lock.Unlock()
+	return data.permutations[key]
+}
+
+//
+// Keeps a permutation of the library's items
+//
+func (data *SiteServer) SetPermutation(key string, permutation [][2]int) {
+	data.permutations_lock.Lock()
+	defer data.permutations_lock.Unlock()
+	data.permutations[key] = permutation
 }
 
 //
@@ -607,10 +965,10 @@ func (data *SiteServer) HandleResults(w http.ResponseWriter, r *http.Request) {
 		if query_exists {
 			perm_key = "q_" + form["q"][0]
 			log.Printf("Serving query %s\n", perm_key)
-			data.permutations[perm_key] = SearchItems(
+			data.SetPermutation(perm_key, SearchItems(
 				data,
 				form["q"][0],
-			)
+			))
 		} else if seed_exists {
 			perm_key = "s_" + form["s"][0]
 			log.Printf("Serving site with seed %s\n", perm_key)
@@ -618,8 +976,10 @@ func (data *SiteServer) HandleResults(w http.ResponseWriter, r *http.Request) {
 			seed, err := strconv.ParseInt(form["s"][0], 16, 64)
 			common.CheckErr(err)
 
-			data.permutations[perm_key] = data.permutations["original"]
-			ShufflePermutation(data.permutations[perm_key], seed)
+			// shuffled as a copy, as other requests are reading the original
+			shuffled := append([][2]int(nil), data.Permutation("original")...)
+			ShufflePermutation(shuffled, seed)
+			data.SetPermutation(perm_key, shuffled)
 		}
 
 		result_cards := MakeResultCards(data, perm_key, 0, 24)
@@ -666,6 +1026,26 @@ func (data *SiteServer) HandleWatch(w http.ResponseWriter, r *http.Request) {
 	common.CheckErr(err)
 }
 
+//
+// Handles /chapters requests,
+// giving the chapters of one of an item's videos as WebVTT
+//
+func (data *SiteServer) HandleChapters(w http.ResponseWriter, r *http.Request) {
+	watch_id := r.FormValue("id")
+	video := r.FormValue("video")
+
+	file, found := FindItemFile(data, watch_id, video)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("Serving chapters for '%s'.\n", video)
+
+	w.Header().Add("Content-Type", "text/vtt; charset=utf-8")
+	_, err := w.Write([]byte(ChaptersVTT(WatchChapters(file.Media))))
+	common.CheckErr(err)
+}
+
 //
 // Handles /xml requests
 //
@@ -705,6 +1085,8 @@ func (data *SiteServer) HandleXML(w http.ResponseWriter, r *http.Request) {
 // Handles site requests
 //
 func (data *SiteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data.lock.RLock()
+	defer data.lock.RUnlock()
 	switch path := r.URL.Path; path {
 	case "/results":
 		data.HandleResults(w, r)
@@ -712,6 +1094,8 @@ func (data *SiteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		data.HandleInfo(w, r)
 	case "/watch":
 		data.HandleWatch(w, r)
+	case "/chapters":
+		data.HandleChapters(w, r)
 	case "/xml":
 		data.HandleXML(w, r)
 	}
@@ -725,7 +1109,12 @@ func main() {
 	file_server := http.FileServer(http.Dir("."))
 	site_server := new(SiteServer)
 
-	BuildDatabase(site_server)
+	if errs := BuildDatabase(site_server); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("%v\n", err)
+		}
+		log.Fatal("Couldn't load the library.")
+	}
 
 	log.Printf("Loaded %d Collecions.\n", len(site_server.collections))
 	log.Printf("Loaded %d Films.\n", len(site_server.films))
@@ -738,6 +1127,16 @@ func main() {
 	http.Handle("/results", site_server)
 	http.Handle("/info", site_server)
 	http.Handle("/watch", site_server)
+	http.Handle("/chapters", site_server)
 	http.Handle("/xml", site_server)
+
+	ingester := NewIngester(site_server)
+	http.Handle("/admin", ingester)
+	http.Handle("/match", ingester)
+	http.Handle("/ingest", ingester)
+	http.Handle("/job", ingester)
+	http.Handle("/progress", ingester)
+	http.Handle("/poster", ingester)
+	http.Handle("/rescan", ingester)
 	http.ListenAndServe(":8042", nil)
 }
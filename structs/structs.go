@@ -1,5 +1,19 @@
 package structs
 
+import (
+	"path"
+	"path/filepath"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Version of the info file format written by this version of serviam.
+// Bump it and add a migration to the library package when the format changes.
+//
+const SCHEMA_VERSION = 1
+
 //---------------------------------------------------------------------------
 // Serviam Structures
 //---------------------------------------------------------------------------
@@ -7,39 +21,44 @@ package structs
 // Collection Data Structure
 //
 type CollectionData struct {
-	Name         string     `json:"name"`
-	PosterFile   FileData   `json:"poster_file"`
-	BackdropFile FileData   `json:"backdrop_file"`
-	Films        []FilmData `json:"films"`
-	TMDBId       int        `json:"tmdb_id"`
+	SchemaVersion int        `json:"schema_version"`
+	Name          string     `json:"name"`
+	PosterFile    FileData   `json:"poster_file"`
+	BackdropFile  FileData   `json:"backdrop_file"`
+	Films         []FilmData `json:"films"`
+	TMDBId        int        `json:"tmdb_id"`
+	Locked        []string   `json:"locked,omitempty"`
 }
 
 //
 // Film Data Structure
 //
 type FilmData struct {
-	Id           string      `json:"id"`
-	Title        string      `json:"title"`
-	Tagline      string      `json:"tagline"`
-	Overview     string      `json:"overview"`
-	ReleaseDate  string      `json:"release_date"`
-	Runtime      int         `json:"runtime"`
-	PosterFile   FileData    `json:"poster_file"`
-	BackdropFile FileData    `json:"backdrop_file"`
-	FilmFiles    []FileData  `json:"film_files"`
-	Genres       []TMDBGenre `json:"genres"`
-	TMDBId       int         `json:"tmdb_id"`
-	Budget       uint        `json:"budget"`
-	Revenue      uint        `json:"revenue"`
-	VoteAverage  float64     `json:"vote_average"`
-	VoteCount    int         `json:"vote_count"`
-	Popularity   float64     `json:"popularity"`
+	SchemaVersion int         `json:"schema_version"`
+	Id            string      `json:"id"`
+	Title         string      `json:"title"`
+	Tagline       string      `json:"tagline"`
+	Overview      string      `json:"overview"`
+	ReleaseDate   string      `json:"release_date"`
+	Runtime       int         `json:"runtime"`
+	PosterFile    FileData    `json:"poster_file"`
+	BackdropFile  FileData    `json:"backdrop_file"`
+	FilmFiles     []FileData  `json:"film_files"`
+	Genres        []TMDBGenre `json:"genres"`
+	TMDBId        int         `json:"tmdb_id"`
+	Budget        uint        `json:"budget"`
+	Revenue       uint        `json:"revenue"`
+	VoteAverage   float64     `json:"vote_average"`
+	VoteCount     int         `json:"vote_count"`
+	Popularity    float64     `json:"popularity"`
+	Locked        []string    `json:"locked,omitempty"`
 }
 
 //
 // Show Data Structure
 //
 type ShowData struct {
+	SchemaVersion    int          `json:"schema_version"`
 	Id               string       `json:"id"`
 	Name             string       `json:"name"`
 	FirstAirDate     string       `json:"first_air_date"`
@@ -56,6 +75,7 @@ type ShowData struct {
 	VoteAverage      float64      `json:"vote_average"`
 	VoteCount        int          `json:"vote_count"`
 	Popularity       float64      `json:"popularity"`
+	Locked           []string     `json:"locked,omitempty"`
 }
 
 //
@@ -70,6 +90,7 @@ type SeasonData struct {
 	PosterFile   FileData      `json:"poster_file"`
 	Episodes     []EpisodeData `json:"episodes"`
 	TMDBId       int           `json:"tmdb_id"`
+	Locked       []string      `json:"locked,omitempty"`
 }
 
 //
@@ -86,15 +107,71 @@ type EpisodeData struct {
 	TMDBId        int        `json:"tmdb_id"`
 	VoteAverage   float64    `json:"vote_average"`
 	VoteCount     int        `json:"vote_count"`
+	Locked        []string   `json:"locked,omitempty"`
 }
 
 //
-// File Data Structure
+// File Data Structure.
+// Placement is how a film or episode file was put in the media directory
+// (move, copy, hardlink, symlink or reflink), empty if it isn't known.
+// Sidecars such as subtitles record their language and flags
+// (forced, sdh, default).
+// Videos which have been probed record what is in them.
+// Videos are versions of their film or episode,
+// labelled by their edition, resolution and source (e.g. BluRay).
+// Videos record their size and a hash of blocks sampled through them,
+// to find the same video placed twice.
 //
 type FileData struct {
-	Name string `json:"name"`
-	Path string `json:"path"`
-	Type string `json:"type"`
+	Name       string     `json:"name"`
+	Path       string     `json:"path"`
+	Type       string     `json:"type"`
+	Placement  string     `json:"placement,omitempty"`
+	Language   string     `json:"language,omitempty"`
+	Flags      []string   `json:"flags,omitempty"`
+	Media      *MediaInfo `json:"media,omitempty"`
+	Label      string     `json:"label,omitempty"`
+	Edition    string     `json:"edition,omitempty"`
+	Resolution string     `json:"resolution,omitempty"`
+	Source     string     `json:"source,omitempty"`
+	Size       int64      `json:"size,omitempty"`
+	Hash       string     `json:"hash,omitempty"`
+}
+
+//
+// Media Info Structure.
+// What probing a video found in it,
+// its duration in seconds, the codecs of its tracks and its chapters.
+// BrowserPlayable says whether browsers can play it without converting it.
+//
+type MediaInfo struct {
+	Container       string        `json:"container"`
+	Duration        float64       `json:"duration"`
+	Width           int           `json:"width"`
+	Height          int           `json:"height"`
+	VideoCodec      string        `json:"video_codec"`
+	AudioTracks     []TrackInfo   `json:"audio_tracks,omitempty"`
+	SubtitleTracks  []TrackInfo   `json:"subtitle_tracks,omitempty"`
+	Chapters        []ChapterInfo `json:"chapters,omitempty"`
+	BrowserPlayable bool          `json:"browser_playable"`
+}
+
+//
+// Track Info Structure.
+// An audio or subtitle track of a video.
+//
+type TrackInfo struct {
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+}
+
+//
+// Chapter Info Structure.
+// Where a chapter of a video starts, in seconds.
+//
+type ChapterInfo struct {
+	Start float64 `json:"start"`
+	Title string  `json:"title"`
 }
 
 //---------------------------------------------------------------------------
@@ -250,6 +327,22 @@ type TMDBGenre struct {
 //---------------------------------------------------------------------------
 // Functions
 //---------------------------------------------------------------------------
+//
+// Makes the FileData of a file called name in sub_dir,
+// typing the file by its extension.
+//
+func NewFileData(name string, sub_dir string) FileData {
+	file_type := filepath.Ext(name)
+	if file_type != "" {
+		file_type = file_type[1:]
+	}
+	return FileData{
+		Name: name,
+		Path: path.Join(sub_dir, name),
+		Type: file_type,
+	}
+}
+
 //
 // Converts a TMDBMovie struct to a FilmData struct
 //
@@ -261,22 +354,23 @@ func TMDBMovieToFilmData(
 	film_files *[]FileData,
 ) FilmData {
 	return FilmData{
-		*id,
-		tmdb_movie.Title,
-		tmdb_movie.Tagline,
-		tmdb_movie.Overview,
-		tmdb_movie.ReleaseDate,
-		tmdb_movie.Runtime,
-		*poster_file,
-		*backdrop_file,
-		*film_files,
-		tmdb_movie.Genres,
-		tmdb_movie.Id,
-		tmdb_movie.Budget,
-		tmdb_movie.Revenue,
-		tmdb_movie.VoteAverage,
-		tmdb_movie.VoteCount,
-		tmdb_movie.Popularity,
+		SchemaVersion: SCHEMA_VERSION,
+		Id:            *id,
+		Title:         tmdb_movie.Title,
+		Tagline:       tmdb_movie.Tagline,
+		Overview:      tmdb_movie.Overview,
+		ReleaseDate:   tmdb_movie.ReleaseDate,
+		Runtime:       tmdb_movie.Runtime,
+		PosterFile:    *poster_file,
+		BackdropFile:  *backdrop_file,
+		FilmFiles:     *film_files,
+		Genres:        tmdb_movie.Genres,
+		TMDBId:        tmdb_movie.Id,
+		Budget:        tmdb_movie.Budget,
+		Revenue:       tmdb_movie.Revenue,
+		VoteAverage:   tmdb_movie.VoteAverage,
+		VoteCount:     tmdb_movie.VoteCount,
+		Popularity:    tmdb_movie.Popularity,
 	}
 }
 
@@ -290,11 +384,12 @@ func TMDBCollectionToCollectionData(
 	films *[]FilmData,
 ) CollectionData {
 	return CollectionData{
-		tmdb_collection.Name,
-		*poster_file,
-		*backdrop_file,
-		*films,
-		tmdb_collection.Id,
+		SchemaVersion: SCHEMA_VERSION,
+		Name:          tmdb_collection.Name,
+		PosterFile:    *poster_file,
+		BackdropFile:  *backdrop_file,
+		Films:         *films,
+		TMDBId:        tmdb_collection.Id,
 	}
 }
 
@@ -308,16 +403,16 @@ func TMDBEpisodeToEpisodeData(
 	episode_files *[]FileData,
 ) EpisodeData {
 	return EpisodeData{
-		*id,
-		tmdb_episode.EpisodeNumber,
-		tmdb_episode.Name,
-		tmdb_episode.AirDate,
-		tmdb_episode.Overview,
-		*still_file,
-		*episode_files,
-		tmdb_episode.Id,
-		tmdb_episode.VoteAverage,
-		tmdb_episode.VoteCount,
+		Id:            *id,
+		EpisodeNumber: tmdb_episode.EpisodeNumber,
+		Name:          tmdb_episode.Name,
+		AirDate:       tmdb_episode.AirDate,
+		Overview:      tmdb_episode.Overview,
+		StillFile:     *still_file,
+		Files:         *episode_files,
+		TMDBId:        tmdb_episode.Id,
+		VoteAverage:   tmdb_episode.VoteAverage,
+		VoteCount:     tmdb_episode.VoteCount,
 	}
 }
 
@@ -331,14 +426,14 @@ func TMDBSeasonToSeasonData(
 	episodes *[]EpisodeData,
 ) SeasonData {
 	return SeasonData{
-		*id,
-		tmdb_season.SeasonNumber,
-		tmdb_season.Name,
-		tmdb_season.AirDate,
-		tmdb_season.Overview,
-		*poster_file,
-		*episodes,
-		tmdb_season.Id,
+		Id:           *id,
+		SeasonNumber: tmdb_season.SeasonNumber,
+		Name:         tmdb_season.Name,
+		AirDate:      tmdb_season.AirDate,
+		Overview:     tmdb_season.Overview,
+		PosterFile:   *poster_file,
+		Episodes:     *episodes,
+		TMDBId:       tmdb_season.Id,
 	}
 }
 
@@ -353,21 +448,22 @@ func TMDBTVToShowData(
 	seasons *[]SeasonData,
 ) ShowData {
 	return ShowData{
-		*id,
-		tmdb_tv.Name,
-		tmdb_tv.FirstAirDate,
-		tmdb_tv.Overview,
-		tmdb_tv.NumberOfSeasons,
-		tmdb_tv.NumberOfEpisodes,
-		tmdb_tv.EpisodeRunTime,
-		*poster_file,
-		*backdrop_file,
-		*seasons,
-		tmdb_tv.Genres,
-		tmdb_tv.Type,
-		tmdb_tv.Id,
-		tmdb_tv.VoteAverage,
-		tmdb_tv.VoteCount,
-		tmdb_tv.Popularity,
+		SchemaVersion:    SCHEMA_VERSION,
+		Id:               *id,
+		Name:             tmdb_tv.Name,
+		FirstAirDate:     tmdb_tv.FirstAirDate,
+		Overview:         tmdb_tv.Overview,
+		NumberOfSeasons:  tmdb_tv.NumberOfSeasons,
+		NumberOfEpisodes: tmdb_tv.NumberOfEpisodes,
+		EpisodeRunTime:   tmdb_tv.EpisodeRunTime,
+		PosterFile:       *poster_file,
+		BackdropFile:     *backdrop_file,
+		Seasons:          *seasons,
+		Genres:           tmdb_tv.Genres,
+		Type:             tmdb_tv.Type,
+		TMDBId:           tmdb_tv.Id,
+		VoteAverage:      tmdb_tv.VoteAverage,
+		VoteCount:        tmdb_tv.VoteCount,
+		Popularity:       tmdb_tv.Popularity,
 	}
 }
@@ -0,0 +1,197 @@
+package tmdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Environment variables which configure the cache
+//
+const (
+	CACHE_DIR_ENV = "TMDB_CACHE_DIR"
+	CACHE_TTL_ENV = "TMDB_CACHE_TTL"
+	OFFLINE_ENV   = "TMDB_OFFLINE"
+)
+
+//
+// How long responses are fresh for
+//
+const (
+	SEARCH_TTL  = 24 * time.Hour
+	DETAILS_TTL = 7 * 24 * time.Hour
+	IMAGE_TTL   = 30 * 24 * time.Hour
+)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// Returned when offline and a request has not been cached
+//
+type OfflineError struct {
+	URL     string
+	NoCache bool
+}
+
+//
+// Describes the offline error
+//
+func (err *OfflineError) Error() string {
+	if err.NoCache {
+		return fmt.Sprintf("offline and there is no cache to get '%s' from", err.URL)
+	}
+	return fmt.Sprintf("offline and '%s' is not in the cache", err.URL)
+}
+
+//
+// A cached response
+//
+type CacheEntry struct {
+	URL     string    `json:"url"`
+	Fetched time.Time `json:"fetched"`
+	Body    []byte    `json:"body"`
+}
+
+//
+// An on disk cache of responses, keyed by request URL without the API key.
+// When offline, every request is served from the cache however old it is.
+// Without a directory nothing is cached, so offline every request fails.
+//
+type Cache struct {
+	Dir        string
+	Offline    bool
+	SearchTTL  time.Duration
+	DetailsTTL time.Duration
+	ImageTTL   time.Duration
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Makes a cache configured by the environment.
+// TMDB_CACHE_DIR sets the directory, or turns the cache off if set to "off",
+// TMDB_CACHE_TTL overrides every time to live (e.g. "48h")
+// and TMDB_OFFLINE set to "1" serves everything from the cache.
+// If there is no user cache directory the cache is turned off with a warning.
+//
+func NewCacheFromEnv() (*Cache, error) {
+	cache := &Cache{
+		SearchTTL:  SEARCH_TTL,
+		DetailsTTL: DETAILS_TTL,
+		ImageTTL:   IMAGE_TTL,
+	}
+
+	switch strings.ToLower(os.Getenv(OFFLINE_ENV)) {
+	case "1", "true", "yes":
+		cache.Offline = true
+	}
+
+	cache.Dir = os.Getenv(CACHE_DIR_ENV)
+	if cache.Dir == "off" {
+		cache.Dir = ""
+	} else if cache.Dir == "" {
+		user_cache_dir, err := os.UserCacheDir()
+		if err != nil {
+			log.Printf("Not caching TMDB responses, there is no cache directory: %v\n", err)
+		} else {
+			cache.Dir = filepath.Join(user_cache_dir, "serviam", "tmdb")
+		}
+	}
+	if cache.Dir == "" && cache.Offline {
+		log.Printf("Offline without a TMDB cache, so nothing can be fetched.\n")
+	}
+
+	if env_ttl := os.Getenv(CACHE_TTL_ENV); env_ttl != "" {
+		ttl, err := time.ParseDuration(env_ttl)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s '%s': %v", CACHE_TTL_ENV, env_ttl, err)
+		}
+		cache.SearchTTL = ttl
+		cache.DetailsTTL = ttl
+		cache.ImageTTL = ttl
+	}
+	return cache, nil
+}
+
+//
+// Picks the time to live of an API request from its endpoint
+//
+func (cache *Cache) TTL(endpoint string) time.Duration {
+	if strings.HasPrefix(endpoint, "/search/") {
+		return cache.SearchTTL
+	}
+	return cache.DetailsTTL
+}
+
+//
+// Gets the location of a request's cache file
+//
+func (cache *Cache) Location(cache_url string) string {
+	sum := sha256.Sum256([]byte(cache_url))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(cache.Dir, key[:2], key+".json")
+}
+
+//
+// Loads a cached response.
+// Stale responses are only returned when offline.
+//
+func (cache *Cache) Load(cache_url string, ttl time.Duration) ([]byte, bool) {
+	var entry CacheEntry
+
+	if cache.Dir == "" {
+		return nil, false
+	}
+	blob, err := ioutil.ReadFile(cache.Location(cache_url))
+	if err != nil {
+		return nil, false
+	}
+	if json.Unmarshal(blob, &entry) != nil || entry.URL != cache_url {
+		return nil, false
+	}
+	if !cache.Offline && time.Since(entry.Fetched) > ttl {
+		return nil, false
+	}
+	return entry.Body, true
+}
+
+//
+// Stores a response in the cache
+//
+func (cache *Cache) Store(cache_url string, body []byte) error {
+	if cache.Dir == "" {
+		return nil
+	}
+	location := cache.Location(cache_url)
+	err := os.MkdirAll(filepath.Dir(location), 0755)
+	if err != nil {
+		return err
+	}
+	blob, err := json.Marshal(CacheEntry{
+		URL:     cache_url,
+		Fetched: time.Now(),
+		Body:    body,
+	})
+	if err != nil {
+		return err
+	}
+	tmp_location := location + ".part"
+	err = ioutil.WriteFile(tmp_location, blob, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp_location, location)
+}
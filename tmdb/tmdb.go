@@ -0,0 +1,545 @@
+package tmdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"serviam/structs"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// URL Prefixes
+//
+const (
+	DEFAULT_API_URL   = "https://api.themoviedb.org/3"
+	DEFAULT_IMAGE_URL = "https://image.tmdb.org/t/p/original"
+)
+
+//
+// Environment variables which override the URL prefixes
+//
+const (
+	API_URL_ENV   = "TMDB_API_URL"
+	IMAGE_URL_ENV = "TMDB_IMAGE_URL"
+)
+
+//
+// Settings
+//
+const (
+	TIMEOUT       = 30 * time.Second
+	MAX_RETRIES   = 5
+	FIRST_BACKOFF = 1 * time.Second
+	MAX_BACKOFF   = 60 * time.Second
+	RATE_REQUESTS = 40
+	RATE_PERIOD   = 10 * time.Second
+)
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// Returned when TMDB answers with a status other than OK
+//
+type StatusError struct {
+	Endpoint   string
+	StatusCode int
+	Body       string
+}
+
+//
+// Describes the status error
+//
+func (err *StatusError) Error() string {
+	return fmt.Sprintf(
+		"'%s' returned status code %d: %s",
+		err.Endpoint,
+		err.StatusCode,
+		err.Body,
+	)
+}
+
+//
+// Spaces requests out so no more than a number are made in a period
+//
+type RateLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+//
+// Makes a rate limiter allowing requests every period
+//
+func NewRateLimiter(requests int, period time.Duration) *RateLimiter {
+	return &RateLimiter{interval: period / time.Duration(requests)}
+}
+
+//
+// Waits until the next request is allowed
+//
+func (limiter *RateLimiter) Wait(ctx context.Context) error {
+	limiter.mutex.Lock()
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	wait := limiter.next.Sub(now)
+	limiter.next = limiter.next.Add(limiter.interval)
+	limiter.mutex.Unlock()
+
+	return Sleep(ctx, wait)
+}
+
+//
+// A TMDB API client
+//
+type Client struct {
+	HTTPClient *http.Client
+	APIKey     string
+	APIURL     string
+	ImageURL   string
+	MaxRetries int
+	Limiter    *RateLimiter
+	Cache      *Cache
+}
+
+//---------------------------------------------------------------------------
+// Helper Functions
+//---------------------------------------------------------------------------
+//
+// Sleeps for a duration unless the context finishes first
+//
+func Sleep(ctx context.Context, duration time.Duration) error {
+	if duration <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+//
+// Works out how long to wait before retrying.
+// A Retry-After header, in seconds or as a date, is honoured,
+// otherwise the wait doubles with each attempt.
+//
+func Backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		retry_after := resp.Header.Get("Retry-After")
+		if seconds, err := strconv.Atoi(retry_after); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(retry_after); err == nil {
+			return time.Until(date)
+		}
+	}
+	backoff := FIRST_BACKOFF << uint(attempt)
+	if backoff > MAX_BACKOFF || backoff <= 0 {
+		backoff = MAX_BACKOFF
+	}
+	jitter := time.Duration(rand.Int63n(int64(backoff) / 4))
+	return backoff + jitter
+}
+
+//
+// Checks whether a response status is worth retrying
+//
+func Retryable(status_code int) bool {
+	return status_code == http.StatusTooManyRequests || status_code >= 500
+}
+
+//---------------------------------------------------------------------------
+// Client Functions
+//---------------------------------------------------------------------------
+//
+// Makes a client with the default settings.
+// The URL prefixes can be overridden with the TMDB_API_URL
+// and TMDB_IMAGE_URL environment variables, e.g. to use a local stub,
+// and the response cache is configured as in NewCacheFromEnv.
+//
+func NewClient(api_key string) *Client {
+	cache, err := NewCacheFromEnv()
+	if err != nil {
+		log.Fatalf("Couldn't set up the TMDB cache: %v.", err)
+	}
+
+	api_url := DEFAULT_API_URL
+	if env_url := os.Getenv(API_URL_ENV); env_url != "" {
+		api_url = env_url
+	}
+	image_url := DEFAULT_IMAGE_URL
+	if env_url := os.Getenv(IMAGE_URL_ENV); env_url != "" {
+		image_url = env_url
+	}
+	return &Client{
+		HTTPClient: &http.Client{Timeout: TIMEOUT},
+		APIKey:     api_key,
+		APIURL:     strings.TrimSuffix(api_url, "/"),
+		ImageURL:   strings.TrimSuffix(image_url, "/"),
+		MaxRetries: MAX_RETRIES,
+		Limiter:    NewRateLimiter(RATE_REQUESTS, RATE_PERIOD),
+		Cache:      cache,
+	}
+}
+
+//
+// Makes the URL of an API endpoint, without the API key
+//
+func (client *Client) EndpointURL(endpoint string, query url.Values) string {
+	if len(query) == 0 {
+		return client.APIURL + endpoint
+	}
+	return client.APIURL + endpoint + "?" + query.Encode()
+}
+
+//
+// Makes the URL of an API endpoint, with the API key.
+// Version 4 read access tokens are sent as a header instead.
+//
+func (client *Client) KeyedEndpointURL(endpoint string, query url.Values) string {
+	keyed_query := url.Values{}
+	for key, values := range query {
+		keyed_query[key] = values
+	}
+	if !client.BearerAuth() {
+		keyed_query.Set("api_key", client.APIKey)
+	}
+	return client.EndpointURL(endpoint, keyed_query)
+}
+
+//
+// Checks whether the API key is a version 4 read access token
+//
+func (client *Client) BearerAuth() bool {
+	return strings.HasPrefix(client.APIKey, "eyJ")
+}
+
+//
+// Makes a request, retrying transient failures,
+// and returns the body of the OK response
+//
+func (client *Client) Fetch(
+	ctx context.Context,
+	endpoint string,
+	full_url string,
+	bearer bool,
+) (
+	[]byte,
+	error,
+) {
+	var last_err error
+
+	for attempt := 0; attempt <= client.MaxRetries; attempt++ {
+		if client.Limiter != nil {
+			if err := client.Limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		req, err := http.NewRequest("GET", full_url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if bearer {
+			req.Header.Set("Authorization", "Bearer "+client.APIKey)
+		}
+
+		resp, err := client.HTTPClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			last_err = err
+			wait := Backoff(attempt, nil)
+			log.Printf(
+				"Request for '%s' failed (%v), retrying in %v.\n",
+				endpoint,
+				err,
+				wait,
+			)
+			if err := Sleep(ctx, wait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		blob, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			last_err = err
+			wait := Backoff(attempt, nil)
+			log.Printf(
+				"Reading '%s' failed (%v), retrying in %v.\n",
+				endpoint,
+				err,
+				wait,
+			)
+			if err := Sleep(ctx, wait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			return blob, nil
+		}
+
+		last_err = &StatusError{
+			Endpoint:   endpoint,
+			StatusCode: resp.StatusCode,
+			Body:       string(blob),
+		}
+		if !Retryable(resp.StatusCode) {
+			return nil, last_err
+		}
+		wait := Backoff(attempt, resp)
+		log.Printf(
+			"'%s' returned status code %d, retrying in %v.\n",
+			endpoint,
+			resp.StatusCode,
+			wait,
+		)
+		if err := Sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+	return nil, last_err
+}
+
+//
+// Fetches a request from the cache when it has a fresh enough copy
+// and otherwise from TMDB, caching the response.
+//
+func (client *Client) CachedFetch(
+	ctx context.Context,
+	endpoint string,
+	full_url string,
+	cache_url string,
+	ttl time.Duration,
+	bearer bool,
+) (
+	[]byte,
+	error,
+) {
+	if client.Cache != nil {
+		if blob, ok := client.Cache.Load(cache_url, ttl); ok {
+			return blob, nil
+		}
+		if client.Cache.Offline {
+			return nil, &OfflineError{URL: cache_url, NoCache: client.Cache.Dir == ""}
+		}
+	}
+	blob, err := client.Fetch(ctx, endpoint, full_url, bearer)
+	if err == nil && client.Cache != nil {
+		if err := client.Cache.Store(cache_url, blob); err != nil {
+			log.Printf("Couldn't cache '%s': %v\n", cache_url, err)
+		}
+	}
+	return blob, err
+}
+
+//
+// Gets an API endpoint and decodes the response into the structure given
+//
+func (client *Client) Get(
+	ctx context.Context,
+	endpoint string,
+	query url.Values,
+	output interface{},
+) error {
+	var ttl time.Duration
+	if client.Cache != nil {
+		ttl = client.Cache.TTL(endpoint)
+	}
+	blob, err := client.CachedFetch(
+		ctx,
+		endpoint,
+		client.KeyedEndpointURL(endpoint, query),
+		client.EndpointURL(endpoint, query),
+		ttl,
+		client.BearerAuth(),
+	)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(blob, output)
+	if err != nil {
+		return fmt.Errorf("couldn't decode '%s': %v", endpoint, err)
+	}
+	return nil
+}
+
+//
+// Searches for films. A year of 0 searches all years.
+//
+func (client *Client) SearchMovie(
+	ctx context.Context,
+	query string,
+	year int,
+) (
+	structs.TMDBMovieSearch,
+	error,
+) {
+	var search structs.TMDBMovieSearch
+	values := url.Values{"query": {query}}
+	if year != 0 {
+		values.Set("year", strconv.Itoa(year))
+	}
+	err := client.Get(ctx, "/search/movie", values, &search)
+	return search, err
+}
+
+//
+// Searches for tv shows. A year of 0 searches all years.
+//
+func (client *Client) SearchTV(
+	ctx context.Context,
+	query string,
+	year int,
+) (
+	structs.TMDBTVSearch,
+	error,
+) {
+	var search structs.TMDBTVSearch
+	values := url.Values{"query": {query}}
+	if year != 0 {
+		values.Set("first_air_date_year", strconv.Itoa(year))
+	}
+	err := client.Get(ctx, "/search/tv", values, &search)
+	return search, err
+}
+
+//
+// Gets a film's information
+//
+func (client *Client) Movie(ctx context.Context, id int) (structs.TMDBMovie, error) {
+	var movie structs.TMDBMovie
+	err := client.Get(ctx, "/movie/"+strconv.Itoa(id), nil, &movie)
+	return movie, err
+}
+
+//
+// Gets a collection's information
+//
+func (client *Client) Collection(
+	ctx context.Context,
+	id int,
+) (
+	structs.TMDBCollection,
+	error,
+) {
+	var collection structs.TMDBCollection
+	err := client.Get(ctx, "/collection/"+strconv.Itoa(id), nil, &collection)
+	return collection, err
+}
+
+//
+// Gets a tv show's information, without its seasons' episodes
+//
+func (client *Client) TV(ctx context.Context, id int) (structs.TMDBTV, error) {
+	var tv structs.TMDBTV
+	err := client.Get(ctx, "/tv/"+strconv.Itoa(id), nil, &tv)
+	return tv, err
+}
+
+//
+// Gets a season's information, including its episodes
+//
+func (client *Client) Season(
+	ctx context.Context,
+	tv_id int,
+	season_number int,
+) (
+	structs.TMDBSeason,
+	error,
+) {
+	var season structs.TMDBSeason
+	err := client.Get(
+		ctx,
+		"/tv/"+strconv.Itoa(tv_id)+"/season/"+strconv.Itoa(season_number),
+		nil,
+		&season,
+	)
+	return season, err
+}
+
+//
+// Gets a tv show's information with every season's episodes
+//
+func (client *Client) TVWithSeasons(
+	ctx context.Context,
+	id int,
+) (
+	structs.TMDBTV,
+	error,
+) {
+	tv, err := client.TV(ctx, id)
+	if err != nil {
+		return tv, err
+	}
+	for season_idx, season := range tv.Seasons {
+		tv.Seasons[season_idx], err = client.Season(ctx, id, season.SeasonNumber)
+		if err != nil {
+			return tv, err
+		}
+	}
+	return tv, nil
+}
+
+//
+// Downloads an image to the location given.
+// Nothing is left at the location if the download fails.
+//
+func (client *Client) DownloadImage(
+	ctx context.Context,
+	tmdb_img string,
+	location string,
+) (
+	int64,
+	error,
+) {
+	var ttl time.Duration
+	if client.Cache != nil {
+		ttl = client.Cache.ImageTTL
+	}
+	image_url := client.ImageURL + tmdb_img
+	blob, err := client.CachedFetch(ctx, tmdb_img, image_url, image_url, ttl, false)
+	if err != nil {
+		return 0, err
+	}
+	tmp_location := location + ".part"
+	file, err := os.Create(tmp_location)
+	if err != nil {
+		return 0, err
+	}
+	size, err := file.Write(blob)
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(tmp_location)
+		return 0, err
+	}
+	return int64(size), os.Rename(tmp_location, location)
+}
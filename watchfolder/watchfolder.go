@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"serviam/common"
+	"serviam/library"
+	"serviam/match"
+	"serviam/releasename"
+	"serviam/tmdb"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//---------------------------------------------------------------------------
+// Constants
+//---------------------------------------------------------------------------
+//
+// Settings
+//
+const (
+	DEFAULT_INTERVAL = 30 * time.Second
+	DEFAULT_SETTLE   = 2 * time.Minute
+	DEFAULT_SERVER   = "http://localhost:8042"
+	TOP_CANDIDATES   = 5
+	OUTPUT_LINES     = 20
+)
+
+//
+// Files and directories the watcher keeps in the inbox
+//
+const (
+	QUARANTINE_DIR = "quarantine"
+	REASON_SUFFIX  = ".reason.txt"
+	PLACED_FILE    = ".watchfolder.json"
+)
+
+//
+// directories the scripts and the watcher make in the inbox,
+// which aren't watched
+//
+var SKIPPED_DIRS = map[string]bool{
+	"pictures":     true,
+	"collections":  true,
+	"moved":        true,
+	QUARANTINE_DIR: true,
+}
+
+//---------------------------------------------------------------------------
+// Structures
+//---------------------------------------------------------------------------
+//
+// How big an inbox entry was and when it last changed.
+// Since is when the watcher first saw it like this.
+//
+type Sighting struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Since   time.Time `json:"-"`
+}
+
+//
+// Settings and state of the watcher.
+// Entries placed without moving them stay in the inbox,
+// so they are remembered until they change.
+//
+type Watcher struct {
+	client     *tmdb.Client
+	api_key    string
+	media_root string
+	inbox      string
+	bin_dir    string
+	placement  string
+	threshold  float64
+	settle     time.Duration
+	server     string
+	password   string
+	sightings  map[string]Sighting
+	placed     map[string]Sighting
+}
+
+//---------------------------------------------------------------------------
+// Functions
+//---------------------------------------------------------------------------
+//
+// Adds up the size of an entry and finds when it last changed,
+// with the number of videos in it
+//
+func SightEntry(location string) (Sighting, int, error) {
+	var sighting Sighting
+	num_videos := 0
+	err := filepath.Walk(location, func(
+		file_path string,
+		file_info os.FileInfo,
+		err error,
+	) error {
+		if err != nil {
+			return err
+		}
+		sighting.Size += file_info.Size()
+		if file_info.ModTime().After(sighting.ModTime) {
+			sighting.ModTime = file_info.ModTime()
+		}
+		if !file_info.IsDir() && library.IsVideoName(file_path) {
+			num_videos++
+		}
+		return nil
+	})
+	return sighting, num_videos, err
+}
+
+//
+// Checks whether an entry is a show,
+// a directory or a video named like an episode
+//
+func IsShow(name string, dir bool) bool {
+	return dir || releasename.Parse(name).IsEpisode()
+}
+
+//
+// Reads the entries placed before, a missing file has none
+//
+func (watcher *Watcher) ReadPlaced() {
+	watcher.placed = make(map[string]Sighting)
+	blob, err := ioutil.ReadFile(path.Join(watcher.inbox, PLACED_FILE))
+	if os.IsNotExist(err) {
+		return
+	}
+	common.CheckErr(err)
+	common.CheckErr(json.Unmarshal(blob, &watcher.placed))
+}
+
+//
+// Saves the entries placed, forgetting those which have gone
+//
+func (watcher *Watcher) SavePlaced() {
+	for name := range watcher.placed {
+		if _, err := os.Stat(path.Join(watcher.inbox, name)); os.IsNotExist(err) {
+			delete(watcher.placed, name)
+		}
+	}
+	blob, err := json.MarshalIndent(watcher.placed, "", common.INDENT)
+	common.CheckErr(err)
+	common.SaveBlob(blob, path.Join(watcher.inbox, PLACED_FILE))
+}
+
+//
+// Lists the entries of the inbox which have stopped changing,
+// videos and directories with videos in them.
+// Entries still being copied in change size or time between looks.
+//
+func (watcher *Watcher) Settled(now time.Time) []string {
+	var settled []string
+	dir_files, err := ioutil.ReadDir(watcher.inbox)
+	common.CheckErr(err)
+
+	seen := make(map[string]bool)
+	for _, dir_file := range dir_files {
+		name := dir_file.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if dir_file.IsDir() {
+			if SKIPPED_DIRS[name] || library.IsSidecarDir(name) {
+				continue
+			}
+		} else if !library.IsVideoName(name) {
+			continue
+		}
+
+		sighting, num_videos, err := SightEntry(path.Join(watcher.inbox, name))
+		if err != nil {
+			log.Printf("Couldn't look at '%s': %v\n", name, err)
+			continue
+		}
+		if num_videos == 0 {
+			continue
+		}
+		if placed, found := watcher.placed[name]; found &&
+			placed.Size == sighting.Size && placed.ModTime.Equal(sighting.ModTime) {
+			continue
+		}
+		seen[name] = true
+
+		last, found := watcher.sightings[name]
+		if !found || last.Size != sighting.Size || !last.ModTime.Equal(sighting.ModTime) {
+			sighting.Since = now
+			watcher.sightings[name] = sighting
+			if watcher.settle > 0 {
+				continue
+			}
+			last = sighting
+		}
+		if now.Sub(last.Since) >= watcher.settle {
+			settled = append(settled, name)
+		}
+	}
+	for name := range watcher.sightings {
+		if !seen[name] {
+			delete(watcher.sightings, name)
+		}
+	}
+	return settled
+}
+
+//
+// Gets the last lines of a script's output
+//
+func LastLines(output string, num_lines int) string {
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	if len(lines) > num_lines {
+		lines = lines[len(lines)-num_lines:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+//
+// Moves an entry to the quarantine directory
+// with a file next to it saying why it wasn't placed.
+// An entry already there with the same name is numbered.
+//
+func (watcher *Watcher) Quarantine(name string, reason string) {
+	quarantine_dir := path.Join(watcher.inbox, QUARANTINE_DIR)
+	common.CheckDir(quarantine_dir)
+
+	quarantined := name
+	taken := func(name string) bool {
+		_, err := os.Stat(path.Join(quarantine_dir, name))
+		return err == nil
+	}
+	for number := 2; taken(quarantined); number++ {
+		ext := filepath.Ext(name)
+		quarantined = fmt.Sprintf("%s.%d%s", strings.TrimSuffix(name, ext), number, ext)
+	}
+	err := os.Rename(path.Join(watcher.inbox, name), path.Join(quarantine_dir, quarantined))
+	common.CheckErr(err)
+	common.SaveBlob([]byte(reason), path.Join(quarantine_dir, quarantined+REASON_SUFFIX))
+	delete(watcher.sightings, name)
+	log.Printf("Quarantined '%s'.\n", name)
+}
+
+//
+// Describes the candidates found for an entry
+//
+func DescribeCandidates(
+	kind string,
+	query string,
+	year int,
+	candidates []match.Candidate,
+) string {
+	var reason strings.Builder
+	if year != 0 {
+		fmt.Fprintf(&reason, "Searched TMDB for the %s '%s' (%d).\n", kind, query, year)
+	} else {
+		fmt.Fprintf(&reason, "Searched TMDB for the %s '%s'.\n", kind, query)
+	}
+	if len(candidates) > TOP_CANDIDATES {
+		candidates = candidates[:TOP_CANDIDATES]
+	}
+	for _, candidate := range candidates {
+		fmt.Fprintf(
+			&reason,
+			"%6.3f  %s (%s), TMDB id %d\n",
+			candidate.Score,
+			candidate.Title,
+			candidate.ReleaseDate,
+			candidate.Id,
+		)
+	}
+	return reason.String()
+}
+
+//
+// Matches an entry and places it as a film
+// the way posterplucker and posterplacer do, or as a show as getshow does.
+// Entries which can't be matched with confidence,
+// or aren't placed, are quarantined.
+// Returns whether anything was placed.
+//
+func (watcher *Watcher) Ingest(name string) bool {
+	location := path.Join(watcher.inbox, name)
+	info, err := os.Stat(location)
+	if err != nil {
+		log.Printf("Couldn't look at '%s': %v\n", name, err)
+		return false
+	}
+	show := IsShow(name, info.IsDir())
+	kind := "film"
+	if show {
+		kind = "show"
+	}
+	query, year := releasename.Query(name)
+	log.Printf("Matching '%s' as a %s.\n", name, kind)
+
+	candidates, err := match.Search(watcher.client, show, query, year)
+	if err != nil {
+		// TMDB may only be unreachable for now, so try again later
+		log.Printf("Couldn't search for '%s': %v\n", name, err)
+		return false
+	}
+	description := DescribeCandidates(kind, query, year, candidates)
+	if len(candidates) == 0 {
+		watcher.Quarantine(name, "Nothing was found.\n"+description)
+		return false
+	}
+	if !match.Confident(candidates, watcher.threshold) {
+		watcher.Quarantine(name, fmt.Sprintf(
+			"No match was good enough, scoring at least %.2f"+
+				" and %.2f ahead of the next.\n%s",
+			watcher.threshold,
+			match.MIN_MARGIN,
+			description,
+		))
+		return false
+	}
+	log.Printf(
+		"Matched '%s' to '%s' (%s) with a score of %.3f.\n",
+		name,
+		candidates[0].Title,
+		candidates[0].ReleaseDate,
+		candidates[0].Score,
+	)
+
+	var output bytes.Buffer
+	run_script := func(name string, args ...string) error {
+		log.Printf("Running %s.\n", name)
+		return match.RunScript(
+			watcher.bin_dir,
+			watcher.inbox,
+			io.MultiWriter(os.Stdout, &output),
+			name,
+			args...,
+		)
+	}
+	tmdb_id := strconv.Itoa(candidates[0].Id)
+	if show {
+		err = run_script(
+			"getshow",
+			"-id", tmdb_id,
+			"-yes",
+			"-placement", watcher.placement,
+			watcher.api_key,
+			watcher.media_root,
+			location,
+		)
+	} else {
+		err = run_script("posterplucker", "-id", tmdb_id, watcher.api_key, name)
+		if err == nil {
+			err = run_script(
+				"posterplacer",
+				"-placement", watcher.placement,
+				watcher.media_root,
+				strings.TrimSuffix(name, filepath.Ext(name))+".json",
+			)
+		}
+	}
+	if err != nil {
+		watcher.Quarantine(name, fmt.Sprintf(
+			"Placing it failed: %v\n%s\n%s\n",
+			err,
+			description,
+			LastLines(output.String(), OUTPUT_LINES),
+		))
+		return false
+	}
+
+	// what is left of a moved entry wasn't placed, such as unmatched episodes
+	sighting, num_videos, err := SightEntry(location)
+	if err == nil && num_videos > 0 {
+		if watcher.placement == common.PLACE_MOVE {
+			watcher.Quarantine(name, fmt.Sprintf(
+				"Some of it wasn't placed, it may be in the library already"+
+					" or have episodes which couldn't be matched.\n%s\n%s\n",
+				description,
+				LastLines(output.String(), OUTPUT_LINES),
+			))
+		} else {
+			watcher.placed[name] = sighting
+			watcher.SavePlaced()
+		}
+	}
+	log.Printf("Placed '%s'.\n", name)
+	return true
+}
+
+//
+// Makes a request to the server's /rescan,
+// logging in if there is an admin password
+//
+func (watcher *Watcher) RescanRequest(method string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(
+		method,
+		strings.TrimSuffix(watcher.server, "/")+"/rescan",
+		strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if watcher.password != "" {
+		req.SetBasicAuth("admin", watcher.password)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+//
+// Asks the server to reload the library,
+// with the token it gives for asking.
+// The server not running isn't a problem, it loads the library when it starts.
+//
+func (watcher *Watcher) Notify() {
+	if watcher.server == "" {
+		return
+	}
+	resp, err := watcher.RescanRequest(http.MethodGet, nil)
+	if err != nil {
+		log.Printf("Couldn't ask the server to rescan: %v\n", err)
+		return
+	}
+	token, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil && resp.StatusCode >= 300 {
+		err = fmt.Errorf("%s", resp.Status)
+	}
+	if err != nil {
+		log.Printf("Couldn't ask the server to rescan: %v\n", err)
+		return
+	}
+
+	resp, err = watcher.RescanRequest(http.MethodPost, url.Values{"csrf": {string(token)}})
+	if err != nil {
+		log.Printf("Couldn't ask the server to rescan: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Couldn't ask the server to rescan: %s\n", resp.Status)
+		return
+	}
+	log.Printf("Asked the server to rescan.\n")
+}
+
+//
+// Places the entries which have settled,
+// asking the server to rescan if anything was placed
+//
+func (watcher *Watcher) Poll() {
+	num_placed := 0
+	for _, name := range watcher.Settled(time.Now()) {
+		if watcher.Ingest(name) {
+			num_placed++
+		}
+	}
+	if num_placed > 0 {
+		watcher.Notify()
+	}
+}
+
+//---------------------------------------------------------------------------
+// Main
+//---------------------------------------------------------------------------
+//
+func main() {
+	interval := flag.Duration("interval", DEFAULT_INTERVAL, "how often the inbox is looked at")
+	settle := flag.Duration("settle", DEFAULT_SETTLE, "how long entries must stop changing for")
+	threshold := flag.Float64("threshold", match.DEFAULT_THRESHOLD, "lowest score placed")
+	server := flag.String("server", DEFAULT_SERVER, "server to ask to rescan, none if empty")
+	once := flag.Bool("once", false, "place what is in the inbox now and stop")
+	placement := flag.String(
+		"placement",
+		common.PLACE_MOVE,
+		"how files are put in the media directory: "+
+			strings.Join(common.PLACEMENTS, ", "),
+	)
+	flag.Parse()
+
+	if flag.NArg() < 3 {
+		println(
+			"Please provide an API key,",
+			"the media root",
+			"and the inbox directory.",
+		)
+		return
+	}
+	err := common.CheckPlacement(*placement)
+	common.CheckErr(err)
+	media_root, err := filepath.Abs(flag.Arg(1))
+	common.CheckErr(err)
+	inbox, err := filepath.Abs(flag.Arg(2))
+	common.CheckErr(err)
+	common.CheckDir(media_root)
+	common.CheckDir(inbox)
+
+	watcher := &Watcher{
+		client:     tmdb.NewClient(flag.Arg(0)),
+		api_key:    flag.Arg(0),
+		media_root: media_root,
+		inbox:      inbox,
+		bin_dir:    os.Getenv("SERVIAM_BIN_DIR"),
+		placement:  *placement,
+		threshold:  *threshold,
+		settle:     *settle,
+		server:     *server,
+		password:   os.Getenv("SERVIAM_ADMIN_PASSWORD"),
+		sightings:  make(map[string]Sighting),
+	}
+	watcher.ReadPlaced()
+
+	if *once {
+		watcher.settle = 0
+		watcher.Poll()
+		return
+	}
+	log.Printf("Watching '%s' every %v.\n", inbox, *interval)
+	for {
+		watcher.Poll()
+		time.Sleep(*interval)
+	}
+}